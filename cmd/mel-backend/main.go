@@ -0,0 +1,331 @@
+/*
+Command line entry point for the backend.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/mel-app/backend/src"
+)
+
+// version is the version of this binary; override it when building with
+// -ldflags "-X main.version=<version>".
+var version = "dev"
+
+const usage = `Usage: mel-backend <command> [flags] [arguments]
+
+Commands:
+	serve                       run the server
+	migrate                     bring the database schema up to date
+	seed-demo                   add the demo users and projects
+	user add <name>             add a user (password is read from stdin)
+	user promote <name>         make the user a manager
+	user demote <name>          make the user a normal user
+	user delete <name>          delete the user and their projects
+	user set-password <name>    change the password (read from stdin)
+	version                     print version information
+
+Run 'mel-backend <command> -h' for the flags accepted by each command.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "serve":
+		err = serve(os.Args[2:])
+	case "migrate":
+		err = migrate(os.Args[2:])
+	case "seed-demo":
+		err = seedDemo(os.Args[2:])
+	case "user":
+		err = user(os.Args[2:])
+	case "version":
+		err = printVersion(os.Args[2:])
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mel-backend %s: %s\n", os.Args[1], strings.TrimSpace(err.Error()))
+		os.Exit(1)
+	}
+}
+
+// env returns the value of the given environment variable, or def if unset.
+func env(name, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
+
+// database holds the common database flags.
+type database struct {
+	driver string
+	dsn    string
+}
+
+// newFlagSet returns a flag set with the common database flags.
+func newFlagSet(name string) (*flag.FlagSet, *database) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	d := database{}
+	flags.StringVar(&d.driver, "driver", env("DATABASE_DRIVER", "postgres"),
+		"database driver, either postgres or sqlite3 ($DATABASE_DRIVER)")
+	flags.StringVar(&d.dsn, "dsn", env("DATABASE_URL", ""),
+		"database connection string or SQLite file name ($DATABASE_URL)")
+	return flags, &d
+}
+
+// passwordHashFlag adds the -password-hash flag to the given flag set.
+func passwordHashFlag(flags *flag.FlagSet) *string {
+	return flags.String("password-hash", env("PASSWORD_HASH", "scrypt"),
+		"algorithm for new passwords, scrypt or argon2id ($PASSWORD_HASH)")
+}
+
+// open opens the database and returns the corresponding store.
+func (d *database) open() (backend.Store, *sql.DB, error) {
+	if d.dsn == "" {
+		return nil, nil, fmt.Errorf("no database given; set -dsn or $DATABASE_URL")
+	}
+	db, err := sql.Open(d.driver, d.dsn)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = db.Ping()
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	switch d.driver {
+	case "postgres":
+		return backend.NewPostgresStore(db), db, nil
+	case "sqlite3":
+		return backend.NewSQLiteStore(db), db, nil
+	}
+	db.Close()
+	return nil, nil, fmt.Errorf("unsupported driver %q", d.driver)
+}
+
+// serve runs the server until interrupted.
+func serve(args []string) error {
+	flags, database := newFlagSet("serve")
+	port := flags.String("port", env("PORT", "8080"), "port to listen on ($PORT)")
+	cert := flags.String("tls-cert", env("TLS_CERT", ""),
+		"TLS certificate file; serves HTTPS if set ($TLS_CERT)")
+	key := flags.String("tls-key", env("TLS_KEY", ""), "TLS key file ($TLS_KEY)")
+	readTimeout := flags.Duration("read-timeout", 30*time.Second, "request read timeout")
+	writeTimeout := flags.Duration("write-timeout", 30*time.Second, "response write timeout")
+	idleTimeout := flags.Duration("idle-timeout", 2*time.Minute, "keep-alive idle timeout")
+	migrate := flags.Bool("migrate", false, "migrate the database before serving")
+	hash := passwordHashFlag(flags)
+	flags.Parse(args)
+	if (*cert == "") != (*key == "") {
+		return fmt.Errorf("both -tls-cert and -tls-key are required for TLS")
+	}
+	err := backend.SetPasswordHash(*hash)
+	if err != nil {
+		return err
+	}
+
+	store, db, err := database.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if *migrate {
+		err = backend.NewDB(store).Migrate()
+		if err != nil {
+			return err
+		}
+	}
+	err = checkVersion(store)
+	if err != nil {
+		return err
+	}
+
+	opts := []backend.Option{
+		backend.WithTimeouts(*readTimeout, *writeTimeout, *idleTimeout),
+	}
+	if *cert != "" {
+		opts = append(opts, backend.WithTLSCertificate(*cert, *key))
+	}
+	server, err := backend.NewServer(":"+*port, store, opts...)
+	if err != nil {
+		return err
+	}
+
+	// Shut down gracefully when interrupted.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	log.Printf("Running on port :%s\n", *port)
+	return server.ListenAndServe(ctx)
+}
+
+// checkVersion returns an error unless the schema is up to date.
+func checkVersion(store backend.Store) error {
+	current, err := backend.NewDB(store).Version()
+	if err != nil {
+		return err
+	}
+	latest, err := backend.LatestVersion()
+	if err != nil {
+		return err
+	}
+	if current != latest {
+		return fmt.Errorf("schema is at version %d, but version %d is required; run migrate or serve -migrate",
+			current, latest)
+	}
+	return nil
+}
+
+// migrate brings the database schema up to date, or to the given version.
+func migrate(args []string) error {
+	flags, database := newFlagSet("migrate")
+	to := flags.Int("to", -1, "schema version to migrate to (default latest)")
+	flags.Parse(args)
+
+	store, db, err := database.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	d := backend.NewDB(store)
+	if *to < 0 {
+		err = d.Migrate()
+	} else {
+		err = d.MigrateTo(*to)
+	}
+	if err != nil {
+		return err
+	}
+	current, err := d.Version()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Schema is at version %d\n", current)
+	return nil
+}
+
+// seedDemo adds the demo data.
+func seedDemo(args []string) error {
+	flags, database := newFlagSet("seed-demo")
+	flags.Parse(args)
+
+	store, db, err := database.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return backend.NewDB(store).SeedDemo()
+}
+
+// user manages user accounts.
+func user(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("expected one of add, promote, demote, delete, set-password")
+	}
+	action := args[0]
+	switch action {
+	case "add", "promote", "demote", "delete", "set-password":
+	default:
+		return fmt.Errorf("unknown action %q", action)
+	}
+	flags, database := newFlagSet("user " + action)
+	manager := false
+	if action == "add" {
+		flags.BoolVar(&manager, "manager", false, "make the new user a manager")
+	}
+	hash := passwordHashFlag(flags)
+	flags.Parse(args[1:])
+	if flags.NArg() != 1 {
+		return fmt.Errorf("expected a single user name")
+	}
+	name := flags.Arg(0)
+	err := backend.SetPasswordHash(*hash)
+	if err != nil {
+		return err
+	}
+
+	store, db, err := database.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	d := backend.NewDB(store)
+
+	switch action {
+	case "add":
+		password, err := readPassword(os.Stdin)
+		if err != nil {
+			return err
+		}
+		return d.AddUser(name, password, manager)
+	case "promote":
+		return d.SetIsManager(name, true)
+	case "demote":
+		return d.SetIsManager(name, false)
+	case "delete":
+		return d.DeleteUser(name)
+	case "set-password":
+		password, err := readPassword(os.Stdin)
+		if err != nil {
+			return err
+		}
+		return d.SetPassword(name, password)
+	}
+	return nil
+}
+
+// readPassword reads a password from the first line of the given reader.
+func readPassword(r io.Reader) (string, error) {
+	password, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		return "", fmt.Errorf("no password given on stdin")
+	}
+	return password, nil
+}
+
+// printVersion prints the binary and schema versions.
+func printVersion(args []string) error {
+	flags := flag.NewFlagSet("version", flag.ExitOnError)
+	flags.Parse(args)
+
+	schema, err := backend.LatestVersion()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("mel-backend %s (schema version %d)\n", version, schema)
+	return nil
+}
+
+// vim: sw=4 ts=4 noexpandtab
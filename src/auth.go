@@ -8,72 +8,156 @@ Contact:	<hobbitalastair at yandex dot com>
 package backend
 
 import (
-	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
 	"fmt"
 	"log"
 	"net/http"
 
-	"database/sql"
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/scrypt"
 )
 
 const passwordSize = 256
 
+// passwordHash records how a password was hashed.
+// The parameters are stored alongside each password so that the defaults can
+// be raised over time; users are migrated when they next log in.
+// For scrypt, N, R and P are the usual cost parameters. For argon2id, N is the
+// memory cost in KiB, R the number of iterations, and P the parallelism.
+type passwordHash struct {
+	Algorithm string
+	N         int
+	R         int
+	P         int
+	KeyLen    int
+}
+
+// Supported password hashing schemes.
+var (
+	scryptHash   = passwordHash{"scrypt", 1 << 16, 8, 1, passwordSize}
+	argon2idHash = passwordHash{"argon2id", 64 * 1024, 3, 4, 32}
+)
+
+// passwordHashes maps each algorithm to the parameters used for new
+// passwords; see SetPasswordHash.
+var passwordHashes = map[string]passwordHash{
+	scryptHash.Algorithm:   scryptHash,
+	argon2idHash.Algorithm: argon2idHash,
+}
+
+// defaultHash is used for any new or changed passwords.
+var defaultHash = scryptHash
+
+// SetPasswordHash sets the algorithm used for new and changed passwords,
+// either "scrypt" (the default) or "argon2id".
+// Existing passwords are rehashed when the user next logs in.
+// This should be called before serving any requests.
+func SetPasswordHash(algorithm string) error {
+	hash, ok := passwordHashes[algorithm]
+	if !ok {
+		return fmt.Errorf("Unknown password hash algorithm %q\n", algorithm)
+	}
+	defaultHash = hash
+	return nil
+}
+
 // internalError ends the request and logs an internal error.
 func internalError(fail func(int), err error) {
 	fail(http.StatusInternalServerError)
 	log.Printf("%q\n", err)
 }
 
-// SetPassword sets the given user's password.
-// TODO: We should not need to export this.
-func SetPassword(user, password string, db *sql.DB) error {
-	salt := make([]byte, passwordSize)
-	err := db.QueryRow("SELECT salt FROM users WHERE name=$1", user).Scan(&salt)
+// setPassword sets the given user's password, and revokes all of their
+// sessions so that a leaked session token does not outlive a password reset.
+// The store should be a transaction, so that both happen together.
+func setPassword(user, password string, store Store) error {
+	err := rehashPassword(user, password, store)
 	if err != nil {
-		return fmt.Errorf("Failed to find existing salt: %q\n", err)
+		return err
 	}
-	key, err := encryptPassword(password, salt)
+	return store.deleteSessions(user)
+}
+
+// rehashPassword stores the password with a new salt and the default
+// parameters, leaving any sessions alone.
+func rehashPassword(user, password string, store Store) error {
+	salt, key, err := newPassword(password)
 	if err != nil {
 		return fmt.Errorf("Failed to encrypt the user password: %q\n", err)
 	}
-	_, err = db.Exec("UPDATE users SET password=$1 WHERE name=$2", key, user)
-	if err != nil {
+	err = store.setPassword(user, salt, key, defaultHash)
+	if err == notFound {
+		return fmt.Errorf("Failed to update the user password: no such user %q\n", user)
+	} else if err != nil {
 		return fmt.Errorf("Failed to update the user password: %q\n", err)
 	}
 	return nil
 }
 
+// newPassword generates a new salt and hashes the given password with the
+// default parameters.
+func newPassword(password string) (salt, key []byte, err error) {
+	salt = make([]byte, passwordSize)
+	_, err = rand.Read(salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err = encryptPassword(password, salt, defaultHash)
+	return salt, key, err
+}
+
 // encryptPassword salts and encrypts the given password.
-func encryptPassword(password string, salt []byte) ([]byte, error) {
+func encryptPassword(password string, salt []byte, params passwordHash) ([]byte, error) {
 	// We salt and encrypt the password to avoid potential security issues if
 	// the db is stolen.
-	// This appears to be reasonably close to "best practice", but the 1<<16
-	// value probably should be checked for sanity.
-	// FIXME: We don't store the 1<<16 value in the db, but it should be
-	// increased as compute power grows. Doing so is complicated since some way
-	// of migrating users from the old value would also need to be implemented.
-	return scrypt.Key([]byte(password), salt, 1<<16, 8, 1, passwordSize)
+	switch params.Algorithm {
+	case "scrypt":
+		return scrypt.Key([]byte(password), salt, params.N, params.R,
+			params.P, params.KeyLen)
+	case "argon2id":
+		if params.N <= 0 || params.R <= 0 || params.P <= 0 || params.P > 255 || params.KeyLen <= 0 {
+			return nil, fmt.Errorf("Invalid argon2id parameters %v\n", params)
+		}
+		return argon2.IDKey([]byte(password), salt, uint32(params.R),
+			uint32(params.N), uint8(params.P), uint32(params.KeyLen)), nil
+	}
+	return nil, fmt.Errorf("Unknown password hash algorithm %q\n", params.Algorithm)
 }
 
-// authenticateUser checks that the user and password in the given HTTP request.
-func authenticateUser(writer http.ResponseWriter, fail func(int), request *http.Request, db *sql.DB) (user, password string, ok bool) {
+// authenticateUser checks the user and password, or the session token, in the
+// given HTTP request.
+// Session tokens are much cheaper to check than passwords.
+func authenticateUser(writer http.ResponseWriter, fail func(int), request *http.Request, store Store) (user, password string, ok bool) {
+	if token, found := bearerToken(request); found {
+		user, ok, err := authenticateToken(token, store)
+		if err != nil {
+			internalError(fail, err)
+			return user, "", false
+		} else if !ok {
+			log.Printf("Invalid session token\n")
+			writer.Header().Add("WWW-Authenticate", "bearer realm=\"\", error=\"invalid_token\"")
+			fail(http.StatusUnauthorized)
+			return user, "", false
+		}
+		return user, "", true
+	}
+
 	// get the user name and password.
 	user, password, ok = request.BasicAuth()
 	if !ok {
 		writer.Header().Add("WWW-Authenticate", "basic realm=\"\"")
+		writer.Header().Add("WWW-Authenticate", "bearer realm=\"\"")
 		fail(http.StatusUnauthorized)
 		return user, password, false
 	}
 
-	// Retrieve the salt and database password.
-	salt := make([]byte, passwordSize)
-	dbpassword := []byte("")
-	err := db.QueryRow("SELECT salt, password FROM users WHERE name=$1", user).Scan(&salt, &dbpassword)
-	if err == sql.ErrNoRows && request.URL.Path == "/login" && request.Method == http.MethodPost {
+	// Retrieve the salt, database password, and hash parameters.
+	salt, dbpassword, params, err := store.password(user)
+	if err == notFound && request.URL.Path == "/login" && request.Method == http.MethodPost {
 		// FIXME: Special case creating a new user.
 		return user, password, true
-	} else if err == sql.ErrNoRows {
+	} else if err == notFound {
 		log.Printf("No such user %s\n", user)
 		fail(http.StatusForbidden)
 		return user, password, false
@@ -82,26 +166,36 @@ func authenticateUser(writer http.ResponseWriter, fail func(int), request *http.
 		return user, password, false
 	}
 
-	key, err := encryptPassword(password, salt)
+	key, err := encryptPassword(password, salt, params)
 	if err != nil {
 		internalError(fail, err)
 		return user, password, false
 	}
-	if !bytes.Equal(key, dbpassword) {
+	if subtle.ConstantTimeCompare(key, dbpassword) != 1 {
 		log.Printf("Invalid password for user %s\n", user)
 		fail(http.StatusForbidden)
 		return user, password, false
 	}
+
+	// Migrate the user to the current defaults if required.
+	// The password is known to be valid, so failures here are not fatal.
+	if params != defaultHash {
+		err = rehashPassword(user, password, store)
+		if err != nil {
+			log.Printf("Failed to rehash the password for %s: %q\n", user, err)
+		}
+	}
 	return user, password, true
 }
 
 // authenticateRequest checks that the given user has permission to complete
 // the request.
-func authenticateRequest(request *http.Request, defaultResource resource) (ok bool) {
-	return ((request.Method == http.MethodGet) && (defaultResource.forbidden()&get == 0)) ||
-		((request.Method == http.MethodPut) && (defaultResource.forbidden()&set == 0)) ||
-		((request.Method == http.MethodPost) && (defaultResource.forbidden()&create == 0)) ||
-		((request.Method == http.MethodDelete) && (defaultResource.forbidden()&delete == 0))
+func authenticateRequest(method string, defaultResource resource) (ok bool) {
+	return ((method == http.MethodGet) && (defaultResource.forbidden()&get == 0)) ||
+		((method == http.MethodPut) && (defaultResource.forbidden()&set == 0)) ||
+		((method == http.MethodPatch) && (defaultResource.forbidden()&set == 0)) ||
+		((method == http.MethodPost) && (defaultResource.forbidden()&create == 0)) ||
+		((method == http.MethodDelete) && (defaultResource.forbidden()&delete == 0))
 }
 
 // vim: sw=4 ts=4 noexpandtab
@@ -0,0 +1,135 @@
+/*
+Tests for password hashing.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package backend
+
+import (
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// usePasswordHash sets the default password hash for the rest of the test.
+// Tests using this must not run in parallel.
+func usePasswordHash(t *testing.T, algorithm string) {
+	t.Helper()
+	old := defaultHash
+	t.Cleanup(func() { defaultHash = old })
+	err := SetPasswordHash(algorithm)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// addUserWithHash adds a user whose password is hashed with the given
+// parameters, as if added before the defaults changed.
+func addUserWithHash(t *testing.T, store Store, user, password string, hash passwordHash) {
+	t.Helper()
+	salt := make([]byte, passwordSize)
+	_, err := rand.Read(salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := encryptPassword(password, salt, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.addUser(user, salt, key, hash, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkLogin fails unless the user can log in with the password.
+func checkLogin(t *testing.T, handler http.Handler, user, password string) {
+	t.Helper()
+	request := httptest.NewRequest(http.MethodGet, "/login", nil)
+	request.SetBasicAuth(user, password)
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+	if response.Code != http.StatusOK {
+		t.Fatalf("Expected 200 logging in, got %d", response.Code)
+	}
+}
+
+// checkHash fails unless the user's password is hashed with the given
+// parameters.
+func checkHash(t *testing.T, store Store, user string, hash passwordHash) {
+	t.Helper()
+	_, _, params, err := store.password(user)
+	if err != nil {
+		t.Fatal(err)
+	} else if params != hash {
+		t.Fatalf("Expected %v, got %v", hash, params)
+	}
+}
+
+func TestRehashOldScrypt(t *testing.T) {
+	store := newTestStore(t)
+	old := passwordHash{"scrypt", 1 << 14, 8, 1, passwordSize}
+	addUserWithHash(t, store, "user", "password", old)
+	handler := NewHandler(store)
+
+	checkLogin(t, handler, "user", "password")
+	checkHash(t, store, "user", scryptHash)
+	checkLogin(t, handler, "user", "password")
+}
+
+func TestRehashToArgon2id(t *testing.T) {
+	usePasswordHash(t, "argon2id")
+	store := newTestStore(t)
+	old := passwordHash{"scrypt", 1 << 14, 8, 1, passwordSize}
+	addUserWithHash(t, store, "user", "password", old)
+	handler := NewHandler(store)
+
+	checkLogin(t, handler, "user", "password")
+	checkHash(t, store, "user", argon2idHash)
+	checkLogin(t, handler, "user", "password")
+}
+
+func TestRehashFromArgon2id(t *testing.T) {
+	store := newTestStore(t)
+	addUserWithHash(t, store, "user", "password", argon2idHash)
+	handler := NewHandler(store)
+
+	checkLogin(t, handler, "user", "password")
+	checkHash(t, store, "user", scryptHash)
+}
+
+func TestNewUsersUseChosenHash(t *testing.T) {
+	usePasswordHash(t, "argon2id")
+	store := newTestStore(t)
+	err := NewDB(store).AddUser("user", "password", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHash(t, store, "user", argon2idHash)
+	// Already using the chosen hash, so left alone.
+	_, key, _, err := store.password("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLogin(t, NewHandler(store), "user", "password")
+	_, rehashed, _, err := store.password("user")
+	if err != nil {
+		t.Fatal(err)
+	} else if string(key) != string(rehashed) {
+		t.Fatal("Expected the password to be left alone")
+	}
+}
+
+func TestUnknownPasswordHash(t *testing.T) {
+	err := SetPasswordHash("md5")
+	if err == nil {
+		t.Fatal("Expected an error for an unknown algorithm")
+	} else if defaultHash != scryptHash {
+		t.Fatalf("Expected the default to be unchanged, got %v", defaultHash)
+	}
+}
+
+// vim: sw=4 ts=4 noexpandtab
@@ -8,55 +8,129 @@ Contact:	<hobbitalastair at yandex dot com>
 package backend
 
 import (
+	"bytes"
 	"encoding/json"
-	"log"
+	"io"
 	"net/http"
-
-	"database/sql"
+	"net/url"
 )
 
 // handle a single HTTP request.
-func handle(writer http.ResponseWriter, request *http.Request, db *sql.DB) {
+func handle(writer http.ResponseWriter, request *http.Request, c config, store Store) {
 	// Wrapper for failing functions.
-	fail := func(status int) { http.Error(writer, http.StatusText(status), status) }
+	fail := func(status int) { writeProblem(writer, statusProblem(status)) }
 
 	// Authenticate the user.
-	user, password, ok := authenticateUser(writer, fail, request, db)
+	user, password, ok := authenticateUser(writer, fail, request, store)
 	if !ok {
 		return
 	}
 
-	// get the corresponding defaultResource and authenticate the request.
-	defaultResource, err := fromURI(user, password, request.URL.Path, db)
-	if err == invalidResource {
-		http.NotFound(writer, request)
+	// Event streams and WebSockets last much longer than a normal request, so
+	// can't run in a single transaction.
+	if isEventStream(request.URL.Path) {
+		serveEvents(writer, request, user, store)
 		return
-	} else if err != nil {
-		internalError(fail, err)
+	} else if request.URL.Path == wsPath {
+		serveWebSocket(writer, request, user, password, c, store)
 		return
 	}
-	if !authenticateRequest(request, defaultResource) {
-		fail(http.StatusForbidden)
+
+	// Each request runs in a single transaction, so that a failure part way
+	// through does not leave the database in an inconsistent state.
+	tx, err := store.begin()
+	if err != nil {
+		internalError(fail, err)
 		return
 	}
+	defer tx.rollback()
+
+	var res *result
+	if request.URL.Path == batchPath {
+		res, err = batch(user, password, request, c, tx)
+	} else {
+		res, err = perform(user, password, request.Method, request.URL,
+			request.Header, request.Body, c, tx)
+	}
+	if err == nil {
+		err = tx.commit()
+	}
+	if errorStatus(err) == http.StatusInternalServerError {
+		internalError(fail, err)
+	} else if err != nil {
+		writeProblem(writer, newProblem(err))
+	} else {
+		if res.location != "" {
+			writer.Header().Add("Location", res.location)
+		}
+		if res.etag != "" {
+			writer.Header().Add("ETag", res.etag)
+		}
+		writer.WriteHeader(res.status)
+		writer.Write(res.body.Bytes())
+	}
+}
+
+// result is the buffered response to an operation.
+// The response is buffered until the transaction is committed, so that
+// clients never see a success for changes which were not saved.
+type result struct {
+	status   int
+	location string
+	etag     string // Only set for GET.
+	body     bytes.Buffer
+}
+
+// perform a single operation on the resource at the given URI.
+// header holds the request headers used by conditional requests (see
+// checkPreconditions) and PATCH.
+func perform(user, password, method string, uri *url.URL, header http.Header, body io.Reader, c config, store Store) (*result, error) {
+	// get the corresponding defaultResource and authenticate the request.
+	defaultResource, err := fromURI(user, password, uri.Path, uri.Query(),
+		c, store)
+	if err != nil {
+		return nil, err
+	}
+	if !authenticateRequest(method, defaultResource) {
+		return nil, accessDenied
+	}
+	switch method {
+	case http.MethodPut, http.MethodPatch, http.MethodDelete:
+		err = checkPreconditions(defaultResource, header)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	// Respond.
-	enc := json.NewEncoder(writer)
+	res := &result{status: http.StatusOK}
+	enc := json.NewEncoder(&res.body)
 	enc.SetEscapeHTML(true)
-	switch request.Method {
+	switch method {
 	case http.MethodGet:
 		err = defaultResource.get(enc)
+		if err == nil {
+			res.etag = etagOf(res.body.Bytes())
+			ifNoneMatch := header.Get("If-None-Match")
+			if ifNoneMatch != "" && etagMatches(ifNoneMatch, res.etag, true) {
+				res.status = http.StatusNotModified
+				res.body.Reset()
+			}
+		}
 	case http.MethodPut:
-		err = defaultResource.set(json.NewDecoder(request.Body))
+		// Synchronised items respond with the merged state.
+		err = defaultResource.set(json.NewDecoder(body), enc)
+	case http.MethodPatch:
+		err = patch(defaultResource, header.Get("Content-Type"), body, enc)
 	case http.MethodPost:
 		// Posts need to return 201 with a Location header with the URI to the
 		// newly created defaultResource.
 		// They should also use enc to write a representation of the object
 		// created, preferably including the id.
-		err = defaultResource.create(json.NewDecoder(request.Body),
-			func(location string, item interface{}) error {
-				writer.Header().Add("Location", location)
-				writer.WriteHeader(http.StatusCreated)
+		err = defaultResource.create(json.NewDecoder(body),
+			func(uri string, item interface{}) error {
+				res.location = uri
+				res.status = http.StatusCreated
 				return enc.Encode(item)
 			})
 	case http.MethodDelete:
@@ -64,24 +138,7 @@ func handle(writer http.ResponseWriter, request *http.Request, db *sql.DB) {
 	default:
 		err = invalidMethod
 	}
-	if err == invalidBody {
-		fail(http.StatusBadRequest)
-	} else if err == invalidMethod {
-		fail(http.StatusMethodNotAllowed)
-	} else if err != nil {
-		internalError(fail, err)
-	}
-}
-
-// Run the server on the given port, connecting to the given database.
-func Run(port string, db *sql.DB) {
-	log.Printf("Running on port :%s\n", port)
-	seed()
-	log.Fatal(http.ListenAndServe(":"+port,
-		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			handle(w, r, db)
-		}),
-	))
+	return res, err
 }
 
 // vim: sw=4 ts=4 noexpandtab
@@ -0,0 +1,169 @@
+/*
+Batched operations, letting clients push many changes in a single request.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+const (
+	batchPath = "/batch"
+	// maxBatchSize is the maximum number of operations in a batch.
+	maxBatchSize = 100
+)
+
+// operation is a single request within a batch.
+type operation struct {
+	Method string
+	Path   string // May include a query string.
+	Body   json.RawMessage
+	// ContentType is only needed for JSON Patch; see patch.
+	ContentType string `json:",omitempty"`
+	// IfMatch and IfNoneMatch make the operation conditional, like the
+	// corresponding headers; see checkPreconditions.
+	IfMatch     string `json:",omitempty"`
+	IfNoneMatch string `json:",omitempty"`
+}
+
+// operationResult is the response to a single operation.
+// Body lists the values the operation would have returned by itself; items
+// return a single value, and lists return one value per entry.
+type operationResult struct {
+	Status   int
+	Location string            `json:",omitempty"`
+	ETag     string            `json:",omitempty"`
+	Body     []json.RawMessage `json:",omitempty"`
+	Error    *problem          `json:",omitempty"` // Set for failures.
+}
+
+// batch performs each operation in the body of the request in turn, and
+// responds with the result of each.
+// Each operation is run in a nested transaction, so failed operations do not
+// leave partial changes.
+// If "?atomic=true" is given, the first failure rolls back every operation;
+// the failed operation reports its own status, and every other operation
+// reports 424 Failed Dependency.
+func batch(user, password string, request *http.Request, c config, store Store) (*result, error) {
+	if request.Method != http.MethodPost {
+		return nil, invalidMethod
+	}
+	atomic := false
+	switch value := request.URL.Query().Get("atomic"); value {
+	case "", "false", "0":
+	case "true", "1":
+		atomic = true
+	default:
+		return nil, badBody(fmt.Sprintf("Invalid atomic value %q", value))
+	}
+	ops := []operation{}
+	err := json.NewDecoder(request.Body).Decode(&ops)
+	if err != nil {
+		return nil, badJSON(err)
+	} else if len(ops) > maxBatchSize {
+		return nil, badBody(fmt.Sprintf("At most %d operations are allowed",
+			maxBatchSize))
+	}
+
+	// Run the whole batch in a nested transaction, so that an atomic batch
+	// can be undone without failing the request.
+	tx, err := store.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.rollback()
+
+	results := make([]operationResult, len(ops))
+	for i, op := range ops {
+		results[i], err = batchOperation(user, password, op, c, tx)
+		if err != nil {
+			return nil, err
+		}
+		if atomic && results[i].Status >= http.StatusBadRequest {
+			err = tx.rollback()
+			if err != nil {
+				return nil, err
+			}
+			for j := range results {
+				if j != i {
+					results[j] = operationResult{Status: http.StatusFailedDependency}
+				}
+			}
+			return batchResult(results)
+		}
+	}
+	err = tx.commit()
+	if err != nil {
+		return nil, err
+	}
+	return batchResult(results)
+}
+
+// batchResult encodes the results of a batch.
+func batchResult(results []operationResult) (*result, error) {
+	res := &result{status: http.StatusOK}
+	return res, json.NewEncoder(&res.body).Encode(results)
+}
+
+// batchOperation performs a single operation in a nested transaction.
+// Errors performing the operation are reported in the result; only errors
+// with the transaction itself are returned.
+func batchOperation(user, password string, op operation, c config, store Store) (operationResult, error) {
+	uri, err := url.Parse(op.Path)
+	if err != nil {
+		p := newProblem(badBody(fmt.Sprintf("Invalid path %q", op.Path)))
+		return operationResult{Status: http.StatusBadRequest, Error: &p}, nil
+	}
+	tx, err := store.begin()
+	if err != nil {
+		return operationResult{}, err
+	}
+	defer tx.rollback()
+
+	var body io.Reader = bytes.NewReader(op.Body)
+	header := http.Header{}
+	for name, value := range map[string]string{
+		"Content-Type":  op.ContentType,
+		"If-Match":      op.IfMatch,
+		"If-None-Match": op.IfNoneMatch,
+	} {
+		if value != "" {
+			header.Set(name, value)
+		}
+	}
+	res, err := perform(user, password, op.Method, uri, header, body, c, tx)
+	if err == nil {
+		err = tx.commit()
+	}
+	if err != nil {
+		status := errorStatus(err)
+		if status == http.StatusInternalServerError {
+			return operationResult{}, err
+		}
+		p := newProblem(err)
+		return operationResult{Status: status, Error: &p}, nil
+	}
+
+	values := []json.RawMessage{}
+	dec := json.NewDecoder(&res.body)
+	for dec.More() {
+		value := json.RawMessage{}
+		err = dec.Decode(&value)
+		if err != nil {
+			return operationResult{}, err
+		}
+		values = append(values, value)
+	}
+	return operationResult{res.status, res.location, res.etag, values, nil}, nil
+}
+
+// vim: sw=4 ts=4 noexpandtab
@@ -0,0 +1,199 @@
+/*
+Comment threads on projects and deliverables.
+
+Comments can start a new thread, or reply to another comment on the same
+project or deliverable by giving it as the Parent. Members who can comment
+can edit their own comments, and delete them along with any replies.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package backend
+
+import (
+	"time"
+)
+
+const dbCommentLen = 4096
+
+type comment struct {
+	Id      uint
+	Parent  uint   `json:",omitempty"` // The comment replied to, if any.
+	User    string // The author.
+	Body    string
+	Created string
+	Updated string
+	did     uint // Zero for comments on the project.
+}
+
+// validate of comments checks that the body will fit in the database.
+func (c *comment) validate() error {
+	v := validator{}
+	v.length("Body", c.Body, 1, dbCommentLen)
+	return v.err()
+}
+
+// commentPath returns the path of a comment.
+func commentPath(pid, did, id uint) string {
+	return projectPath(pid) + "/" + commentItem(did, id)
+}
+
+// commentList is the list of comments on a project, or on a deliverable if
+// did is set.
+type commentList struct {
+	resource
+	did     uint
+	project *projectResource
+	store   Store
+}
+
+func (l *commentList) forbidden() int {
+	return forbiddenFor(l.project.role, commentListKind)
+}
+
+// get for commentList lists the comments, oldest first.
+func (l *commentList) get(enc encoder) error {
+	comments, err := l.store.comments(l.project.pid, l.did)
+	if err != nil {
+		return err
+	}
+	for _, c := range comments {
+		err = enc.Encode(c)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// create for commentList adds a comment, which replies to Parent if set.
+func (l *commentList) create(dec decoder, success func(string, interface{}) error) error {
+	upload := comment{}
+	err := dec.Decode(&upload)
+	if err != nil {
+		return badJSON(err)
+	}
+	err = upload.validate()
+	if err != nil {
+		return err
+	}
+	pid := l.project.pid
+	if upload.Parent != 0 {
+		parent, err := l.store.comment(pid, upload.Parent)
+		if err == notFound || (err == nil && parent.did != l.did) {
+			return invalidFields([]fieldError{
+				{"Parent", "No such comment in this thread"}})
+		} else if err != nil {
+			return err
+		}
+	}
+
+	now := formatDate(time.Now())
+	c := comment{Parent: upload.Parent, User: l.project.user, Body: upload.Body,
+		Created: now, Updated: now, did: l.did}
+	c.Id, err = insertWithId(func(id uint) error {
+		c.Id = id
+		return l.store.addComment(pid, c)
+	})
+	if err != nil {
+		return err
+	}
+	return success(commentPath(pid, l.did, c.Id), c)
+}
+
+// newCommentList returns the comments on the project, or on the deliverable
+// if did is not zero.
+func newCommentList(user string, did, pid uint, store Store) (resource, error) {
+	if did == 0 {
+		proj, err := newProject(user, pid, store)
+		return &commentList{defaultResource{}, 0, proj, store}, err
+	}
+	d, err := newDeliverable(user, did, pid, store)
+	if err != nil {
+		return nil, err
+	}
+	return &commentList{defaultResource{}, did, d.project, store}, nil
+}
+
+type commentResource struct {
+	resource
+	comment comment
+	project *projectResource
+	store   Store
+}
+
+// forbidden for commentResource only lets authors edit their comments.
+// Owners can also delete other members' comments.
+func (c *commentResource) forbidden() int {
+	forbidden := forbiddenFor(c.project.role, commentKind)
+	if c.comment.User != c.project.user {
+		forbidden |= set
+		if c.project.role != roleOwner {
+			forbidden |= delete
+		}
+	}
+	return forbidden
+}
+
+func (c *commentResource) get(enc encoder) error {
+	return enc.Encode(c.comment)
+}
+
+// set for commentResource replaces the Body; nothing else can be changed.
+func (c *commentResource) set(dec decoder, enc encoder) error {
+	upload := comment{}
+	err := dec.Decode(&upload)
+	if err != nil {
+		return badJSON(err)
+	}
+	err = upload.validate()
+	if err != nil {
+		return err
+	}
+	cur := c.comment
+	cur.Body = upload.Body
+	cur.Updated = formatDate(time.Now())
+	err = c.store.updateComment(c.project.pid, cur)
+	if err != nil {
+		return err
+	}
+	return enc.Encode(cur)
+}
+
+func (c *commentResource) patchable() []string {
+	return []string{"Body"}
+}
+
+// delete for commentResource also deletes any replies.
+func (c *commentResource) delete() error {
+	return c.store.deleteComment(c.project.pid, c.comment.Id)
+}
+
+// newComment returns the comment with the given id, which must be on the
+// deliverable if did is not zero, or on the project otherwise.
+func newComment(user string, id, did, pid uint, store Store) (resource, error) {
+	var proj *projectResource
+	if did == 0 {
+		p, err := newProject(user, pid, store)
+		if err != nil {
+			return nil, err
+		}
+		proj = p
+	} else {
+		d, err := newDeliverable(user, did, pid, store)
+		if err != nil {
+			return nil, err
+		}
+		proj = d.project
+	}
+	c, err := store.comment(pid, id)
+	if err == notFound || (err == nil && c.did != did) {
+		return nil, invalidResource
+	} else if err != nil {
+		return nil, err
+	}
+	return &commentResource{defaultResource{}, c, proj, store}, nil
+}
+
+// vim: sw=4 ts=4 noexpandtab
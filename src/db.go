@@ -8,140 +8,192 @@ Contact:	<hobbitalastair at yandex dot com>
 package backend
 
 import (
-	"database/sql"
 	"fmt"
-	"log"
+	"time"
 )
 
+// DB provides administrative operations on a Store.
 type DB struct {
-	db *sql.DB
+	store Store
 }
 
-func NewDB(db *sql.DB) DB {
-	return DB{db}
+func NewDB(store Store) DB {
+	return DB{store}
+}
+
+// AddUser creates a new user with the given password.
+func (d DB) AddUser(user, password string, isManager bool) error {
+	salt, key, err := newPassword(password)
+	if err != nil {
+		return err
+	}
+	return d.store.addUser(user, salt, key, defaultHash, isManager)
+}
+
+// SetPassword sets the given user's password, revoking any sessions.
+func (d DB) SetPassword(user, password string) error {
+	tx, err := d.store.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.rollback()
+	err = setPassword(user, password, tx)
+	if err != nil {
+		return err
+	}
+	return tx.commit()
 }
 
 // SetIsManager updates the manager flag on the given user.
 func (d DB) SetIsManager(user string, isManager bool) error {
-	_, err := d.db.Exec("UPDATE users SET is_manager=$1 WHERE name=$2",
-		isManager, user)
+	err := d.store.setIsManager(user, isManager)
+	if err == notFound {
+		return noSuchUser(user)
+	}
 	return err
 }
 
 // DeleteUser removes the given user.
+// The user and their projects are removed in a single transaction.
 func (d DB) DeleteUser(user string) error {
+	tx, err := d.store.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.rollback()
+
 	// Delete all connections to the account.
-	for _, table := range []string{"views", "owns"} {
-		rows, err := d.db.Query(fmt.Sprintf("SELECT pid FROM %s WHERE name=$1", table), user)
+	ids, err := tx.projects(user)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		project, err := newProject(user, id, tx)
 		if err != nil {
 			return err
 		}
-		defer rows.Close()
-
-		for rows.Next() {
-			var id uint = 0
-			err = rows.Scan(&id)
-			if err != nil {
-				return err
-			}
-			project, err := newProject(user, id, d.db)
-			if err != nil {
-				return err
-			}
-			err = project.delete()
-			if err != nil {
-				return err
-			}
-		}
-		if rows.Err() != nil {
-			return rows.Err()
+		err = project.delete()
+		if err != nil {
+			return err
 		}
 	}
 
+	// Revoke any sessions.
+	err = tx.deleteSessions(user)
+	if err != nil {
+		return err
+	}
+
+	// Remove the user's own webhooks; any project webhooks they added belong
+	// to the project, so are kept.
+	err = tx.deleteUserWebhooks(user)
+	if err != nil {
+		return err
+	}
+
 	// Actually delete the account.
-	_, err := d.db.Exec("DELETE FROM users WHERE name=$1", user)
-	return err
+	err = tx.deleteUser(user)
+	if err == notFound {
+		return noSuchUser(user)
+	} else if err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+// noSuchUser returns the error for an unknown user.
+func noSuchUser(user string) error {
+	return fmt.Errorf("No such user %q\n", user)
 }
 
-// Init clears and initialises the database with the expected tables.
-// TODO: Figure out how to handle errors (DROP TABLEs can fail, but nothing
-//		 else).
-func (d DB) Init() {
-	exec := []string{
-		`DROP TABLE views`,
-		`DROP TABLE owns`,
-		`DROP TABLE deliverables`,
-		`DROP TABLE projects`,
-		`DROP TABLE users`,
-		`CREATE TABLE users (
-			name VARCHAR(320) PRIMARY KEY, -- 320 is the maximum email length.
-			salt BYTEA,
-			password BYTEA, -- Password is salted and encrypted.
-			is_manager BOOL -- True if the user is also a manager.
-		)`,
-		`CREATE TABLE projects (
-			id BIGINT PRIMARY KEY, -- Is this required??
-			name VARCHAR(128), -- Type??
-			percentage SMALLINT CHECK (percentage >= 0 and percentage <= 100),
-			description VARCHAR(512), -- Size??
-			updated TIMESTAMP WITH TIME ZONE,
-			version INT,
-			flag BOOL,
-			flag_version INT
-		)`,
-		`CREATE TABLE deliverables (
-			id BIGINT,
-			pid BIGINT,
-			name VARCHAR(128),
-			due TIMESTAMP WITH TIME ZONE,
-			percentage SMALLINT CHECK (percentage >= 0 and percentage <= 100),
-			submitted BOOL, -- Whether or not the project is submitted.
-			description VARCHAR(512), -- Size??
-			updated TIMESTAMP WITH TIME ZONE,
-			version INT,
-			PRIMARY KEY (id, pid)
-		)`,
-		`CREATE TABLE owns (
-			name VARCHAR(320) REFERENCES users,
-			pid BIGINT REFERENCES projects,
-			PRIMARY KEY (name, pid)
-		)`,
-		`CREATE TABLE views (
-			name VARCHAR(320) REFERENCES users,
-			pid BIGINT REFERENCES projects,
-			PRIMARY KEY (name, pid)
-		)`,
-		// Add a couple of test projects.
-		`INSERT INTO projects VALUES (0, 'Test Project 0', 30, 'First test project', '1/17/2017', 0, TRUE, 0)`,
-		`INSERT INTO projects VALUES (1, 'Test Project 1', 80, 'Second test project', '1/17/2017', 0, FALSE, 0)`,
-		`INSERT INTO deliverables VALUES
-			(0, 0, 'Deliverable 0', '11/25/2016', 20, FALSE, 'Finish backend', '1/17/2017', 0)`,
-		`INSERT INTO deliverables VALUES
-			(1, 0, 'Deliverable 1', '12/9/2016', 70, FALSE, 'Finish prototype', '1/17/2017', 0)`,
-		// Add some test users.
-		`INSERT INTO users VALUES ('beth', '', '', TRUE)`,
-		`INSERT INTO users VALUES ('bob', '', '', TRUE)`,
-		`INSERT INTO users VALUES ('bill', '', '', TRUE)`,
-		`INSERT INTO users VALUES ('ben', '', '', FALSE)`,
-		`INSERT INTO owns VALUES ('beth', 0)`,
-		`INSERT INTO views VALUES ('ben', 0)`,
-		`INSERT INTO owns VALUES ('bob', 1)`,
-		`INSERT INTO views VALUES ('ben', 1)`,
-		`INSERT INTO views VALUES ('bill', 1)`,
-	}
-
-	for _, cmd := range exec {
-		_, err := d.db.Exec(cmd)
+// Version returns the current schema version.
+// Databases without a schema_version table are at version 0.
+func (d DB) Version() (int, error) {
+	return d.store.version()
+}
+
+// Migrate brings the database schema up to date, preserving any existing data.
+func (d DB) Migrate() error {
+	latest, err := LatestVersion()
+	if err != nil {
+		return err
+	}
+	return d.MigrateTo(latest)
+}
+
+// MigrateTo migrates the database schema up or down to the given version.
+// Migrating down may discard data; migrating to version 0 drops everything.
+func (d DB) MigrateTo(target int) error {
+	return d.store.migrate(target)
+}
+
+// SeedDemo adds some demo projects and users to the database.
+// All of the demo users have the password "test", so this should never be
+// run against a real database.
+func (d DB) SeedDemo() error {
+	tx, err := d.store.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.rollback()
+	err = DB{tx}.seedDemo()
+	if err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+// seedDemo adds the demo data; see SeedDemo.
+func (d DB) seedDemo() error {
+	// Add a couple of test projects.
+	projects := []project{
+		{Id: 0, Name: "Test Project 0", Percentage: 30, Description: "First test project", Updated: "2017-01-17T00:00:00Z"},
+		{Id: 1, Name: "Test Project 1", Percentage: 80, Description: "Second test project", Updated: "2017-01-17T00:00:00Z"},
+	}
+	for _, p := range projects {
+		err := d.store.addProject(p)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := d.store.swapFlag(0, flag{Version: 0, Value: false}, flag{Version: 0, Value: true})
+	if err != nil {
+		return err
+	}
+	deliverables := []deliverable{
+		{Id: 0, Name: "Deliverable 0", Due: "2016-11-25T00:00:00Z", Percentage: 20, Description: "Finish backend", Updated: "2017-01-17T00:00:00Z"},
+		{Id: 1, Name: "Deliverable 1", Due: "2016-12-09T00:00:00Z", Percentage: 70, Description: "Finish prototype", Updated: "2017-01-17T00:00:00Z"},
+	}
+	for _, v := range deliverables {
+		err = d.store.addDeliverable(0, v)
 		if err != nil {
-			log.Printf("Error executing '%s': %q\n", cmd, err)
+			return err
 		}
 	}
 
-	// Set the default passwords.
-	SetPassword("beth", "test", d.db)
-	SetPassword("bob", "test", d.db)
-	SetPassword("bill", "test", d.db)
-	SetPassword("ben", "test", d.db)
+	// Add some test users.
+	users := []struct {
+		name      string
+		isManager bool
+	}{{"beth", true}, {"bob", true}, {"bill", true}, {"ben", false}}
+	for _, user := range users {
+		err = d.AddUser(user.name, "test", user.isManager)
+		if err != nil {
+			return err
+		}
+	}
+	members := []struct {
+		name string
+		pid  uint
+		role role
+	}{{"beth", 0, roleOwner}, {"ben", 0, roleViewer}, {"bob", 1, roleOwner}, {"ben", 1, roleViewer}, {"bill", 1, roleViewer}}
+	for _, m := range members {
+		err = d.store.addMember(m.pid, member{m.name, m.role, "", time.Now().UTC()})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // vim: sw=4 ts=4 noexpandtab
@@ -0,0 +1,139 @@
+/*
+Errors reported to clients.
+
+Errors caused by the request are sent to the client as "problem details"
+(RFC 7807), with a machine readable code and, for invalid bodies, a list of
+the fields which were invalid. Other errors are logged, and the client only
+sees a generic internal error.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const problemType = "application/problem+json"
+
+// requestError is an error caused by the request.
+type requestError struct {
+	status  int
+	code    string // Machine readable; see problem.
+	message string
+	fields  []fieldError
+}
+
+// fieldError describes a single invalid field in a body.
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e *requestError) Error() string {
+	return e.message + "\n"
+}
+
+// Is treats errors with the same code as equivalent, so that errors with
+// extra detail still match the general errors below.
+func (e *requestError) Is(target error) bool {
+	t, ok := target.(*requestError)
+	return ok && t.code == e.code
+}
+
+// General errors.
+var invalidResource error = &requestError{http.StatusNotFound, "not_found", "No such resource", nil}
+var invalidBody error = &requestError{http.StatusBadRequest, "invalid_body", "Invalid body", nil}
+var invalidMethod error = &requestError{http.StatusMethodNotAllowed, "invalid_method", "Method not supported by the resource", nil}
+var accessDenied error = &requestError{http.StatusForbidden, "access_denied", "Access denied", nil}
+var lastOwner error = &requestError{http.StatusConflict, "last_owner", "Cannot remove the last owner", nil}
+
+// badBody returns an invalidBody error with the given message and invalid
+// fields.
+func badBody(message string, fields ...fieldError) error {
+	return &requestError{http.StatusBadRequest, "invalid_body", message, fields}
+}
+
+// badJSON returns an invalidBody error for a body which failed to decode.
+func badJSON(err error) error {
+	return badBody(fmt.Sprintf("Invalid JSON: %s", err))
+}
+
+// invalidFields returns an invalidBody error listing the given fields, or
+// nil if there are none.
+func invalidFields(fields []fieldError) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	return badBody("Invalid fields", fields...)
+}
+
+// errorStatus returns the HTTP status corresponding to an error returned
+// while performing an operation.
+func errorStatus(err error) int {
+	e := &requestError{}
+	if err == nil {
+		return http.StatusOK
+	} else if errors.As(err, &e) {
+		return e.status
+	}
+	return http.StatusInternalServerError
+}
+
+// problem is the body sent with an error, as described in RFC 7807.
+// Code identifies the error, and Errors lists any invalid fields.
+type problem struct {
+	Type   string       `json:"type"`
+	Title  string       `json:"title"`
+	Status int          `json:"status"`
+	Detail string       `json:"detail,omitempty"`
+	Code   string       `json:"code"`
+	Errors []fieldError `json:"errors,omitempty"`
+}
+
+// newProblem returns the problem corresponding to the given error.
+// Errors not caused by the request are not described, since they may leak
+// internal details.
+func newProblem(err error) problem {
+	e := &requestError{}
+	if !errors.As(err, &e) {
+		return statusProblem(http.StatusInternalServerError)
+	}
+	p := statusProblem(e.status)
+	p.Detail = strings.TrimSuffix(e.message, "\n")
+	p.Code = e.code
+	p.Errors = e.fields
+	return p
+}
+
+// statusProblem returns a problem with no more detail than the status.
+func statusProblem(status int) problem {
+	text := http.StatusText(status)
+	code := strings.ReplaceAll(strings.ToLower(text), " ", "_")
+	if status == http.StatusForbidden {
+		// Match accessDenied.
+		code = "access_denied"
+	}
+	return problem{
+		Type:   "about:blank",
+		Title:  text,
+		Status: status,
+		Code:   code,
+	}
+}
+
+// writeProblem sends the problem to the client.
+func writeProblem(writer http.ResponseWriter, p problem) {
+	writer.Header().Set("Content-Type", problemType)
+	writer.Header().Set("X-Content-Type-Options", "nosniff")
+	writer.WriteHeader(p.Status)
+	json.NewEncoder(writer).Encode(p)
+}
+
+// vim: sw=4 ts=4 noexpandtab
@@ -0,0 +1,93 @@
+/*
+Conditional requests using entity tags (ETags).
+
+The ETag of a resource is a hash of the response to a GET, so it changes
+whenever anything visible to the user changes. Clients can poll with
+If-None-Match to avoid downloading unchanged items, and send If-Match with a
+PUT, PATCH or DELETE to make sure that they are not overwriting somebody
+else's changes.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package backend
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+var preconditionFailed error = &requestError{http.StatusPreconditionFailed, "precondition_failed", "Precondition failed", nil}
+
+// etagLen is the number of bytes of the hash to include in an ETag.
+const etagLen = 16
+
+// etagOf returns the ETag for the given GET response body.
+func etagOf(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:etagLen]) + `"`
+}
+
+// currentETag returns the ETag of the resource, or the empty string if the
+// resource can't be retrieved.
+func currentETag(r resource) (string, error) {
+	buf := bytes.Buffer{}
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(true)
+	err := r.get(enc)
+	if err == invalidMethod {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return etagOf(buf.Bytes()), nil
+}
+
+// etagMatches returns true if the given If-Match or If-None-Match header
+// value matches the ETag.
+// An empty ETag never matches; "*" matches anything else.
+// If weak is true, weak ETags match their strong equivalents.
+func etagMatches(header, etag string, weak bool) bool {
+	if etag == "" {
+		return false
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPreconditions checks the If-Match and If-None-Match headers for a
+// request changing the resource, returning preconditionFailed if either
+// does not hold.
+func checkPreconditions(r resource, header http.Header) error {
+	ifMatch := header.Get("If-Match")
+	ifNoneMatch := header.Get("If-None-Match")
+	if ifMatch == "" && ifNoneMatch == "" {
+		return nil
+	}
+	etag, err := currentETag(r)
+	if err != nil {
+		return err
+	}
+	if ifMatch != "" && !etagMatches(ifMatch, etag, false) {
+		return preconditionFailed
+	}
+	if ifNoneMatch != "" && etagMatches(ifNoneMatch, etag, true) {
+		return preconditionFailed
+	}
+	return nil
+}
+
+// vim: sw=4 ts=4 noexpandtab
@@ -0,0 +1,298 @@
+/*
+Real-time change notifications using Server-Sent Events.
+
+GET /events streams changes to any of the user's projects, and
+GET /projects/pID/events streams changes to a single project. Each event is
+an entry from the changes feed, with the sequence number of the change as the
+event id, so clients can resume with Last-Event-ID after reconnecting.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var (
+	eventsRe        = regexp.MustCompile(`\A/events\z`)
+	projectEventsRe = regexp.MustCompile(`\A/projects/(\d+)/events\z`)
+)
+
+// Streams also check for changes every eventPollInterval; see checkChanges.
+// A comment is sent every eventKeepAlive so that idle connections are not
+// closed by proxies.
+var (
+	eventPollInterval = 5 * time.Second
+	eventKeepAlive    = 15 * time.Second
+)
+
+// checkChanges calls check, and returns a channel which is closed the next
+// time changes are committed through the store.
+// The channel is taken before calling check, so that changes committed while
+// checking are never missed.
+// Changes made by other processes sharing the database are not notified, so
+// callers should also check again every so often.
+func checkChanges(store Store, check func() error) (<-chan struct{}, error) {
+	changed := store.changed()
+	return changed, check()
+}
+
+// isEventStream returns true if the path is an event stream.
+func isEventStream(path string) bool {
+	return eventsRe.MatchString(path) || projectEventsRe.MatchString(path)
+}
+
+// eventStream is a single client's stream of changes.
+type eventStream struct {
+	user string
+	// only holds the projects being streamed, or is nil for every project.
+	// Projects which the user can no longer see are removed.
+	only   map[uint]bool
+	cursor uint // The last change sent.
+	// session is the hash of the session token used to open the stream, or
+	// nil if opened with the password; see checkSession.
+	session []byte
+	store   Store
+}
+
+// newEventStream checks the request for an event stream, returning the
+// stream starting at the change after Last-Event-ID, or at the next change
+// if not given.
+func newEventStream(user string, request *http.Request, store Store) (*eventStream, error) {
+	if request.Method != http.MethodGet {
+		return nil, invalidMethod
+	}
+	tx, err := store.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.rollback()
+
+	s := &eventStream{user: user, store: store}
+	if token, ok := bearerToken(request); ok {
+		s.session = hashToken(token)
+	}
+	if match := projectEventsRe.FindStringSubmatch(request.URL.Path); match != nil {
+		pid, err := strconv.ParseUint(match[1], 10, 64)
+		if err != nil {
+			return nil, invalidResource
+		}
+		err = checkCanView(user, uint(pid), tx)
+		if err != nil {
+			return nil, err
+		}
+		s.only = map[uint]bool{uint(pid): true}
+	}
+
+	// EventSource polyfills which can't set headers send the id in the query
+	// string instead.
+	last := request.Header.Get("Last-Event-ID")
+	if last == "" {
+		last = request.URL.Query().Get("lastEventId")
+	}
+	err = s.start(last, tx)
+	if err != nil {
+		return nil, err
+	}
+	return s, tx.commit()
+}
+
+// start sets the cursor to the given event id, or the latest change if
+// empty.
+func (s *eventStream) start(last string, store Store) error {
+	var err error
+	s.cursor, err = store.cursor()
+	if err != nil || last == "" {
+		return err
+	}
+	since, err := strconv.ParseUint(last, 10, 64)
+	if err != nil {
+		return badBody(fmt.Sprintf("Invalid event id %q", last))
+	} else if uint(since) > s.cursor {
+		return badBody(fmt.Sprintf("Event id %d is newer than the server cursor %d",
+			since, s.cursor))
+	}
+	s.cursor = uint(since)
+	return nil
+}
+
+// checkCanView returns accessDenied if the user can't see the project.
+func checkCanView(user string, pid uint, store Store) error {
+	r, err := roleOf(user, pid, store)
+	if err != nil {
+		return err
+	} else if forbiddenFor(r, projectKind)&get != 0 {
+		return accessDenied
+	}
+	return nil
+}
+
+// next returns the events since the last call, ordered by sequence number.
+func (s *eventStream) next() ([]event, error) {
+	tx, err := s.store.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.rollback()
+
+	events, err := s.read(tx)
+	if err != nil {
+		return nil, err
+	}
+	return events, tx.commit()
+}
+
+// read returns the events since the last call using the given transaction,
+// and moves the cursor to the latest change.
+// Streams opened with a session end with sessionEnded once the session does.
+func (s *eventStream) read(tx Store) ([]event, error) {
+	if s.session != nil {
+		err := checkSession(s.session, tx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	cursor, err := tx.cursor()
+	if err != nil || cursor == s.cursor {
+		return nil, err
+	}
+	f := &feedResource{defaultResource{}, s.user, "", tx, map[uint]role{}, s.only}
+	events, err := f.events(s.cursor, cursor)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].seq < events[j].seq
+	})
+	s.cursor = cursor
+
+	if s.only != nil {
+		visible := map[uint]bool{}
+		for pid := range s.only {
+			r, err := f.role(pid)
+			if err != nil {
+				return nil, err
+			} else if forbiddenFor(r, projectKind)&get == 0 {
+				visible[pid] = true
+			}
+		}
+		s.only = visible
+	}
+	return events, nil
+}
+
+// writeEvents writes the events to the stream.
+// Several events may share a sequence number when a project is sent in full;
+// only the last of those has an id, so that clients reconnecting part way
+// through are sent the whole project again.
+func writeEvents(writer io.Writer, events []event) error {
+	for i, e := range events {
+		data, err := json.Marshal(e.feedEntry)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(writer, "event: %s\n", e.Kind)
+		if err != nil {
+			return err
+		}
+		if i+1 == len(events) || events[i+1].seq != e.seq {
+			_, err = fmt.Fprintf(writer, "id: %d\n", e.seq)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = fmt.Fprintf(writer, "data: %s\n\n", data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serveEvents streams changes to the client until the client disconnects,
+// the server shuts down, or the user can no longer see the project being
+// streamed.
+func serveEvents(writer http.ResponseWriter, request *http.Request, user string, store Store) {
+	stream, err := newEventStream(user, request, store)
+	if errorStatus(err) == http.StatusInternalServerError {
+		writeProblem(writer, statusProblem(http.StatusInternalServerError))
+		log.Printf("%q\n", err)
+		return
+	} else if err != nil {
+		writeProblem(writer, newProblem(err))
+		return
+	}
+
+	// Streams last much longer than the server write timeout.
+	controller := http.NewResponseController(writer)
+	err = controller.SetWriteDeadline(time.Time{})
+	if err != nil && err != http.ErrNotSupported {
+		log.Printf("Failed to clear the write deadline: %q\n", err)
+	}
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.Header().Set("X-Accel-Buffering", "no")
+	writer.WriteHeader(http.StatusOK)
+	controller.Flush()
+
+	poll := time.NewTicker(eventPollInterval)
+	defer poll.Stop()
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		var events []event
+		changed, err := checkChanges(store, func() (err error) {
+			events, err = stream.next()
+			return err
+		})
+		if err == sessionEnded {
+			return
+		} else if err != nil {
+			log.Printf("Failed to read changes for %s: %q\n", user, err)
+			return
+		}
+		if len(events) != 0 {
+			err = writeEvents(writer, events)
+			if err == nil {
+				err = controller.Flush()
+			}
+			if err != nil {
+				// The client has gone.
+				return
+			}
+			keepAlive.Reset(eventKeepAlive)
+		}
+		if stream.only != nil && len(stream.only) == 0 {
+			// The user can no longer see the project.
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-poll.C:
+		case <-keepAlive.C:
+			_, err = io.WriteString(writer, ": keep-alive\n\n")
+			if err == nil {
+				err = controller.Flush()
+			}
+			if err != nil {
+				return
+			}
+		case <-request.Context().Done():
+			return
+		}
+	}
+}
+
+// vim: sw=4 ts=4 noexpandtab
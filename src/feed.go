@@ -0,0 +1,361 @@
+/*
+Changes feed, letting clients pull everything which changed since their last
+sync in a single request.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package backend
+
+import (
+	"encoding/base32"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+)
+
+// Kinds of recorded change.
+const (
+	changeProject     = "project"
+	changeFlag        = "flag"
+	changeDeliverable = "deliverable"
+	changeMembership  = "membership"
+	changeComment     = "comment"
+)
+
+// change is a single entry in the change log.
+// item is the deliverable id, member name, or path of the comment within the
+// project (see commentItem), and is empty for projects and flags.
+type change struct {
+	seq     uint
+	pid     uint
+	kind    string
+	item    string
+	deleted bool
+}
+
+// feedEntry is the current state of an item which has changed.
+// Deleted items are sent as tombstones, without the Item.
+type feedEntry struct {
+	Kind    string
+	Path    string
+	Deleted bool        `json:",omitempty"`
+	Item    interface{} `json:",omitempty"`
+}
+
+// feed is the response to a GET on the changes feed.
+// Cursor should be sent as "since" on the next sync.
+type feed struct {
+	Cursor  uint
+	Changes []feedEntry
+}
+
+type feedResource struct {
+	resource
+	user  string
+	since string
+	store Store
+	roles map[uint]role // Cache of the user's role in each project.
+	only  map[uint]bool // If set, only include changes to these projects.
+}
+
+// event is a feed entry, along with the sequence number of the change which
+// caused it.
+// Entries for projects sent in full have the sequence number of the change
+// which caused the project to be sent.
+type event struct {
+	feedEntry
+	seq uint
+}
+
+func (f *feedResource) forbidden() int {
+	return set | create | delete
+}
+
+// get for feedResource lists the changes since the given cursor.
+// Only the latest state of each item is sent.
+// Projects the user has joined since the cursor are sent in full, as are all
+// of their projects if there is no cursor.
+func (f *feedResource) get(enc encoder) error {
+	since := uint64(0)
+	if f.since != "" {
+		var err error
+		since, err = strconv.ParseUint(f.since, 10, 64)
+		if err != nil {
+			return badBody(fmt.Sprintf("Invalid cursor %q", f.since))
+		}
+	}
+	cursor, err := f.store.cursor()
+	if err != nil {
+		return err
+	}
+	// Reject cursors from the future, as for versions.
+	if uint(since) > cursor {
+		return badBody(fmt.Sprintf("Cursor %d is newer than the server cursor %d",
+			since, cursor))
+	}
+	events, err := f.events(uint(since), cursor)
+	if err != nil {
+		return err
+	}
+
+	result := feed{Cursor: cursor, Changes: []feedEntry{}}
+	for _, e := range events {
+		result.Changes = append(result.Changes, e.feedEntry)
+	}
+	return enc.Encode(result)
+}
+
+// events returns the feed entries for the changes with since < seq <= until.
+// Projects sent in full are listed first, followed by the other changes in
+// the order they last changed.
+func (f *feedResource) events(since, until uint) ([]event, error) {
+	changes, err := f.store.changes(f.user, since, until)
+	if err != nil {
+		return nil, err
+	}
+	if f.only != nil {
+		filtered := []change{}
+		for _, c := range changes {
+			if f.only[c.pid] {
+				filtered = append(filtered, c)
+			}
+		}
+		changes = filtered
+	}
+
+	// Find the projects to send in full, and the change causing each.
+	full := map[uint]uint{}
+	if since == 0 {
+		pids, err := f.store.projects(f.user)
+		if err != nil {
+			return nil, err
+		}
+		for _, pid := range pids {
+			if f.only == nil || f.only[pid] {
+				full[pid] = until
+			}
+		}
+	}
+	for _, c := range changes {
+		if c.kind == changeMembership && c.item == f.user && !c.deleted {
+			full[c.pid] = c.seq
+		}
+	}
+
+	result := []event{}
+	pids := []uint{}
+	for pid := range full {
+		pids = append(pids, pid)
+	}
+	sort.Slice(pids, func(i, j int) bool { return pids[i] < pids[j] })
+	sent := map[uint]bool{}
+	for _, pid := range pids {
+		r, err := f.role(pid)
+		if err != nil {
+			return nil, err
+		} else if r == roleNone {
+			// Joined and then left again; sent as a tombstone below.
+			continue
+		}
+		entries, err := f.snapshot(pid, r)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			result = append(result, event{entry, full[pid]})
+		}
+		sent[pid] = true
+	}
+
+	gone := map[uint]bool{}
+	for _, c := range latestChanges(changes) {
+		if sent[c.pid] || gone[c.pid] {
+			continue
+		}
+		r, err := f.role(c.pid)
+		if err != nil {
+			return nil, err
+		} else if r == roleNone {
+			// The project was deleted, or the user was removed from it.
+			gone[c.pid] = true
+			result = append(result, event{feedEntry{
+				Kind: changeProject, Path: projectPath(c.pid), Deleted: true,
+			}, c.seq})
+			continue
+		}
+		entry, ok, err := f.entry(c, r)
+		if err != nil {
+			return nil, err
+		} else if ok {
+			result = append(result, event{entry, c.seq})
+		}
+	}
+	return result, nil
+}
+
+// role returns the role of the user in the given project.
+func (f *feedResource) role(pid uint) (role, error) {
+	r, ok := f.roles[pid]
+	if ok {
+		return r, nil
+	}
+	r, err := roleOf(f.user, pid, f.store)
+	if err != nil {
+		return roleNone, err
+	}
+	f.roles[pid] = r
+	return r, nil
+}
+
+// latestChanges returns the latest change to each item, ordered by seq.
+func latestChanges(changes []change) []change {
+	latest := map[string]int{}
+	for i, c := range changes {
+		latest[fmt.Sprintf("%d/%s/%s", c.pid, c.kind, c.item)] = i
+	}
+	result := []change{}
+	for i, c := range changes {
+		if latest[fmt.Sprintf("%d/%s/%s", c.pid, c.kind, c.item)] == i {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// entry returns the feed entry for the given change, or false if the user
+// is not allowed to see it.
+func (f *feedResource) entry(c change, r role) (feedEntry, bool, error) {
+	entry := feedEntry{Kind: c.kind, Deleted: c.deleted}
+	var err error
+	switch c.kind {
+	case changeProject:
+		entry.Path = projectPath(c.pid)
+		entry.Item, err = f.project(c.pid, r)
+	case changeFlag:
+		if forbiddenFor(r, flagKind)&get != 0 {
+			return entry, false, nil
+		}
+		entry.Path = projectPath(c.pid) + "/flag"
+		entry.Item, err = f.store.flag(c.pid)
+	case changeDeliverable:
+		if forbiddenFor(r, deliverableKind)&get != 0 {
+			return entry, false, nil
+		}
+		entry.Path = fmt.Sprintf("%s/deliverables/%s", projectPath(c.pid), c.item)
+		if !c.deleted {
+			id, _ := strconv.ParseUint(c.item, 10, 64)
+			entry.Item, err = f.store.deliverable(c.pid, uint(id))
+		}
+	case changeMembership:
+		// Members can always see their own role.
+		if c.item != f.user && forbiddenFor(r, clientKind)&get != 0 {
+			return entry, false, nil
+		}
+		entry.Path = clientPath(c.pid, c.item)
+		if !c.deleted {
+			var m member
+			m, err = f.store.member(c.item, c.pid)
+			entry.Item = newClientInfo(m)
+		}
+	case changeComment:
+		if forbiddenFor(r, commentKind)&get != 0 {
+			return entry, false, nil
+		}
+		entry.Path = projectPath(c.pid) + "/" + c.item
+		if !c.deleted {
+			id, _ := strconv.ParseUint(path.Base(c.item), 10, 64)
+			entry.Item, err = f.store.comment(c.pid, uint(id))
+		}
+	default:
+		return entry, false, fmt.Errorf("Unknown change kind %q\n", c.kind)
+	}
+	if err == notFound {
+		// Deleted since; the deletion is recorded later.
+		return entry, false, nil
+	} else if err != nil {
+		return entry, false, err
+	}
+	if entry.Deleted {
+		entry.Item = nil
+	}
+	return entry, true, nil
+}
+
+// snapshot returns entries for everything the user can see in the project.
+func (f *feedResource) snapshot(pid uint, r role) ([]feedEntry, error) {
+	entries := []feedEntry{}
+	add := func(c change) error {
+		entry, ok, err := f.entry(c, r)
+		if ok {
+			entries = append(entries, entry)
+		}
+		return err
+	}
+
+	for _, kind := range []string{changeProject, changeFlag} {
+		err := add(change{pid: pid, kind: kind})
+		if err != nil {
+			return nil, err
+		}
+	}
+	members, err := f.store.members(pid)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range members {
+		err = add(change{pid: pid, kind: changeMembership, item: m.Name})
+		if err != nil {
+			return nil, err
+		}
+	}
+	ids, err := f.store.deliverables(pid)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		err = add(change{pid: pid, kind: changeDeliverable, item: deliverableItem(id)})
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Comments on the project, then on each deliverable.
+	for _, did := range append([]uint{0}, ids...) {
+		comments, err := f.store.comments(pid, did)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range comments {
+			err = add(change{pid: pid, kind: changeComment, item: commentItem(did, c.Id)})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return entries, nil
+}
+
+// project returns the project as seen by a user with the given role.
+func (f *feedResource) project(pid uint, r role) (project, error) {
+	p, err := f.store.project(pid)
+	p.Owns = (r == roleOwner)
+	p.Role = r
+	return p, err
+}
+
+func projectPath(pid uint) string {
+	return fmt.Sprintf("/projects/%d", pid)
+}
+
+func clientPath(pid uint, name string) string {
+	return fmt.Sprintf("/projects/%d/clients/%s", pid,
+		base32.StdEncoding.EncodeToString([]byte(name)))
+}
+
+func newFeed(user, since string, store Store) (resource, error) {
+	return &feedResource{defaultResource{}, user, since, store, map[uint]role{}, nil}, nil
+}
+
+// vim: sw=4 ts=4 noexpandtab
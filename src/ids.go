@@ -0,0 +1,52 @@
+/*
+Identifier generation.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package backend
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+)
+
+// maxIdAttempts is the number of ids tried before giving up on an insert.
+// With 63 bit ids collisions should be vanishingly rare, so running out
+// indicates that something else is wrong.
+const maxIdAttempts = 8
+
+// duplicateId is returned by Store inserts when the id is already taken.
+var duplicateId error = fmt.Errorf("Duplicate id\n")
+
+// newId returns a random, unguessable id which fits in a signed BIGINT.
+// This is a variable so that tests can force collisions.
+var newId = func() (uint, error) {
+	buf := make([]byte, 8)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return 0, err
+	}
+	// Mask to 63 bits (or 31 bits where uint is 32 bits wide).
+	return uint(binary.BigEndian.Uint64(buf)) & (^uint(0) >> 1), nil
+}
+
+// insertWithId calls insert with new ids until it does not return
+// duplicateId, and returns the id used.
+func insertWithId(insert func(id uint) error) (uint, error) {
+	for attempt := 0; attempt < maxIdAttempts; attempt++ {
+		id, err := newId()
+		if err != nil {
+			return 0, err
+		}
+		err = insert(id)
+		if err != duplicateId {
+			return id, err
+		}
+	}
+	return 0, fmt.Errorf("Failed to find a free id after %d attempts\n", maxIdAttempts)
+}
+
+// vim: sw=4 ts=4 noexpandtab
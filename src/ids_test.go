@@ -0,0 +1,161 @@
+/*
+Tests for identifier generation.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package backend
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// setIds replaces newId with a function returning the given ids in order.
+// The original is restored when the test finishes, so tests using this must
+// not run in parallel.
+func setIds(t *testing.T, ids ...uint) {
+	original := newId
+	t.Cleanup(func() { newId = original })
+	newId = func() (uint, error) {
+		if len(ids) == 0 {
+			t.Fatal("Ran out of ids")
+		}
+		id := ids[0]
+		ids = ids[1:]
+		return id, nil
+	}
+}
+
+func TestNewIdRange(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		id, err := newId()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int(id) < 0 {
+			t.Fatalf("Id %d does not fit in a signed integer", id)
+		}
+	}
+}
+
+func TestDuplicateInsert(t *testing.T) {
+	store := newTestStore(t)
+	err := store.addProject(project{Id: 1, Name: "First"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.addProject(project{Id: 1, Name: "Second"})
+	if err != duplicateId {
+		t.Fatalf("Expected duplicateId, got %v", err)
+	}
+	err = store.addDeliverable(1, deliverable{Id: 1, Name: "First"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.addDeliverable(1, deliverable{Id: 1, Name: "Second"})
+	if err != duplicateId {
+		t.Fatalf("Expected duplicateId, got %v", err)
+	}
+}
+
+func TestInsertWithIdRetries(t *testing.T) {
+	store := newTestStore(t)
+	err := store.addProject(project{Id: 1, Name: "Existing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first two ids collide, so the third should be used.
+	setIds(t, 1, 1, 2)
+	id, err := insertWithId(func(id uint) error {
+		return store.addProject(project{Id: id, Name: "New"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 2 {
+		t.Fatalf("Expected id 2, got %d", id)
+	}
+	p, err := store.project(1)
+	if err != nil || p.Name != "Existing" {
+		t.Fatalf("Expected the existing project to be untouched, got %+v, %v", p, err)
+	}
+}
+
+func TestInsertWithIdGivesUp(t *testing.T) {
+	store := newTestStore(t)
+	err := store.addProject(project{Id: 1, Name: "Existing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := make([]uint, maxIdAttempts)
+	for i := range ids {
+		ids[i] = 1
+	}
+	setIds(t, ids...)
+	_, err = insertWithId(func(id uint) error {
+		return store.addProject(project{Id: id, Name: "New"})
+	})
+	if err == nil {
+		t.Fatal("Expected an error after running out of attempts")
+	}
+}
+
+func TestCreateCollision(t *testing.T) {
+	store := newTestStore(t)
+	err := NewDB(store).AddUser("manager", "password", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both projects are offered id 1 first; the second create must retry
+	// rather than failing or overwriting the first.
+	setIds(t, 1, 1, 2, 3, 3, 4)
+	created := []uint{}
+	record := func(uri string, v interface{}) error {
+		switch item := v.(type) {
+		case project:
+			created = append(created, item.Id)
+		case deliverable:
+			created = append(created, item.Id)
+		}
+		return nil
+	}
+	projectBody := `{"Name": "Project", "Description": "Project", "Updated": "2017-01-01"}`
+	deliverableBody := `{"Name": "Deliverable", "Description": "Deliverable", "Updated": "2017-01-01", "Due": "2017-02-01T00:00:00Z"}`
+	for i := 0; i < 2; i++ {
+		l, err := newProjectList("manager", store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = l.create(json.NewDecoder(strings.NewReader(projectBody)), record)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		l, err := newDeliverableList("manager", 1, store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = l.create(json.NewDecoder(strings.NewReader(deliverableBody)), record)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := []uint{1, 2, 3, 4}
+	if len(created) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, created)
+	}
+	for i := range expected {
+		if created[i] != expected[i] {
+			t.Fatalf("Expected %v, got %v", expected, created)
+		}
+	}
+}
+
+// vim: sw=4 ts=4 noexpandtab
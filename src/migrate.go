@@ -0,0 +1,175 @@
+/*
+Schema migrations.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package backend
+
+import (
+	"embed"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// Migrations are stored as pairs of SQL files for each dialect, named
+// <dialect>/<version>_<description>.up.sql and
+// <dialect>/<version>_<description>.down.sql.
+// Versions start at 1 and must be consecutive, and each dialect must provide
+// the same versions.
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+var migrationRe = regexp.MustCompile(`\A(\d+)_(\w+)\.(up|down)\.sql\z`)
+
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+// loadMigrations returns the embedded migrations for the given dialect,
+// sorted by version.
+func loadMigrations(dialect string) ([]migration, error) {
+	dir := path.Join("migrations", dialect)
+	files, err := migrationFiles.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*migration{}
+	for _, file := range files {
+		match := migrationRe.FindStringSubmatch(file.Name())
+		if match == nil {
+			return nil, fmt.Errorf("Invalid migration file name %q\n", file.Name())
+		}
+		version, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, err
+		}
+		body, err := migrationFiles.ReadFile(path.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{version: version, name: match[2]}
+			byVersion[version] = m
+		}
+		if match[3] == "up" {
+			m.up = string(body)
+		} else {
+			m.down = string(body)
+		}
+	}
+
+	migrations := []migration{}
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("Migration %d is missing an up or down step\n", m.version)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+	for i, m := range migrations {
+		if m.version != i+1 {
+			return nil, fmt.Errorf("Missing migration %d\n", i+1)
+		}
+	}
+	return migrations, nil
+}
+
+// LatestVersion returns the schema version that Migrate will bring a
+// database up to.
+func LatestVersion() (int, error) {
+	latest := -1
+	for _, d := range []*dialect{postgres, sqlite} {
+		migrations, err := loadMigrations(d.name)
+		if err != nil {
+			return 0, err
+		}
+		if latest >= 0 && len(migrations) != latest {
+			return 0, fmt.Errorf("Dialects have different numbers of migrations\n")
+		}
+		latest = len(migrations)
+	}
+	return latest, nil
+}
+
+// version returns the current schema version.
+// Databases without a schema_version table are at version 0.
+func (s *sqlStore) version() (int, error) {
+	_, err := s.exec(s.dialect.versionTable)
+	if err != nil {
+		return 0, err
+	}
+	version := 0
+	err = s.queryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version", nil, &version)
+	return version, err
+}
+
+// migrate migrates the database schema up or down to the given version.
+// Each step runs in its own transaction, so a failure leaves the database at
+// the last successfully applied version.
+func (s *sqlStore) migrate(target int) error {
+	migrations, err := loadMigrations(s.dialect.name)
+	if err != nil {
+		return err
+	}
+	if target < 0 || target > len(migrations) {
+		return fmt.Errorf("Unknown schema version %d\n", target)
+	}
+	current, err := s.version()
+	if err != nil {
+		return err
+	}
+	if current > len(migrations) {
+		return fmt.Errorf("Database schema version %d is newer than this server\n", current)
+	}
+
+	for current < target {
+		m := migrations[current]
+		err = s.step(m.up, "INSERT INTO schema_version (version) VALUES ($1)", m.version)
+		if err != nil {
+			return fmt.Errorf("Failed to apply migration %d (%s): %q\n", m.version, m.name, err)
+		}
+		current++
+	}
+	for current > target {
+		m := migrations[current-1]
+		err = s.step(m.down, "DELETE FROM schema_version WHERE version=$1", m.version)
+		if err != nil {
+			return fmt.Errorf("Failed to revert migration %d (%s): %q\n", m.version, m.name, err)
+		}
+		current--
+	}
+	return nil
+}
+
+// step runs a single migration and records the new version.
+func (s *sqlStore) step(body, record string, version int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(body)
+	if err == nil {
+		_, err = tx.Exec(s.dialect.rebind(record), version)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// vim: sw=4 ts=4 noexpandtab
@@ -0,0 +1,5 @@
+DROP TABLE views;
+DROP TABLE owns;
+DROP TABLE deliverables;
+DROP TABLE projects;
+DROP TABLE users;
@@ -0,0 +1,41 @@
+-- Base schema.
+-- Tables may already exist if the database was created before migrations
+-- were introduced, so only create what is missing.
+CREATE TABLE IF NOT EXISTS users (
+	name VARCHAR(320) PRIMARY KEY, -- 320 is the maximum email length.
+	salt BYTEA,
+	password BYTEA, -- Password is salted and encrypted.
+	is_manager BOOL -- True if the user is also a manager.
+);
+CREATE TABLE IF NOT EXISTS projects (
+	id BIGINT PRIMARY KEY, -- Is this required??
+	name VARCHAR(128), -- Type??
+	percentage SMALLINT CHECK (percentage >= 0 and percentage <= 100),
+	description VARCHAR(512), -- Size??
+	updated TIMESTAMP WITH TIME ZONE,
+	version INT,
+	flag BOOL,
+	flag_version INT
+);
+CREATE TABLE IF NOT EXISTS deliverables (
+	id BIGINT,
+	pid BIGINT,
+	name VARCHAR(128),
+	due TIMESTAMP WITH TIME ZONE,
+	percentage SMALLINT CHECK (percentage >= 0 and percentage <= 100),
+	submitted BOOL, -- Whether or not the project is submitted.
+	description VARCHAR(512), -- Size??
+	updated TIMESTAMP WITH TIME ZONE,
+	version INT,
+	PRIMARY KEY (id, pid)
+);
+CREATE TABLE IF NOT EXISTS owns (
+	name VARCHAR(320) REFERENCES users,
+	pid BIGINT REFERENCES projects,
+	PRIMARY KEY (name, pid)
+);
+CREATE TABLE IF NOT EXISTS views (
+	name VARCHAR(320) REFERENCES users,
+	pid BIGINT REFERENCES projects,
+	PRIMARY KEY (name, pid)
+);
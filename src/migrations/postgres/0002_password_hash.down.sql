@@ -0,0 +1,7 @@
+-- Passwords hashed with anything other than the original parameters will no
+-- longer be usable after this.
+ALTER TABLE users DROP COLUMN hash_algorithm;
+ALTER TABLE users DROP COLUMN hash_n;
+ALTER TABLE users DROP COLUMN hash_r;
+ALTER TABLE users DROP COLUMN hash_p;
+ALTER TABLE users DROP COLUMN hash_key_len;
@@ -0,0 +1,7 @@
+-- Password hashing parameters; see passwordHash.
+-- The defaults match the parameters used before they were stored.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS hash_algorithm VARCHAR(16) DEFAULT 'scrypt';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS hash_n INT DEFAULT 65536;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS hash_r INT DEFAULT 8;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS hash_p INT DEFAULT 1;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS hash_key_len INT DEFAULT 256;
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS sessions (
+	id VARCHAR(32) PRIMARY KEY, -- Public identifier for the session.
+	token BYTEA UNIQUE, -- SHA-256 hash of the bearer token.
+	name VARCHAR(320) REFERENCES users,
+	created TIMESTAMP WITH TIME ZONE,
+	last_used TIMESTAMP WITH TIME ZONE,
+	expires TIMESTAMP WITH TIME ZONE
+);
@@ -0,0 +1,8 @@
+-- Versions of the synchronised fields; see merge.
+ALTER TABLE projects ADD COLUMN IF NOT EXISTS name_version INT NOT NULL DEFAULT 0;
+ALTER TABLE projects ADD COLUMN IF NOT EXISTS percentage_version INT NOT NULL DEFAULT 0;
+ALTER TABLE projects ADD COLUMN IF NOT EXISTS description_version INT NOT NULL DEFAULT 0;
+ALTER TABLE deliverables ADD COLUMN IF NOT EXISTS name_version INT NOT NULL DEFAULT 0;
+ALTER TABLE deliverables ADD COLUMN IF NOT EXISTS due_version INT NOT NULL DEFAULT 0;
+ALTER TABLE deliverables ADD COLUMN IF NOT EXISTS percentage_version INT NOT NULL DEFAULT 0;
+ALTER TABLE deliverables ADD COLUMN IF NOT EXISTS description_version INT NOT NULL DEFAULT 0;
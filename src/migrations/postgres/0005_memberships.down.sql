@@ -0,0 +1,14 @@
+-- Editors and commenters become viewers.
+CREATE TABLE owns (
+	name VARCHAR(320) REFERENCES users,
+	pid BIGINT REFERENCES projects,
+	PRIMARY KEY (name, pid)
+);
+CREATE TABLE views (
+	name VARCHAR(320) REFERENCES users,
+	pid BIGINT REFERENCES projects,
+	PRIMARY KEY (name, pid)
+);
+INSERT INTO owns (name, pid) SELECT name, pid FROM memberships WHERE role = 'owner';
+INSERT INTO views (name, pid) SELECT name, pid FROM memberships WHERE role <> 'owner';
+DROP TABLE memberships;
@@ -0,0 +1,12 @@
+-- Log of changes to projects, used for the changes feed; see feed.
+-- item identifies the changed deliverable or member, and is empty for the
+-- project and flag.
+CREATE TABLE IF NOT EXISTS changes (
+	seq BIGSERIAL PRIMARY KEY,
+	pid BIGINT NOT NULL, -- Not a reference, since projects are deleted.
+	kind VARCHAR(16) NOT NULL,
+	item VARCHAR(320) NOT NULL DEFAULT '',
+	deleted BOOL NOT NULL DEFAULT FALSE,
+	changed_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS changes_pid ON changes (pid, seq);
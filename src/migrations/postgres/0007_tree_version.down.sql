@@ -0,0 +1 @@
+ALTER TABLE projects DROP COLUMN tree_version;
@@ -0,0 +1,2 @@
+-- Bumped whenever anything in the project changes; see recordChange.
+ALTER TABLE projects ADD COLUMN IF NOT EXISTS tree_version INT NOT NULL DEFAULT 0;
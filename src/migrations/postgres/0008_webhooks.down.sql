@@ -0,0 +1,6 @@
+DROP INDEX webhook_deliveries_due;
+DROP INDEX webhook_deliveries_hook;
+DROP TABLE webhook_deliveries;
+DROP INDEX webhooks_name;
+DROP INDEX webhooks_pid;
+DROP TABLE webhooks;
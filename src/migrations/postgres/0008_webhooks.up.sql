@@ -0,0 +1,32 @@
+-- Webhooks registered by project owners (with pid set) or by users for all
+-- of their projects (with pid NULL); see webhooks.
+CREATE TABLE IF NOT EXISTS webhooks (
+	id BIGINT PRIMARY KEY,
+	pid BIGINT, -- Not a reference, since projects are deleted.
+	name VARCHAR(320) NOT NULL, -- The user who added the webhook.
+	url VARCHAR(2048) NOT NULL,
+	secret VARCHAR(128) NOT NULL,
+	events VARCHAR(512) NOT NULL, -- Comma separated.
+	created TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX IF NOT EXISTS webhooks_pid ON webhooks (pid);
+CREATE INDEX IF NOT EXISTS webhooks_name ON webhooks (name);
+-- Queue (and log) of webhook deliveries.
+-- The url and signature are saved with the delivery, so that deliveries are
+-- still sent after the project is deleted.
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+	id BIGINT PRIMARY KEY,
+	hook BIGINT NOT NULL,
+	url VARCHAR(2048) NOT NULL,
+	event VARCHAR(32) NOT NULL,
+	payload TEXT NOT NULL,
+	signature VARCHAR(128) NOT NULL,
+	status VARCHAR(16) NOT NULL CHECK (status IN ('pending', 'delivered', 'failed')),
+	attempts INT NOT NULL DEFAULT 0,
+	response_status INT NOT NULL DEFAULT 0,
+	last_error VARCHAR(512) NOT NULL DEFAULT '',
+	created TIMESTAMP WITH TIME ZONE,
+	next_attempt TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX IF NOT EXISTS webhook_deliveries_hook ON webhook_deliveries (hook, created);
+CREATE INDEX IF NOT EXISTS webhook_deliveries_due ON webhook_deliveries (status, next_attempt);
@@ -0,0 +1,3 @@
+DROP INDEX deliverable_history_deliverable;
+DROP TABLE deliverable_history;
+ALTER TABLE deliverables DROP COLUMN state;
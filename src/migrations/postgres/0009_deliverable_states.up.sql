@@ -0,0 +1,18 @@
+-- Review workflow for deliverables; see workflow.
+-- submitted is kept up to date from the state, for older clients.
+ALTER TABLE deliverables ADD COLUMN IF NOT EXISTS state VARCHAR(16) NOT NULL DEFAULT 'draft'
+	CHECK (state IN ('draft', 'submitted', 'in_review', 'accepted', 'rejected'));
+UPDATE deliverables SET state='submitted' WHERE submitted;
+-- Every state change, along with who made it.
+CREATE TABLE IF NOT EXISTS deliverable_history (
+	id BIGINT PRIMARY KEY,
+	pid BIGINT NOT NULL, -- Not references, since deliverables are deleted.
+	did BIGINT NOT NULL,
+	seq INTEGER NOT NULL, -- Position in the deliverable's history.
+	from_state VARCHAR(16) NOT NULL,
+	to_state VARCHAR(16) NOT NULL,
+	name VARCHAR(320) NOT NULL, -- Not a reference, so that users can be deleted.
+	note VARCHAR(512) NOT NULL DEFAULT '',
+	changed_at TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX IF NOT EXISTS deliverable_history_deliverable ON deliverable_history (pid, did, seq);
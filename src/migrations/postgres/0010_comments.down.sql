@@ -0,0 +1,3 @@
+DROP INDEX comments_parent;
+DROP INDEX comments_thread;
+DROP TABLE comments;
@@ -0,0 +1,16 @@
+-- Comment threads on projects (with did 0) and deliverables; see comments.
+-- Replies have the id of the comment they reply to as the parent, and
+-- comments starting a thread have parent 0.
+CREATE TABLE IF NOT EXISTS comments (
+	id BIGINT PRIMARY KEY,
+	pid BIGINT NOT NULL, -- Not references, since projects are deleted.
+	did BIGINT NOT NULL DEFAULT 0,
+	parent BIGINT NOT NULL DEFAULT 0,
+	seq INTEGER NOT NULL, -- Order within the project or deliverable.
+	name VARCHAR(320) NOT NULL, -- Not a reference, so that users can be deleted.
+	body VARCHAR(4096) NOT NULL,
+	created TIMESTAMP WITH TIME ZONE,
+	updated TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX IF NOT EXISTS comments_thread ON comments (pid, did, seq);
+CREATE INDEX IF NOT EXISTS comments_parent ON comments (parent);
@@ -0,0 +1,38 @@
+CREATE TABLE users (
+	name VARCHAR(320) PRIMARY KEY, -- 320 is the maximum email length.
+	salt BLOB,
+	password BLOB, -- Password is salted and encrypted.
+	is_manager BOOLEAN -- True if the user is also a manager.
+);
+CREATE TABLE projects (
+	id BIGINT PRIMARY KEY,
+	name VARCHAR(128),
+	percentage SMALLINT CHECK (percentage >= 0 and percentage <= 100),
+	description VARCHAR(512),
+	updated TIMESTAMP,
+	version INT,
+	flag BOOLEAN,
+	flag_version INT
+);
+CREATE TABLE deliverables (
+	id BIGINT,
+	pid BIGINT,
+	name VARCHAR(128),
+	due TIMESTAMP,
+	percentage SMALLINT CHECK (percentage >= 0 and percentage <= 100),
+	submitted BOOLEAN, -- Whether or not the project is submitted.
+	description VARCHAR(512),
+	updated TIMESTAMP,
+	version INT,
+	PRIMARY KEY (id, pid)
+);
+CREATE TABLE owns (
+	name VARCHAR(320) REFERENCES users,
+	pid BIGINT REFERENCES projects,
+	PRIMARY KEY (name, pid)
+);
+CREATE TABLE views (
+	name VARCHAR(320) REFERENCES users,
+	pid BIGINT REFERENCES projects,
+	PRIMARY KEY (name, pid)
+);
@@ -0,0 +1,5 @@
+ALTER TABLE users DROP COLUMN hash_algorithm;
+ALTER TABLE users DROP COLUMN hash_n;
+ALTER TABLE users DROP COLUMN hash_r;
+ALTER TABLE users DROP COLUMN hash_p;
+ALTER TABLE users DROP COLUMN hash_key_len;
@@ -0,0 +1,6 @@
+-- Password hashing parameters; see passwordHash.
+ALTER TABLE users ADD COLUMN hash_algorithm VARCHAR(16) DEFAULT 'scrypt';
+ALTER TABLE users ADD COLUMN hash_n INT DEFAULT 65536;
+ALTER TABLE users ADD COLUMN hash_r INT DEFAULT 8;
+ALTER TABLE users ADD COLUMN hash_p INT DEFAULT 1;
+ALTER TABLE users ADD COLUMN hash_key_len INT DEFAULT 256;
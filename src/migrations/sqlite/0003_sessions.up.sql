@@ -0,0 +1,8 @@
+CREATE TABLE sessions (
+	id VARCHAR(32) PRIMARY KEY, -- Public identifier for the session.
+	token BLOB UNIQUE, -- SHA-256 hash of the bearer token.
+	name VARCHAR(320) REFERENCES users,
+	created TIMESTAMP,
+	last_used TIMESTAMP,
+	expires TIMESTAMP
+);
@@ -0,0 +1,7 @@
+ALTER TABLE projects DROP COLUMN name_version;
+ALTER TABLE projects DROP COLUMN percentage_version;
+ALTER TABLE projects DROP COLUMN description_version;
+ALTER TABLE deliverables DROP COLUMN name_version;
+ALTER TABLE deliverables DROP COLUMN due_version;
+ALTER TABLE deliverables DROP COLUMN percentage_version;
+ALTER TABLE deliverables DROP COLUMN description_version;
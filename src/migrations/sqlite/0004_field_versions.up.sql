@@ -0,0 +1,8 @@
+-- Versions of the synchronised fields; see merge.
+ALTER TABLE projects ADD COLUMN name_version INT NOT NULL DEFAULT 0;
+ALTER TABLE projects ADD COLUMN percentage_version INT NOT NULL DEFAULT 0;
+ALTER TABLE projects ADD COLUMN description_version INT NOT NULL DEFAULT 0;
+ALTER TABLE deliverables ADD COLUMN name_version INT NOT NULL DEFAULT 0;
+ALTER TABLE deliverables ADD COLUMN due_version INT NOT NULL DEFAULT 0;
+ALTER TABLE deliverables ADD COLUMN percentage_version INT NOT NULL DEFAULT 0;
+ALTER TABLE deliverables ADD COLUMN description_version INT NOT NULL DEFAULT 0;
@@ -0,0 +1,17 @@
+-- Combine owns and views into a single table with roles; see permissions.
+CREATE TABLE memberships (
+	name VARCHAR(320) REFERENCES users,
+	pid BIGINT REFERENCES projects,
+	role VARCHAR(16) NOT NULL CHECK (role IN ('owner', 'editor', 'commenter', 'viewer')),
+	added_by VARCHAR(320), -- Not a reference, so that users can be deleted.
+	added_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (name, pid)
+);
+-- Owners are copied first, so that they keep that role if they somehow
+-- also view the project.
+INSERT OR IGNORE INTO memberships (name, pid, role)
+	SELECT name, pid, 'owner' FROM owns;
+INSERT OR IGNORE INTO memberships (name, pid, role)
+	SELECT name, pid, 'viewer' FROM views;
+DROP TABLE owns;
+DROP TABLE views;
@@ -0,0 +1,2 @@
+DROP INDEX changes_pid;
+DROP TABLE changes;
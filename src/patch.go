@@ -0,0 +1,447 @@
+/*
+Partial updates (PATCH) to items.
+
+Two patch formats are supported: JSON Merge Patch (RFC 7396), which is a
+partial copy of the item, and JSON Patch (RFC 6902), which is a list of
+operations. Either is applied to the current state of the item from get, and
+the result is saved with set, so patches are validated and merged exactly as
+if the client had sent the whole item.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+var patchConflict error = &requestError{http.StatusConflict, "patch_test_failed", "Patch test failed", nil}
+
+// Patch content types.
+const (
+	mergePatchType = "application/merge-patch+json"
+	jsonPatchType  = "application/json-patch+json"
+)
+
+// patch applies the patch in body to the given resource, and responds with
+// the result of set.
+// JSON Patch is used if the content type says so; anything else is treated
+// as a merge patch.
+// Only the fields returned by patchable may be changed.
+// set is passed the changed fields along with the rest of the item as
+// reported by get, so get must leave out any write-only fields (like the
+// login password) rather than reporting them as empty.
+func patch(r resource, contentType string, body io.Reader, enc encoder) error {
+	fields := r.patchable()
+	if len(fields) == 0 {
+		return invalidMethod
+	}
+
+	// Get the current state.
+	buf := bytes.Buffer{}
+	err := r.get(json.NewEncoder(&buf))
+	if err != nil {
+		return err
+	}
+	cur, err := decodeValue(buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	patch, err := io.ReadAll(body)
+	if err != nil {
+		return badJSON(err)
+	}
+	var updated interface{}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType == jsonPatchType {
+		ops := []patchOperation{}
+		err = json.Unmarshal(patch, &ops)
+		if err != nil {
+			return badJSON(err)
+		}
+		updated, err = applyJSONPatch(copyValue(cur), ops)
+		if err != nil {
+			return err
+		}
+	} else {
+		value, err := decodeValue(patch)
+		if err != nil {
+			return badJSON(err)
+		}
+		updated = applyMergePatch(copyValue(cur), value)
+	}
+
+	// Check that only patchable fields changed.
+	before, ok := cur.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("Unexpected state %v for patching\n", cur)
+	}
+	after, ok := updated.(map[string]interface{})
+	if !ok {
+		return badBody("The patched value must be an object")
+	}
+	invalid := []fieldError{}
+	for _, changed := range changedFields(before, after) {
+		if !contains(fields, changed) {
+			invalid = append(invalid, fieldError{changed, "Can not be patched"})
+		}
+	}
+	err = invalidFields(invalid)
+	if err != nil {
+		return err
+	}
+
+	buf.Reset()
+	err = json.NewEncoder(&buf).Encode(updated)
+	if err != nil {
+		return err
+	}
+	return r.set(json.NewDecoder(&buf), enc)
+}
+
+// decodeValue decodes a single JSON value, keeping numbers exact so that
+// ids survive the round trip.
+func decodeValue(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var value interface{}
+	err := dec.Decode(&value)
+	if err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("Expected a single JSON value\n")
+	}
+	return value, nil
+}
+
+// copyValue returns a deep copy of a decoded JSON value.
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			c[key] = copyValue(item)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, item := range v {
+			c[i] = copyValue(item)
+		}
+		return c
+	}
+	return value
+}
+
+// changedFields returns the top level fields which differ between the two
+// objects.
+func changedFields(before, after map[string]interface{}) []string {
+	changed := []string{}
+	for key, value := range before {
+		if !reflect.DeepEqual(value, after[key]) {
+			changed = append(changed, key)
+		}
+	}
+	for key := range after {
+		if _, ok := before[key]; !ok {
+			changed = append(changed, key)
+		}
+	}
+	return changed
+}
+
+// contains returns true if s is in list.
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// applyMergePatch applies a JSON Merge Patch to target, as described in
+// RFC 7396, and returns the result.
+// target may be modified.
+func applyMergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+	for key, value := range p {
+		if value == nil {
+			t = without(t, key)
+		} else {
+			t[key] = applyMergePatch(t[key], value)
+		}
+	}
+	return t
+}
+
+// without returns a copy of the object without the given key.
+func without(object map[string]interface{}, key string) map[string]interface{} {
+	c := make(map[string]interface{}, len(object))
+	for k, v := range object {
+		if k != key {
+			c[k] = v
+		}
+	}
+	return c
+}
+
+// patchOperation is a single JSON Patch operation.
+// Value is empty if not given, which is distinct from null.
+type patchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// applyJSONPatch applies the given JSON Patch operations to doc, as
+// described in RFC 6902, and returns the result.
+// doc may be modified.
+// Malformed operations return invalidBody, and failed tests return
+// patchConflict.
+func applyJSONPatch(doc interface{}, ops []patchOperation) (interface{}, error) {
+	for i, op := range ops {
+		var err error
+		doc, err = applyPatchOperation(doc, op)
+		if err == invalidBody {
+			// Say which operation failed.
+			return nil, badBody(fmt.Sprintf("Operation %d (%s %s) is invalid",
+				i, op.Op, op.Path))
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+// applyPatchOperation applies a single JSON Patch operation to doc, and
+// returns the result.
+func applyPatchOperation(doc interface{}, op patchOperation) (interface{}, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	switch op.Op {
+	case "add", "replace", "test":
+		if len(op.Value) == 0 {
+			return nil, invalidBody
+		}
+		value, err = decodeValue(op.Value)
+		if err != nil {
+			return nil, invalidBody
+		}
+	case "move", "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		value, err = pointerGet(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "move" {
+			if strings.HasPrefix(op.Path+"/", op.From+"/") && op.Path != op.From {
+				// A value can't be moved into itself.
+				return nil, invalidBody
+			}
+			doc, err = pointerRemove(doc, from)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			value = copyValue(value)
+		}
+	}
+
+	switch op.Op {
+	case "add", "move", "copy":
+		doc, err = pointerAdd(doc, path, value)
+	case "remove":
+		doc, err = pointerRemove(doc, path)
+	case "replace":
+		if len(path) == 0 {
+			// Replace the whole document.
+			doc = value
+			break
+		}
+		doc, err = pointerRemove(doc, path)
+		if err == nil {
+			doc, err = pointerAdd(doc, path, value)
+		}
+	case "test":
+		cur, err := pointerGet(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(cur, value) {
+			return nil, patchConflict
+		}
+	default:
+		return nil, invalidBody
+	}
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// parsePointer splits a JSON Pointer (RFC 6901) into reference tokens.
+// The empty pointer refers to the whole document.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	} else if pointer[0] != '/' {
+		return nil, invalidBody
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		token = strings.ReplaceAll(token, "~1", "/")
+		tokens[i] = strings.ReplaceAll(token, "~0", "~")
+	}
+	return tokens, nil
+}
+
+// arrayIndex parses an array index token.
+// The index may be equal to the length if end is true, to refer to the end
+// of the array.
+func arrayIndex(token string, length int, end bool) (int, error) {
+	if end && token == "-" {
+		return length, nil
+	} else if token == "" || (token != "0" && token[0] == '0') {
+		return 0, invalidBody
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i > length || (i == length && !end) {
+		return 0, invalidBody
+	}
+	return i, nil
+}
+
+// pointerGet returns the value referred to by the given pointer tokens.
+func pointerGet(doc interface{}, tokens []string) (interface{}, error) {
+	for _, token := range tokens {
+		switch d := doc.(type) {
+		case map[string]interface{}:
+			value, ok := d[token]
+			if !ok {
+				return nil, invalidBody
+			}
+			doc = value
+		case []interface{}:
+			i, err := arrayIndex(token, len(d), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = d[i]
+		default:
+			return nil, invalidBody
+		}
+	}
+	return doc, nil
+}
+
+// pointerUpdate replaces the parent of the value referred to by the given
+// pointer tokens with the result of update, and returns the new document.
+// tokens must not be empty.
+func pointerUpdate(doc interface{}, tokens []string, update func(parent interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(tokens) == 1 {
+		return update(doc, tokens[0])
+	}
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		child, ok := d[tokens[0]]
+		if !ok {
+			return nil, invalidBody
+		}
+		child, err := pointerUpdate(child, tokens[1:], update)
+		if err != nil {
+			return nil, err
+		}
+		d[tokens[0]] = child
+		return d, nil
+	case []interface{}:
+		i, err := arrayIndex(tokens[0], len(d), false)
+		if err != nil {
+			return nil, err
+		}
+		d[i], err = pointerUpdate(d[i], tokens[1:], update)
+		if err != nil {
+			return nil, err
+		}
+		return d, nil
+	}
+	return nil, invalidBody
+}
+
+// pointerAdd adds the value at the given pointer, and returns the new
+// document.
+func pointerAdd(doc interface{}, tokens []string, value interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	return pointerUpdate(doc, tokens, func(parent interface{}, token string) (interface{}, error) {
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			p[token] = value
+			return p, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(p), true)
+			if err != nil {
+				return nil, err
+			}
+			p = append(p, nil)
+			copy(p[i+1:], p[i:])
+			p[i] = value
+			return p, nil
+		}
+		return nil, invalidBody
+	})
+}
+
+// pointerRemove removes the value at the given pointer, and returns the new
+// document.
+func pointerRemove(doc interface{}, tokens []string) (interface{}, error) {
+	if len(tokens) == 0 {
+		// The whole document can't be removed.
+		return nil, invalidBody
+	}
+	return pointerUpdate(doc, tokens, func(parent interface{}, token string) (interface{}, error) {
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := p[token]; !ok {
+				return nil, invalidBody
+			}
+			return without(p, token), nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(p), false)
+			if err != nil {
+				return nil, err
+			}
+			return append(p[:i], p[i+1:]...), nil
+		}
+		return nil, invalidBody
+	})
+}
+
+// vim: sw=4 ts=4 noexpandtab
@@ -0,0 +1,125 @@
+/*
+Tests for applying JSON Merge Patch and JSON Patch documents.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// mustDecode decodes the given JSON value.
+func mustDecode(t *testing.T, data string) interface{} {
+	value, err := decodeValue([]byte(data))
+	if err != nil {
+		t.Fatalf("Decoding %s: %q", data, err)
+	}
+	return value
+}
+
+// The test cases from RFC 7396, appendix A.
+func TestMergePatch(t *testing.T) {
+	cases := []struct{ target, patch, result string }{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+	for _, c := range cases {
+		got := applyMergePatch(mustDecode(t, c.target), mustDecode(t, c.patch))
+		if !reflect.DeepEqual(got, mustDecode(t, c.result)) {
+			t.Errorf("Patching %s with %s: expected %s, got %v",
+				c.target, c.patch, c.result, got)
+		}
+	}
+}
+
+// Test cases based on the examples in RFC 6902, appendix A.
+func TestJSONPatch(t *testing.T) {
+	cases := []struct {
+		doc, patch, result string
+		err                error
+	}{
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`,
+			`{"baz":"qux","foo":"bar"}`, nil},
+		{`{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`,
+			`{"foo":["bar","qux","baz"]}`, nil},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`,
+			`{"foo":"bar"}`, nil},
+		{`{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`,
+			`{"foo":["bar","baz"]}`, nil},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`,
+			`{"baz":"boo","foo":"bar"}`, nil},
+		{`{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`,
+			`[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`,
+			`{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`, nil},
+		{`{"foo":["all","grass","cows","eat"]}`,
+			`[{"op":"move","from":"/foo/1","path":"/foo/3"}]`,
+			`{"foo":["all","cows","eat","grass"]}`, nil},
+		{`{"baz":"qux","foo":["a",2,"c"]}`,
+			`[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2}]`,
+			`{"baz":"qux","foo":["a",2,"c"]}`, nil},
+		{`{"baz":"qux"}`, `[{"op":"test","path":"/baz","value":"bar"}]`,
+			``, patchConflict},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/child","value":{"grandchild":{}}}]`,
+			`{"foo":"bar","child":{"grandchild":{}}}`, nil},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":"qux"}]`,
+			``, invalidBody},
+		{`{"/":9,"~1":10}`, `[{"op":"test","path":"/~01","value":10}]`,
+			`{"/":9,"~1":10}`, nil},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":["abc","def"]}]`,
+			`{"foo":["bar",["abc","def"]]}`, nil},
+		{`{"foo":"bar"}`, `[{"op":"copy","from":"/foo","path":"/baz"}]`,
+			`{"foo":"bar","baz":"bar"}`, nil},
+		{`{"foo":null}`, `[{"op":"replace","path":"/foo","value":null}]`,
+			`{"foo":null}`, nil},
+		{`{"foo":"bar"}`, `[{"op":"replace","path":"/baz","value":1}]`,
+			``, invalidBody},
+		{`{"foo":"bar"}`, `[{"op":"replace","path":"","value":{"baz":"qux"}}]`,
+			`{"baz":"qux"}`, nil},
+		{`{"foo":"bar"}`, `[{"op":"replace","path":""}]`,
+			``, invalidBody},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz"}]`,
+			``, invalidBody},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/01","value":1}]`,
+			``, invalidBody},
+		{`{"foo":{"bar":1}}`, `[{"op":"move","from":"/foo","path":"/foo/bar/baz"}]`,
+			``, invalidBody},
+		{`{"foo":"bar"}`, `[{"op":"frobnicate","path":"/foo"}]`,
+			``, invalidBody},
+	}
+	for _, c := range cases {
+		ops := []patchOperation{}
+		err := json.Unmarshal([]byte(c.patch), &ops)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := applyJSONPatch(mustDecode(t, c.doc), ops)
+		if !errors.Is(err, c.err) {
+			t.Errorf("Patching %s with %s: expected error %v, got %v",
+				c.doc, c.patch, c.err, err)
+		} else if err == nil && !reflect.DeepEqual(got, mustDecode(t, c.result)) {
+			t.Errorf("Patching %s with %s: expected %s, got %v",
+				c.doc, c.patch, c.result, got)
+		}
+	}
+}
+
+// vim: sw=4 ts=4 noexpandtab
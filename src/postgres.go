@@ -0,0 +1,32 @@
+/*
+PostgreSQL storage.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package backend
+
+import (
+	"database/sql"
+)
+
+var postgres = &dialect{
+	name:   "postgres",
+	rebind: func(query string) string { return query },
+	versionTable: `CREATE TABLE IF NOT EXISTS schema_version (
+		version INT PRIMARY KEY,
+		applied TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	)`,
+	forUpdate:   " FOR UPDATE",
+	lockChanges: "LOCK TABLE changes IN EXCLUSIVE MODE",
+}
+
+// NewPostgresStore returns a Store using the given PostgreSQL database.
+// The caller is responsible for importing a driver (such as
+// github.com/lib/pq).
+func NewPostgresStore(db *sql.DB) Store {
+	return &sqlStore{db, nil, 0, postgres, &notifier{}, nil}
+}
+
+// vim: sw=4 ts=4 noexpandtab
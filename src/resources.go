@@ -8,20 +8,14 @@ Contact:	<hobbitalastair at yandex dot com>
 package backend
 
 import (
-	cryptRand "crypto/rand"
-	"database/sql"
 	"encoding/base32"
 	"fmt"
-	"math/rand"
+	"net/url"
 	"regexp"
 	"strconv"
 	"time"
 )
 
-var invalidResource error = fmt.Errorf("Invalid defaultResource\n")
-var invalidBody error = fmt.Errorf("Invalid body\n")
-var invalidMethod error = fmt.Errorf("Invalid method\n")
-
 // access types (for permission handling).
 const (
 	get = 1 << iota
@@ -48,9 +42,12 @@ type decoder interface {
 type resource interface {
 	forbidden() int
 	get(encoder) error
-	set(decoder) error
+	set(decoder, encoder) error
 	create(decoder, func(string, interface{}) error) error
 	delete() error
+	// patchable returns the fields which may be changed by a PATCH; see
+	// patch.
+	patchable() []string
 }
 
 // Fake encoder to allow extracting the current state from a get call.
@@ -67,14 +64,29 @@ func (m *mapEncoder) Encode(item interface{}) error {
 
 // Regular expressions for the various defaultResources.
 var (
-	loginRe           = regexp.MustCompile(`\A/login\z`)
-	projectListRe     = regexp.MustCompile(`\A/projects\z`)
-	projectRe         = regexp.MustCompile(`\A/projects/(\d+)\z`)
-	flagRe            = regexp.MustCompile(`\A/projects/(\d+)/flag\z`)
-	clientListRe      = regexp.MustCompile(`\A/projects/(\d+)/clients\z`)
-	clientRe          = regexp.MustCompile(`\A/projects/(\d+)/clients/([^/]+)\z`)
-	deliverableListRe = regexp.MustCompile(`\A/projects/(\d+)/deliverables\z`)
-	deliverableRe     = regexp.MustCompile(`\A/projects/(\d+)/deliverables/(\d+)\z`)
+	loginRe               = regexp.MustCompile(`\A/login\z`)
+	projectListRe         = regexp.MustCompile(`\A/projects\z`)
+	projectRe             = regexp.MustCompile(`\A/projects/(\d+)\z`)
+	flagRe                = regexp.MustCompile(`\A/projects/(\d+)/flag\z`)
+	clientListRe          = regexp.MustCompile(`\A/projects/(\d+)/clients\z`)
+	clientRe              = regexp.MustCompile(`\A/projects/(\d+)/clients/([^/]+)\z`)
+	deliverableListRe     = regexp.MustCompile(`\A/projects/(\d+)/deliverables\z`)
+	deliverableRe         = regexp.MustCompile(`\A/projects/(\d+)/deliverables/(\d+)\z`)
+	historyListRe         = regexp.MustCompile(`\A/projects/(\d+)/deliverables/(\d+)/history\z`)
+	historyRe             = regexp.MustCompile(`\A/projects/(\d+)/deliverables/(\d+)/history/(\d+)\z`)
+	commentListRe         = regexp.MustCompile(`\A/projects/(\d+)/comments\z`)
+	commentRe             = regexp.MustCompile(`\A/projects/(\d+)/comments/(\d+)\z`)
+	deliverableCommentsRe = regexp.MustCompile(`\A/projects/(\d+)/deliverables/(\d+)/comments\z`)
+	deliverableCommentRe  = regexp.MustCompile(`\A/projects/(\d+)/deliverables/(\d+)/comments/(\d+)\z`)
+	sessionListRe         = regexp.MustCompile(`\A/sessions\z`)
+	sessionRe             = regexp.MustCompile(`\A/sessions/([^/]+)\z`)
+	feedRe                = regexp.MustCompile(`\A/sync\z`)
+	webhookListRe         = regexp.MustCompile(`\A/webhooks\z`)
+	webhookRe             = regexp.MustCompile(`\A/webhooks/(\d+)\z`)
+	deliveryListRe        = regexp.MustCompile(`\A/webhooks/(\d+)/deliveries\z`)
+	projectWebhookListRe  = regexp.MustCompile(`\A/projects/(\d+)/webhooks\z`)
+	projectWebhookRe      = regexp.MustCompile(`\A/projects/(\d+)/webhooks/(\d+)\z`)
+	projectDeliveryListRe = regexp.MustCompile(`\A/projects/(\d+)/webhooks/(\d+)/deliveries\z`)
 )
 
 // defaultResource provides a default implementation of all of the methods required
@@ -89,7 +101,7 @@ func (r defaultResource) get(enc encoder) error {
 	return invalidMethod
 }
 
-func (r defaultResource) set(dec decoder) error {
+func (r defaultResource) set(dec decoder, enc encoder) error {
 	return invalidMethod
 }
 
@@ -101,18 +113,24 @@ func (r defaultResource) delete() error {
 	return invalidMethod
 }
 
+func (r defaultResource) patchable() []string {
+	return nil
+}
+
 type loginResource struct {
 	resource
 	user       string
 	password   string
 	exists     bool
 	is_manager bool
-	db         *sql.DB
+	store      Store
 }
 
 type login struct {
 	Username string
-	Password string // Note that this field is largely unused.
+	// Password is only ever uploaded, so that a PATCH of the login (which
+	// starts from get) never sends an unchanged, empty password to set.
+	Password string `json:",omitempty"`
 	Manager  bool
 }
 
@@ -122,7 +140,11 @@ type login struct {
 func (l *loginResource) forbidden() int {
 	// Anyone can access the login resource, bar create if the account already
 	// exists.
-	if l.exists {
+	// Changing the password or deleting the account needs the password, so
+	// that a stolen session token can't be used to take over the account.
+	if l.exists && l.password == "" {
+		return create | set | delete
+	} else if l.exists {
 		return create
 	}
 	return 0
@@ -134,29 +156,27 @@ func (l *loginResource) get(enc encoder) error {
 	return enc.Encode(login{Username: l.user, Manager: l.is_manager})
 }
 
-// set for loginResource changes the password.
-func (l *loginResource) set(dec decoder) error {
+// set for loginResource changes the password, which must be given.
+func (l *loginResource) set(dec decoder, enc encoder) error {
 	login := login{}
 	err := dec.Decode(&login)
 	if err != nil {
-		return invalidBody
+		return badJSON(err)
+	}
+	if login.Password == "" {
+		return badBody("No new password given",
+			fieldError{"Password", "Must not be empty"})
 	}
-	return SetPassword(l.user, login.Password, l.db)
+	return setPassword(l.user, login.Password, l.store)
+}
+
+func (l *loginResource) patchable() []string {
+	return []string{"Password"}
 }
 
 // create for loginResource creates a new account.
 func (l *loginResource) create(dec decoder, success func(string, interface{}) error) error {
-	salt := make([]byte, passwordSize)
-	_, err := cryptRand.Read(salt)
-	if err != nil {
-		return err
-	}
-	key, err := encryptPassword(l.password, salt)
-	if err != nil {
-		return err
-	}
-	_, err = l.db.Exec("INSERT INTO users VALUES ($1, $2, $3, $4)",
-		l.user, salt, key, false)
+	err := NewDB(l.store).AddUser(l.user, l.password, false)
 	if err != nil {
 		return err
 	}
@@ -166,16 +186,17 @@ func (l *loginResource) create(dec decoder, success func(string, interface{}) er
 // delete for loginResource deletes that account, and any connections to
 // projects.
 func (l *loginResource) delete() error {
-	return NewDB(l.db).DeleteUser(l.user)
+	return NewDB(l.store).DeleteUser(l.user)
 }
 
 // newLogin creates a new loginResouces.
 // It saves the is_manager and exists state when creating the resource, since
 // they are used later in get() and forbidden().
-func newLogin(user string, password string, db *sql.DB) (resource, error) {
-	l := loginResource{defaultResource{}, user, password, true, false, db}
-	err := db.QueryRow("SELECT is_manager FROM users WHERE name=$1", user).Scan(&l.is_manager)
-	if err == sql.ErrNoRows {
+func newLogin(user string, password string, store Store) (resource, error) {
+	l := loginResource{defaultResource{}, user, password, true, false, store}
+	var err error
+	l.is_manager, err = store.isManager(user)
+	if err == notFound {
 		l.exists = false
 		err = nil
 	}
@@ -186,7 +207,8 @@ type projectList struct {
 	resource
 	user       string
 	is_manager bool
-	db         *sql.DB
+	versions   bool // List tree versions as well as ids.
+	store      Store
 }
 
 func (l *projectList) forbidden() int {
@@ -197,26 +219,28 @@ func (l *projectList) forbidden() int {
 }
 
 func (l *projectList) get(enc encoder) error {
-	for _, table := range []string{"views", "owns"} {
-		rows, err := l.db.Query(fmt.Sprintf("SELECT pid FROM %s WHERE name=$1", table), l.user)
+	if l.versions {
+		versions, err := l.store.treeVersions(l.user)
 		if err != nil {
 			return err
 		}
-		defer rows.Close()
-
-		for rows.Next() {
-			id := -1
-			err = rows.Scan(&id)
-			if err != nil {
-				return err
-			}
-			err = enc.Encode(id)
+		for _, v := range versions {
+			err = enc.Encode(v)
 			if err != nil {
 				return err
 			}
 		}
-		if rows.Err() != nil {
-			return rows.Err()
+		return nil
+	}
+
+	ids, err := l.store.projects(l.user)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		err = enc.Encode(id)
+		if err != nil {
+			return err
 		}
 	}
 	return nil
@@ -226,29 +250,45 @@ func (l *projectList) get(enc encoder) error {
 func (l *projectList) create(dec decoder, success func(string, interface{}) error) error {
 	project := project{}
 	err := dec.Decode(&project)
-	if err != nil || !project.valid() {
-		return invalidBody
+	if err != nil {
+		return badJSON(err)
+	}
+	err = project.validate()
+	if err != nil {
+		return err
 	}
-	project.Id = uint(rand.Int())
-	_, err = l.db.Exec("INSERT INTO projects VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
-		project.Id, project.Name, project.Percentage, project.Description,
-		project.Updated, 0, false, 0)
+	project.Version = 0
+	project.Updated = formatDate(time.Now())
+	project.Id, err = insertWithId(func(id uint) error {
+		project.Id = id
+		return l.store.addProject(project)
+	})
 	if err != nil {
 		return err
 	}
 
 	// Add the user to the project.
-	_, err = l.db.Exec("INSERT INTO owns VALUES ($1, $2)", l.user, project.Id)
+	err = l.store.addMember(project.Id,
+		member{l.user, roleOwner, l.user, time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+
+	// Respond with the saved project, including the tree version.
+	project, err = l.store.project(project.Id)
 	if err != nil {
 		return err
 	}
+	project.Owns = true
+	project.Role = roleOwner
 	return success(fmt.Sprintf("/projects/%d", project.Id), project)
 }
 
-func newProjectList(user string, db *sql.DB) (resource, error) {
-	p := projectList{defaultResource{}, user, false, db}
+func newProjectList(user string, store Store) (*projectList, error) {
+	p := projectList{defaultResource{}, user, false, false, store}
 	// Check if the user is a manager.
-	err := db.QueryRow("SELECT is_manager FROM users WHERE name=$1", user).Scan(&p.is_manager)
+	var err error
+	p.is_manager, err = store.isManager(user)
 	if err != nil {
 		return nil, err
 	}
@@ -258,12 +298,18 @@ func newProjectList(user string, db *sql.DB) (resource, error) {
 type projectResource struct {
 	resource
 	pid   uint
-	db    *sql.DB
+	store Store
 	user  string
-	owns  bool
-	views bool
+	role  role
+	scope string // What DELETE applies to; see delete.
 }
 
+// Deletion scopes, given as "?scope=" when deleting a project.
+const (
+	scopeSelf     = "self"
+	scopeEveryone = "everyone"
+)
+
 type project struct {
 	Id          uint
 	Name        string
@@ -272,110 +318,165 @@ type project struct {
 	Updated     string
 	Version     uint
 	Owns        bool
+	Role        role `json:",omitempty"` // The role of the current user.
+	// TreeVersion changes whenever anything in the project changes.
+	TreeVersion uint
+}
+
+// treeVersion is sent for each project when listing projects with
+// "?versions=1", letting clients skip projects which have not changed.
+type treeVersion struct {
+	Id          uint
+	TreeVersion uint
 }
 
-// valid returns true if the given project looks like it should fit in the
-// database with no errors.
-// FIXME: Validate any dates.
-func (p project) valid() bool {
-	return (p.Percentage <= 100) &&
-		(len(p.Name) < dbNameLen) && (len(p.Name) > 0) &&
-		(len(p.Description) < dbDescLen) &&
-		(len(p.Updated) != 0)
+// validate checks that the given project looks like it should fit in the
+// database with no errors, returning an error listing any invalid fields.
+// Updated is set by the server, so is not checked.
+func (p *project) validate() error {
+	v := validator{}
+	v.length("Name", p.Name, 1, dbNameLen)
+	v.percentage("Percentage", p.Percentage)
+	v.length("Description", p.Description, 0, dbDescLen)
+	return v.err()
 }
 
 func (p *projectResource) forbidden() int {
-	if p.owns {
-		return 0
-	} else if p.views {
-		return set
+	forbidden := forbiddenFor(p.role, projectKind)
+	if p.role != roleOwner && p.scope == scopeEveryone {
+		// Only owners can delete the project for everyone.
+		forbidden |= delete
 	}
-	return get | set | delete
+	return forbidden
+}
+
+// treeVersion returns the current tree version of the project.
+func (p *projectResource) treeVersion() (uint, error) {
+	project, err := p.store.project(p.pid)
+	return project.TreeVersion, err
+}
+
+// setRole fills in the fields describing the current user's role.
+func (p *projectResource) setRole(project *project) {
+	project.Owns = (p.role == roleOwner)
+	project.Role = p.role
 }
 
 func (p *projectResource) get(enc encoder) error {
-	name, percentage, description, updated, version := "", 0, "", "", 0
-	err := p.db.QueryRow("SELECT name, percentage, description, updated, version FROM projects WHERE id=$1", p.pid).
-		Scan(&name, &percentage, &description, &updated, &version)
+	project, err := p.store.project(p.pid)
 	if err != nil {
 		return err
 	}
-	project := project{p.pid, name, uint(percentage), description, updated, uint(version), p.owns}
+	p.setRole(&project)
 	return enc.Encode(project)
 }
 
-// set the project state on the server.
-// We override any existing state as I have not implemented any kind
-// of synchronisation.
-// FIXME: Add synchronisation.
-func (p *projectResource) set(dec decoder) error {
-	project := project{}
-	err := dec.Decode(&project)
-	if err != nil || !project.valid() || project.Id != p.pid {
-		return invalidBody
+// set merges the uploaded project state with the server state, and responds
+// with the result; see merge.
+func (p *projectResource) set(dec decoder, enc encoder) error {
+	update := project{}
+	err := dec.Decode(&update)
+	if err != nil {
+		return badJSON(err)
+	}
+	err = update.validate()
+	if err != nil {
+		return err
+	} else if update.Id != p.pid {
+		return badBody("Id does not match the project",
+			fieldError{"Id", "Does not match the project"})
 	}
-	_, err = p.db.Exec("UPDATE projects SET name=$1, percentage=$2, description=$3, updated=$4 WHERE id=$5",
-		project.Name, project.Percentage, project.Description, project.Updated, p.pid)
-	return err
-}
 
-// delete the given project from the current user.
-// This should remove the current user from the project.
-// If there are no managers left for the given project, delete it, any
-// deliverables, and any viewing relations involving it.
-func (p *projectResource) delete() error {
-	var err error = nil
-	if !p.owns {
-		// Not an owner.
-		_, err = p.db.Exec("DELETE FROM views WHERE name=$1 and pid=$2",
-			p.user, p.pid)
-	} else {
-		// Project owner.
-		_, err = p.db.Exec("DELETE FROM owns WHERE name=$1 and pid=$2",
-			p.user, p.pid)
+	for attempt := 0; attempt < maxMergeAttempts; attempt++ {
+		cur, err := p.store.project(p.pid)
+		if err != nil {
+			return err
+		}
+		// Reject invalid versions.
+		if update.Version > cur.Version {
+			return newerVersion(cur.Version)
+		}
+		versions, err := p.store.projectVersions(p.pid)
 		if err != nil {
 			return err
 		}
-		// Check for other managers.
-		dbpid := 0
-		err = p.db.QueryRow("SELECT pid FROM owns WHERE name=$1 and pid=$2",
-			p.user, p.pid).Scan(&dbpid)
-		if err == sql.ErrNoRows {
-			// Remove any viewers.
-			_, err = p.db.Exec("DELETE FROM views WHERE pid=$1", p.pid)
+
+		old := cur.Version
+		kept, changed := merge(&cur, &update, projectFields, versions,
+			update.Version, old+1)
+		if changed {
+			cur.Version = old + 1
+			cur.Updated = formatDate(time.Now())
+			updated, err := p.store.updateProject(cur, old, versions)
 			if err != nil {
 				return err
+			} else if !updated {
+				// Somebody else got in first; merge with their changes.
+				continue
 			}
-			// Remove any deliverables.
-			_, err = p.db.Exec("DELETE FROM deliverables WHERE pid=$1", p.pid)
+			// The tree version is bumped when saving.
+			cur.TreeVersion, err = p.treeVersion()
 			if err != nil {
 				return err
 			}
-			// Remove the project.
-			_, err = p.db.Exec("DELETE FROM projects WHERE id=$1", p.pid)
 		}
+		p.setRole(&cur)
+		return enc.Encode(mergedProject{cur, mergeResult{kept}})
+	}
+	return fmt.Errorf("Failed to merge project %d after %d attempts\n",
+		p.pid, maxMergeAttempts)
+}
+
+func (p *projectResource) patchable() []string {
+	return append([]string{"Version"}, projectFields...)
+}
+
+// delete the given project.
+// With scopeSelf (the default) this removes the current user from the
+// project; if there are no owners left, the project is deleted, along with
+// any deliverables and viewing relations involving it.
+// With scopeEveryone the project is deleted regardless.
+func (p *projectResource) delete() error {
+	switch p.scope {
+	case scopeSelf:
+	case scopeEveryone:
+		return p.deleteProject()
+	default:
+		return badBody(fmt.Sprintf("Unknown scope %q", p.scope))
+	}
+
+	err := removeMember(p.user, p.pid, p.store)
+	if err == lastOwner {
+		// Nobody would be left to manage the project.
+		return p.deleteProject()
 	}
 	return err
 }
 
-func newProject(user string, pid uint, db *sql.DB) (*projectResource, error) {
-	p := projectResource{defaultResource{}, pid, db, user, false, false}
+// deleteProject deletes the project for everyone, after queueing the event
+// for any webhooks.
+func (p *projectResource) deleteProject() error {
+	project, err := p.store.project(p.pid)
+	if err != nil {
+		return err
+	}
+	err = queueWebhooks(p.store, webhookEvent{eventProjectDeleted, p.pid,
+		p.user, project})
+	if err != nil {
+		return err
+	}
+	return p.store.deleteProject(p.pid)
+}
+
+func newProject(user string, pid uint, store Store) (*projectResource, error) {
+	p := projectResource{defaultResource{}, pid, store, user, roleNone, scopeSelf}
 
 	// Find the user.
-	dbpid := 0
-	for _, table := range []string{"views", "owns"} {
-		err := db.QueryRow(fmt.Sprintf("SELECT pid FROM %s WHERE name=$1 and pid=$2", table), user, pid).Scan(&dbpid)
-		if err == nil {
-			if table == "owns" {
-				p.owns = true
-			} else {
-				p.views = true
-			}
-		} else if err != sql.ErrNoRows {
-			return nil, err
-		}
+	var err error
+	p.role, err = roleOf(user, pid, store)
+	if err != nil {
+		return nil, err
 	}
-
 	return &p, nil
 }
 
@@ -383,7 +484,7 @@ type flagResource struct {
 	resource
 	pid     uint
 	project *projectResource
-	db      *sql.DB
+	store   Store
 }
 
 type flag struct {
@@ -392,127 +493,127 @@ type flag struct {
 }
 
 func (f *flagResource) forbidden() int {
-	// Everyone in the project can read and write to the flag.
-	if f.project.owns || f.project.views {
-		return 0
-	}
-	return get | set
+	return forbiddenFor(f.project.role, flagKind)
 }
 
 func (f *flagResource) get(enc encoder) error {
-	flag := flag{0, false}
-	err := f.db.QueryRow("SELECT flag, flag_version FROM projects WHERE id=$1", f.pid).Scan(&(flag.Value), &(flag.Version))
+	flag, err := f.store.flag(f.pid)
 	if err != nil {
 		return err
 	}
 	return enc.Encode(flag)
 }
 
-func (f *flagResource) set(dec decoder) error {
+func (f *flagResource) set(dec decoder, enc encoder) error {
 	// Decode the uploaded flag.
 	update := flag{0, false}
 	err := dec.Decode(&update)
 	if err != nil {
-		return invalidBody
+		return badJSON(err)
 	}
 
 	// get the saved flag.
-	cur := flag{0, false}
-	err = f.db.QueryRow("SELECT flag, flag_version FROM projects WHERE id=$1", f.pid).Scan(&(cur.Value), &(cur.Version))
+	cur, err := f.store.flag(f.pid)
 	if err != nil {
 		return err
 	}
 
 	// Reject invalid versions.
 	if update.Version > cur.Version {
-		return invalidBody
+		return newerVersion(cur.Version)
 	}
 
 	// Compare and sync.
 	// If the version from the client is equal to the version on the server,
 	// use the value from the client and increment the server version.
 	// Otherwise, just use the server version.
+	// The swap only succeeds if nobody else has changed the flag since we
+	// read it; if somebody has, their newer version wins.
 	if update.Version == cur.Version && update.Value != cur.Value {
-		_, err = f.db.Exec("UPDATE projects SET flag=$1, flag_version=$2 WHERE id=$3",
-			update.Value, update.Version+1, f.pid)
-		return err
+		new := flag{update.Version + 1, update.Value}
+		swapped, err := f.store.swapFlag(f.pid, cur, new)
+		if err != nil || !swapped {
+			return err
+		}
+		return queueWebhooks(f.store, webhookEvent{eventFlagChanged, f.pid,
+			f.project.user, new})
 	}
 	return nil
 }
 
-func newFlag(user string, pid uint, db *sql.DB) (resource, error) {
-	proj, err := newProject(user, pid, db)
-	return &flagResource{defaultResource{}, pid, proj, db}, err
+func (f *flagResource) patchable() []string {
+	return []string{"Version", "Value"}
+}
+
+func newFlag(user string, pid uint, store Store) (resource, error) {
+	proj, err := newProject(user, pid, store)
+	return &flagResource{defaultResource{}, pid, proj, store}, err
 }
 
 type clientList struct {
 	resource
 	pid     uint
 	project *projectResource
-	db      *sql.DB
+	store   Store
 }
 
 func (c *clientList) forbidden() int {
-	if c.project.owns {
-		return 0
-	}
-	return get | create
+	return forbiddenFor(c.project.role, clientListKind)
 }
 
+// get for clientList lists the members of the project, sorted by name.
 func (c *clientList) get(enc encoder) error {
-	rows, err := c.db.Query("SELECT name FROM views WHERE pid=$1", c.pid)
+	members, err := c.store.members(c.pid)
 	if err != nil {
 		return err
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		name := ""
-		err = rows.Scan(&name)
-		if err != nil {
-			return err
-		}
-		err = enc.Encode(base32.StdEncoding.EncodeToString([]byte(name)))
+	for _, m := range members {
+		err = enc.Encode(base32.StdEncoding.EncodeToString([]byte(m.Name)))
 		if err != nil {
 			return err
 		}
 	}
-	return rows.Err()
+	return nil
 }
 
 func (c *clientList) create(dec decoder, success func(string, interface{}) error) error {
 	client := client{}
 	err := dec.Decode(&client)
 	if err != nil {
-		return invalidBody
+		return badJSON(err)
 	}
 
 	// Check if the user exists. This is strictly not required, but lets us
 	// warn the user if the user made a typo.
-	dbuser := ""
-	err = c.db.QueryRow("SELECT name FROM users WHERE name=$1", client.Name).
-		Scan(&dbuser)
-	if err == sql.ErrNoRows {
-		return invalidBody
+	_, err = c.store.isManager(client.Name)
+	if err == notFound {
+		return badBody(fmt.Sprintf("No such user %q", client.Name),
+			fieldError{"Name", "No such user"})
 	} else if err != nil {
 		return err
 	}
 
-	_, err = c.db.Exec("INSERT INTO views VALUES ($1, $2)", client.Name, c.pid)
+	r, ok := client.role()
+	if !ok {
+		return unknownRole(client.Role)
+	}
+
+	// Adding an existing member changes their role.
+	err = setRole(client.Name, c.pid, r, c.project.user, c.store)
 	if err != nil {
 		return err
 	}
-
-	// Populate the Id field; this will be accessed through a base32 encoding
-	// of the Name field.
-	client.Id = base32.StdEncoding.EncodeToString([]byte(client.Name))
-
+	m, err := c.store.member(client.Name, c.pid)
+	if err != nil {
+		return err
+	}
+	client = newClientInfo(m)
 	return success(fmt.Sprintf("/projects/%d/clients/%s", c.pid, client.Id), client)
 }
 
-func newClientList(user string, pid uint, db *sql.DB) (resource, error) {
-	proj, err := newProject(user, pid, db)
-	return &clientList{defaultResource{}, pid, proj, db}, err
+func newClientList(user string, pid uint, store Store) (resource, error) {
+	proj, err := newProject(user, pid, store)
+	return &clientList{defaultResource{}, pid, proj, store}, err
 }
 
 type clientResource struct {
@@ -521,96 +622,150 @@ type clientResource struct {
 	name    string
 	pid     uint
 	project *projectResource
-	db      *sql.DB
+	store   Store
 }
 
 type client struct {
 	Id        string // base32 encoded Name
 	Name      string
-	IsManager bool // TODO: Support adding/removing managers through this.
+	Role      role
+	IsManager bool // True for owners; Role takes precedence if given.
+	AddedBy   string
+	AddedAt   time.Time
 }
 
-func (c *clientResource) forbidden() int {
-	if c.project.owns {
-		return 0
+// newClientInfo returns the client corresponding to the given member.
+func newClientInfo(m member) client {
+	return client{
+		Id:        base32.StdEncoding.EncodeToString([]byte(m.Name)),
+		Name:      m.Name,
+		Role:      m.Role,
+		IsManager: m.Role == roleOwner,
+		AddedBy:   m.AddedBy,
+		AddedAt:   m.AddedAt,
 	}
-	return get | delete
+}
+
+// role returns the role requested by an uploaded client.
+// Older clients only send IsManager, so that is used if no role is given.
+func (c client) role() (role, bool) {
+	if c.Role != roleNone {
+		return c.Role, c.Role.valid()
+	} else if c.IsManager {
+		return roleOwner, true
+	}
+	return roleViewer, true
+}
+
+func (c *clientResource) forbidden() int {
+	return forbiddenFor(c.project.role, clientKind)
 }
 
 func (c *clientResource) get(enc encoder) error {
-	client := client{}
-	client.Id = c.id
-	client.Name = c.name
-	client.IsManager = false // We don't support sending this information.
-	return enc.Encode(client)
+	m, err := c.store.member(c.name, c.pid)
+	if err != nil {
+		return err
+	}
+	return enc.Encode(newClientInfo(m))
+}
+
+// set for clientResource changes the role of the client.
+func (c *clientResource) set(dec decoder, enc encoder) error {
+	update := client{}
+	err := dec.Decode(&update)
+	if err != nil {
+		return badJSON(err)
+	}
+	r, ok := update.role()
+	if !ok {
+		return unknownRole(update.Role)
+	}
+	err = setRole(c.name, c.pid, r, c.project.user, c.store)
+	if err != nil {
+		return err
+	}
+	return c.get(enc)
 }
 
 func (c *clientResource) delete() error {
-	_, err := c.db.Exec("DELETE FROM views WHERE name=$1 and pid=$2", c.name, c.pid)
-	return err
+	return removeMember(c.name, c.pid, c.store)
 }
 
-func newClient(user, id, name string, pid uint, db *sql.DB) (resource, error) {
-	proj, err := newProject(user, pid, db)
-	return &clientResource{defaultResource{}, id, name, pid, proj, db}, err
+func newClient(user, id, name string, pid uint, store Store) (resource, error) {
+	proj, err := newProject(user, pid, store)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check that the client is actually part of the project.
+	_, err = store.member(name, pid)
+	if err == notFound {
+		return nil, invalidResource
+	} else if err != nil {
+		return nil, err
+	}
+	return &clientResource{defaultResource{}, id, name, pid, proj, store}, nil
 }
 
 type deliverableList struct {
 	resource
 	pid     uint
 	project *projectResource
-	db      *sql.DB
+	store   Store
 }
 
 func (l *deliverableList) forbidden() int {
-	if l.project.owns {
-		return 0
-	} else if l.project.views {
-		return create
-	}
-	return get | create
+	return forbiddenFor(l.project.role, deliverableListKind)
 }
 
 func (l *deliverableList) get(enc encoder) error {
-	rows, err := l.db.Query("SELECT id FROM deliverables WHERE pid=$1", l.pid)
+	ids, err := l.store.deliverables(l.pid)
 	if err != nil {
 		return err
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		id := -1
-		err = rows.Scan(&id)
-		if err != nil {
-			return err
-		}
+	for _, id := range ids {
 		err = enc.Encode(id)
 		if err != nil {
 			return err
 		}
 	}
-	return rows.Err()
+	return nil
 }
 
 // create for deliverableList creates a new deliverable.
 func (l *deliverableList) create(dec decoder, success func(string, interface{}) error) error {
 	v := deliverable{}
 	err := dec.Decode(&v)
-	if err != nil || !v.valid() {
-		return invalidBody
+	if err != nil {
+		return badJSON(err)
 	}
-	v.Id = uint(rand.Int())
-	_, err = l.db.Exec("INSERT INTO deliverables VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)",
-		v.Id, l.pid, v.Name, v.Due, v.Percentage, v.Submitted, v.Description, v.Updated, 0)
+	err = v.validate()
+	if err != nil {
+		return err
+	}
+	// New deliverables are always drafts; see historyList.
+	v.State = stateDraft
+	v.Submitted = false
+	v.Version = 0
+	v.Updated = formatDate(time.Now())
+	v.Id, err = insertWithId(func(id uint) error {
+		v.Id = id
+		return l.store.addDeliverable(l.pid, v)
+	})
+	if err != nil {
+		return err
+	}
+	err = queueWebhooks(l.store, webhookEvent{eventDeliverableCreated, l.pid,
+		l.project.user, v})
 	if err != nil {
 		return err
 	}
 	return success(fmt.Sprintf("/projects/%d/deliverables/%d", l.pid, v.Id), v)
 }
 
-func newDeliverableList(user string, pid uint, db *sql.DB) (resource, error) {
-	proj, err := newProject(user, pid, db)
-	return &deliverableList{defaultResource{}, pid, proj, db}, err
+func newDeliverableList(user string, pid uint, store Store) (resource, error) {
+	proj, err := newProject(user, pid, store)
+	return &deliverableList{defaultResource{}, pid, proj, store}, err
 }
 
 type deliverableResource struct {
@@ -618,7 +773,7 @@ type deliverableResource struct {
 	id      uint
 	pid     uint
 	project *projectResource
-	db      *sql.DB
+	store   Store
 }
 
 type deliverable struct {
@@ -626,100 +781,176 @@ type deliverable struct {
 	Name        string
 	Due         string
 	Percentage  uint
-	Submitted   bool
+	State       deliverableState
+	Submitted   bool // Derived from State, for older clients.
 	Description string
 	Updated     string
 	Version     uint
 }
 
-// valid of deliverables returns true if the value will fit in the database and
-// is valid.
-// FIXME: Validate any dates.
-func (d deliverable) valid() bool {
-	return (d.Percentage <= 100) &&
-		(len(d.Name) < dbNameLen) && (len(d.Name) > 0) &&
-		(len(d.Description) < dbDescLen) && (len(d.Description) > 0) &&
-		(len(d.Updated) != 0) && (len(d.Due) != 0)
+// validate of deliverables checks that the value will fit in the database and
+// is valid, returning an error listing any invalid fields.
+// Due is normalised to the format sent to clients.
+func (d *deliverable) validate() error {
+	v := validator{}
+	v.length("Name", d.Name, 1, dbNameLen)
+	v.date("Due", &d.Due)
+	v.percentage("Percentage", d.Percentage)
+	v.length("Description", d.Description, 1, dbDescLen)
+	return v.err()
 }
 
 func (d *deliverableResource) forbidden() int {
-	if d.project.owns {
-		return 0
-	} else if d.project.views {
-		return set | delete
-	}
-	return get | set | delete
+	return forbiddenFor(d.project.role, deliverableKind)
 }
 
 func (d *deliverableResource) get(enc encoder) error {
-	v := deliverable{}
-	err := d.db.QueryRow("SELECT name, due, percentage, submitted, description, updated, version FROM deliverables WHERE id=$1 and pid=$2", d.id, d.pid).
-		Scan(&v.Name, &v.Due, &v.Percentage, &v.Submitted, &v.Description, &v.Updated, &v.Version)
+	v, err := d.store.deliverable(d.pid, d.id)
 	if err != nil {
 		return err
 	}
 	return enc.Encode(v)
 }
 
-func (d *deliverableResource) set(dec decoder) error {
-	v := deliverable{}
-	err := dec.Decode(&v)
-	if err != nil || !v.valid() {
-		return invalidBody
+// set merges the uploaded deliverable state with the server state, and
+// responds with the result; see merge.
+// Older clients submit drafts by setting Submitted, which is treated like
+// adding the transition to the history; otherwise, State and Submitted are
+// ignored.
+func (d *deliverableResource) set(dec decoder, enc encoder) error {
+	update := deliverable{}
+	err := dec.Decode(&update)
+	if err != nil {
+		return badJSON(err)
 	}
-	_, err = d.db.Exec("UPDATE deliverables SET name=$1, due=$2, percentage=$3, submitted=$4, description=$5, updated=$6 WHERE id=$7 and pid=$8",
-		v.Name, v.Due, v.Percentage, v.Submitted, v.Description, v.Updated, d.id, d.pid)
-	return err
+	err = update.validate()
+	if err != nil {
+		return err
+	}
+
+	for attempt := 0; attempt < maxMergeAttempts; attempt++ {
+		cur, err := d.store.deliverable(d.pid, d.id)
+		if err != nil {
+			return err
+		}
+		// Reject invalid versions.
+		if update.Version > cur.Version {
+			return newerVersion(cur.Version)
+		}
+		if update.Submitted && cur.State == stateDraft {
+			_, err = changeState(d, cur.State, stateSubmitted, "")
+			if err == invalidTransition {
+				// Somebody else changed the state first.
+				continue
+			} else if err != nil {
+				return err
+			}
+			cur, err = d.store.deliverable(d.pid, d.id)
+			if err != nil {
+				return err
+			}
+		}
+		versions, err := d.store.deliverableVersions(d.pid, d.id)
+		if err != nil {
+			return err
+		}
+
+		old := cur.Version
+		kept, changed := merge(&cur, &update, deliverableFields, versions,
+			update.Version, old+1)
+		if changed {
+			cur.Version = old + 1
+			cur.Updated = formatDate(time.Now())
+			updated, err := d.store.updateDeliverable(d.pid, cur, old, versions)
+			if err != nil {
+				return err
+			} else if !updated {
+				// Somebody else got in first; merge with their changes.
+				continue
+			}
+		}
+		return enc.Encode(mergedDeliverable{cur, mergeResult{kept}})
+	}
+	return fmt.Errorf("Failed to merge deliverable %d after %d attempts\n",
+		d.id, maxMergeAttempts)
+}
+
+func (d *deliverableResource) patchable() []string {
+	return append([]string{"Version"}, deliverableFields...)
 }
 
 func (d *deliverableResource) delete() error {
-	_, err := d.db.Exec("DELETE FROM deliverables WHERE id=$1 and pid=$2",
-		d.id, d.pid)
-	return err
+	return d.store.deleteDeliverable(d.pid, d.id)
 }
 
-func newDeliverable(user string, id uint, pid uint, db *sql.DB) (resource, error) {
-	proj, err := newProject(user, pid, db)
+func newDeliverable(user string, id uint, pid uint, store Store) (*deliverableResource, error) {
+	proj, err := newProject(user, pid, store)
 	if err != nil {
 		return nil, err
 	}
 
 	// Check that the deliverable actually exists.
-	dbpid := 0
-	err = db.QueryRow("SELECT pid FROM deliverables WHERE id=$1 and pid=$2", id, pid).Scan(&dbpid)
-	if err == sql.ErrNoRows {
+	_, err = store.deliverable(pid, id)
+	if err == notFound {
 		return nil, invalidResource
 	} else if err != nil {
 		return nil, err
 	}
-	return &deliverableResource{defaultResource{}, id, pid, proj, db}, nil
+	return &deliverableResource{defaultResource{}, id, pid, proj, store}, nil
+}
+
+// newerVersion returns the error for an update claiming to be based on a
+// version newer than the server's.
+func newerVersion(cur uint) error {
+	return badBody("Version is newer than the server version",
+		fieldError{"Version", fmt.Sprintf("Must be at most %d", cur)})
+}
+
+// unknownRole returns the error for an update with an unknown role.
+func unknownRole(r role) error {
+	return badBody(fmt.Sprintf("Unknown role %q", r),
+		fieldError{"Role", "Unknown role"})
 }
 
 // fromURI returns the defaultResource corresponding to the given URI.
-func fromURI(user, password, uri string, db *sql.DB) (resource, error) {
+// query holds the parsed query string; most resources ignore it.
+// c is the configuration of the handler serving the request.
+func fromURI(user, password, uri string, query url.Values, c config, store Store) (resource, error) {
 	// Match the path to the regular expressions.
 	if loginRe.MatchString(uri) {
-		return newLogin(user, password, db)
+		return newLogin(user, password, store)
 	} else if projectListRe.MatchString(uri) {
-		return newProjectList(user, db)
+		l, err := newProjectList(user, store)
+		if err != nil {
+			return nil, err
+		}
+		l.versions = (query.Get("versions") != "")
+		return l, nil
 	} else if projectRe.MatchString(uri) {
 		pid, err := strconv.Atoi(projectRe.FindStringSubmatch(uri)[1])
 		if err != nil {
 			return nil, invalidResource
 		}
-		return newProject(user, uint(pid), db)
+		p, err := newProject(user, uint(pid), store)
+		if err != nil {
+			return nil, err
+		}
+		if scope := query.Get("scope"); scope != "" {
+			p.scope = scope
+		}
+		return p, nil
 	} else if flagRe.MatchString(uri) {
 		pid, err := strconv.Atoi(flagRe.FindStringSubmatch(uri)[1])
 		if err != nil {
 			return nil, invalidResource
 		}
-		return newFlag(user, uint(pid), db)
+		return newFlag(user, uint(pid), store)
 	} else if clientListRe.MatchString(uri) {
 		pid, err := strconv.Atoi(clientListRe.FindStringSubmatch(uri)[1])
 		if err != nil {
 			return nil, invalidResource
 		}
-		return newClientList(user, uint(pid), db)
+		return newClientList(user, uint(pid), store)
 	} else if clientRe.MatchString(uri) {
 		pid, err := strconv.Atoi(clientRe.FindStringSubmatch(uri)[1])
 		if err != nil {
@@ -730,13 +961,13 @@ func fromURI(user, password, uri string, db *sql.DB) (resource, error) {
 		if err != nil {
 			return nil, invalidResource
 		}
-		return newClient(user, id, string(name), uint(pid), db)
+		return newClient(user, id, string(name), uint(pid), store)
 	} else if deliverableListRe.MatchString(uri) {
 		pid, err := strconv.Atoi(deliverableListRe.FindStringSubmatch(uri)[1])
 		if err != nil {
 			return nil, invalidResource
 		}
-		return newDeliverableList(user, uint(pid), db)
+		return newDeliverableList(user, uint(pid), store)
 	} else if deliverableRe.MatchString(uri) {
 		pid, err := strconv.Atoi(deliverableRe.FindStringSubmatch(uri)[1])
 		if err != nil {
@@ -746,16 +977,129 @@ func fromURI(user, password, uri string, db *sql.DB) (resource, error) {
 		if err != nil {
 			return nil, invalidResource
 		}
-		return newDeliverable(user, uint(id), uint(pid), db)
+		d, err := newDeliverable(user, uint(id), uint(pid), store)
+		if err != nil {
+			return nil, err
+		}
+		return d, nil
+	} else if historyListRe.MatchString(uri) {
+		match := historyListRe.FindStringSubmatch(uri)
+		pid, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, invalidResource
+		}
+		id, err := strconv.Atoi(match[2])
+		if err != nil {
+			return nil, invalidResource
+		}
+		return newHistoryList(user, uint(id), uint(pid), store)
+	} else if historyRe.MatchString(uri) {
+		match := historyRe.FindStringSubmatch(uri)
+		pid, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, invalidResource
+		}
+		did, err := strconv.Atoi(match[2])
+		if err != nil {
+			return nil, invalidResource
+		}
+		id, err := strconv.Atoi(match[3])
+		if err != nil {
+			return nil, invalidResource
+		}
+		return newHistory(user, uint(id), uint(did), uint(pid), store)
+	} else if commentListRe.MatchString(uri) {
+		pid, err := strconv.Atoi(commentListRe.FindStringSubmatch(uri)[1])
+		if err != nil {
+			return nil, invalidResource
+		}
+		return newCommentList(user, 0, uint(pid), store)
+	} else if commentRe.MatchString(uri) {
+		match := commentRe.FindStringSubmatch(uri)
+		pid, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, invalidResource
+		}
+		id, err := strconv.Atoi(match[2])
+		if err != nil {
+			return nil, invalidResource
+		}
+		return newComment(user, uint(id), 0, uint(pid), store)
+	} else if deliverableCommentsRe.MatchString(uri) {
+		match := deliverableCommentsRe.FindStringSubmatch(uri)
+		pid, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, invalidResource
+		}
+		did, err := strconv.Atoi(match[2])
+		if err != nil {
+			return nil, invalidResource
+		}
+		return newCommentList(user, uint(did), uint(pid), store)
+	} else if deliverableCommentRe.MatchString(uri) {
+		match := deliverableCommentRe.FindStringSubmatch(uri)
+		pid, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, invalidResource
+		}
+		did, err := strconv.Atoi(match[2])
+		if err != nil {
+			return nil, invalidResource
+		}
+		id, err := strconv.Atoi(match[3])
+		if err != nil {
+			return nil, invalidResource
+		}
+		return newComment(user, uint(id), uint(did), uint(pid), store)
+	} else if sessionListRe.MatchString(uri) {
+		return newSessionList(user, password, store)
+	} else if sessionRe.MatchString(uri) {
+		return newSession(user, sessionRe.FindStringSubmatch(uri)[1], store)
+	} else if feedRe.MatchString(uri) {
+		return newFeed(user, query.Get("since"), store)
+	} else if webhookListRe.MatchString(uri) {
+		return newWebhookList(user, 0, c, store)
+	} else if webhookRe.MatchString(uri) {
+		id, err := strconv.Atoi(webhookRe.FindStringSubmatch(uri)[1])
+		if err != nil {
+			return nil, invalidResource
+		}
+		return newWebhook(user, uint(id), 0, store)
+	} else if deliveryListRe.MatchString(uri) {
+		id, err := strconv.Atoi(deliveryListRe.FindStringSubmatch(uri)[1])
+		if err != nil {
+			return nil, invalidResource
+		}
+		return newDeliveryList(user, uint(id), 0, store)
+	} else if projectWebhookListRe.MatchString(uri) {
+		pid, err := strconv.Atoi(projectWebhookListRe.FindStringSubmatch(uri)[1])
+		if err != nil {
+			return nil, invalidResource
+		}
+		return newWebhookList(user, uint(pid), c, store)
+	} else if projectWebhookRe.MatchString(uri) {
+		pid, err := strconv.Atoi(projectWebhookRe.FindStringSubmatch(uri)[1])
+		if err != nil {
+			return nil, invalidResource
+		}
+		id, err := strconv.Atoi(projectWebhookRe.FindStringSubmatch(uri)[2])
+		if err != nil {
+			return nil, invalidResource
+		}
+		return newWebhook(user, uint(id), uint(pid), store)
+	} else if projectDeliveryListRe.MatchString(uri) {
+		pid, err := strconv.Atoi(projectDeliveryListRe.FindStringSubmatch(uri)[1])
+		if err != nil {
+			return nil, invalidResource
+		}
+		id, err := strconv.Atoi(projectDeliveryListRe.FindStringSubmatch(uri)[2])
+		if err != nil {
+			return nil, invalidResource
+		}
+		return newDeliveryList(user, uint(id), uint(pid), store)
 	} else {
 		return nil, invalidResource
 	}
 }
 
-// seed the PRNG.
-// This *must* be called before using fromURI.
-func seed() {
-	rand.Seed(time.Now().Unix())
-}
-
 // vim: sw=4 ts=4 noexpandtab
@@ -0,0 +1,186 @@
+/*
+Project membership roles and permissions.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package backend
+
+import (
+	"time"
+)
+
+// role is the role of a user within a project.
+type role string
+
+const (
+	roleNone      role = "" // Not a member.
+	roleOwner     role = "owner"
+	roleEditor    role = "editor"
+	roleCommenter role = "commenter"
+	roleViewer    role = "viewer"
+)
+
+// valid returns true for the roles that can be given to members.
+func (r role) valid() bool {
+	switch r {
+	case roleOwner, roleEditor, roleCommenter, roleViewer:
+		return true
+	}
+	return false
+}
+
+// member is a user's membership of a project.
+type member struct {
+	Name    string
+	Role    role
+	AddedBy string
+	AddedAt time.Time
+}
+
+// kind identifies the type of a project resource in the permission matrix.
+type kind int
+
+const (
+	projectKind kind = iota
+	flagKind
+	clientListKind
+	clientKind
+	deliverableListKind
+	deliverableKind
+	webhookListKind
+	webhookKind
+	submissionKind // Submitting and withdrawing deliverables.
+	reviewKind     // Reviewing, accepting and rejecting deliverables.
+	commentListKind
+	commentKind
+	numKinds
+)
+
+// all is every access type.
+const all = get | set | create | delete
+
+// permissions lists the access each role has to each kind of resource within
+// a project; anything not listed is forbidden.
+// Everybody can leave a project (by deleting it), read and write the flag,
+// and submit deliverables; only owners can review them.
+var permissions = map[role][numKinds]int{
+	roleOwner: {all, all, all, all, all, all, all, all, all, all, all, all},
+	roleEditor: {
+		projectKind:         get | set | delete,
+		flagKind:            get | set,
+		clientListKind:      get,
+		clientKind:          get,
+		deliverableListKind: get | create,
+		deliverableKind:     get | set | delete,
+		submissionKind:      create,
+		commentListKind:     get | create,
+		commentKind:         get | set | delete,
+	},
+	roleCommenter: {
+		projectKind:         get | delete,
+		flagKind:            get | set,
+		deliverableListKind: get,
+		deliverableKind:     get,
+		submissionKind:      create,
+		commentListKind:     get | create,
+		commentKind:         get | set | delete,
+	},
+	roleViewer: {
+		projectKind:         get | delete,
+		flagKind:            get | set,
+		deliverableListKind: get,
+		deliverableKind:     get,
+		submissionKind:      create,
+		commentListKind:     get,
+		commentKind:         get,
+	},
+}
+
+// forbiddenFor returns the access types the role is forbidden from using on
+// the given kind of resource.
+func forbiddenFor(r role, k kind) int {
+	return all &^ permissions[r][k]
+}
+
+// roleOf returns the role of the user in the project, or roleNone.
+func roleOf(user string, pid uint, store Store) (role, error) {
+	m, err := store.member(user, pid)
+	if err == notFound {
+		return roleNone, nil
+	}
+	return m.Role, err
+}
+
+// setRole gives the user the role in the project, adding them if they are
+// not already a member.
+// Demoting the only owner returns lastOwner, so ownership should be
+// transferred by promoting the new owner before demoting the old one.
+func setRole(user string, pid uint, r role, by string, store Store) error {
+	// Lock the project so that two owners demoting each other concurrently
+	// cannot leave the project without an owner.
+	err := store.lockProject(pid)
+	if err != nil {
+		return err
+	}
+	m, err := store.member(user, pid)
+	if err == notFound {
+		m = member{user, r, by, time.Now().UTC()}
+		err = store.addMember(pid, m)
+		if err != nil {
+			return err
+		}
+		return queueWebhooks(store, webhookEvent{eventClientAdded, pid, by,
+			newClientInfo(m)})
+	} else if err != nil {
+		return err
+	}
+	if m.Role == r {
+		return nil
+	}
+	if m.Role == roleOwner {
+		err = checkOtherOwners(user, pid, store)
+		if err != nil {
+			return err
+		}
+	}
+	return store.setRole(user, pid, r)
+}
+
+// removeMember removes the user from the project, returning lastOwner if
+// they are the only owner.
+func removeMember(user string, pid uint, store Store) error {
+	err := store.lockProject(pid)
+	if err != nil {
+		return err
+	}
+	r, err := roleOf(user, pid, store)
+	if err != nil {
+		return err
+	}
+	if r == roleOwner {
+		err = checkOtherOwners(user, pid, store)
+		if err != nil {
+			return err
+		}
+	}
+	return store.removeMember(user, pid)
+}
+
+// checkOtherOwners returns lastOwner if the user is the only owner of the
+// project.
+func checkOtherOwners(user string, pid uint, store Store) error {
+	members, err := store.members(pid)
+	if err != nil {
+		return err
+	}
+	for _, m := range members {
+		if m.Role == roleOwner && m.Name != user {
+			return nil
+		}
+	}
+	return lastOwner
+}
+
+// vim: sw=4 ts=4 noexpandtab
@@ -0,0 +1,220 @@
+/*
+HTTP server setup.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package backend
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Option configures a handler or server.
+// Options which only make sense for a Server are ignored by NewHandler.
+type Option func(*config)
+
+type config struct {
+	maxBodySize     int64
+	readTimeout     time.Duration
+	writeTimeout    time.Duration
+	idleTimeout     time.Duration
+	shutdownTimeout time.Duration
+	// webhookRetryDelay is the delay before the first retry of a failed
+	// webhook delivery; see sendDelivery.
+	webhookRetryDelay time.Duration
+	// privateWebhooks allows webhooks to private addresses; see
+	// WithPrivateWebhooks.
+	privateWebhooks bool
+	certFile        string
+	keyFile         string
+	tlsConfig       *tls.Config
+}
+
+func newConfig(opts []Option) config {
+	c := config{
+		maxBodySize:       1 << 20,
+		readTimeout:       30 * time.Second,
+		writeTimeout:      30 * time.Second,
+		idleTimeout:       2 * time.Minute,
+		shutdownTimeout:   30 * time.Second,
+		webhookRetryDelay: time.Minute,
+	}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+// WithMaxBodySize limits the size of request bodies.
+// The default is 1 MiB.
+func WithMaxBodySize(size int64) Option {
+	return func(c *config) { c.maxBodySize = size }
+}
+
+// WithTimeouts sets the server read, write, and idle timeouts.
+// A zero duration disables that timeout.
+func WithTimeouts(read, write, idle time.Duration) Option {
+	return func(c *config) {
+		c.readTimeout = read
+		c.writeTimeout = write
+		c.idleTimeout = idle
+	}
+}
+
+// WithShutdownTimeout sets how long the server waits for outstanding requests
+// when shutting down.
+func WithShutdownTimeout(timeout time.Duration) Option {
+	return func(c *config) { c.shutdownTimeout = timeout }
+}
+
+// WithWebhookRetryDelay sets how long to wait before retrying a failed
+// webhook delivery; the delay doubles after each attempt.
+// The default is one minute.
+func WithWebhookRetryDelay(delay time.Duration) Option {
+	return func(c *config) { c.webhookRetryDelay = delay }
+}
+
+// WithPrivateWebhooks allows webhooks to be registered for and delivered to
+// loopback, link-local, and private addresses.
+// These are rejected by default, so that webhooks can't be used to reach
+// services on the server's own network.
+func WithPrivateWebhooks() Option {
+	return func(c *config) { c.privateWebhooks = true }
+}
+
+// WithTLSCertificate serves HTTPS using the given certificate and key files.
+func WithTLSCertificate(certFile, keyFile string) Option {
+	return func(c *config) {
+		c.certFile = certFile
+		c.keyFile = keyFile
+	}
+}
+
+// WithTLSConfig serves HTTPS using the given TLS configuration.
+// Any certificate from WithTLSCertificate is added to the configuration.
+func WithTLSConfig(tlsConfig *tls.Config) Option {
+	return func(c *config) { c.tlsConfig = tlsConfig }
+}
+
+// handler serves the API.
+type handler struct {
+	store  Store
+	config config
+}
+
+// NewHandler returns a http.Handler serving the API using the given store.
+// The handler may be mounted under a prefix with http.StripPrefix.
+func NewHandler(store Store, opts ...Option) http.Handler {
+	return &handler{store, newConfig(opts)}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.config.maxBodySize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, h.config.maxBodySize)
+	}
+	handle(w, r, h.config, h.store)
+}
+
+// Server runs the API over HTTP or HTTPS.
+type Server struct {
+	config config
+	server *http.Server
+	store  Store
+}
+
+// NewServer returns a server listening on the given address (for example
+// ":8080") and using the given store.
+// Any TLS certificates are loaded immediately, so configuration errors are
+// reported here rather than when serving.
+func NewServer(addr string, store Store, opts ...Option) (*Server, error) {
+	c := newConfig(opts)
+	s := &Server{c, &http.Server{
+		Addr:         addr,
+		Handler:      NewHandler(store, opts...),
+		ReadTimeout:  c.readTimeout,
+		WriteTimeout: c.writeTimeout,
+		IdleTimeout:  c.idleTimeout,
+	}, store}
+
+	if c.certFile != "" || c.tlsConfig != nil {
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+		if c.tlsConfig != nil {
+			tlsConfig = c.tlsConfig.Clone()
+		}
+		if c.certFile != "" {
+			cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
+		}
+		s.server.TLSConfig = tlsConfig
+	}
+	return s, nil
+}
+
+// Handler returns the handler used by the server.
+func (s *Server) Handler() http.Handler {
+	return s.server.Handler
+}
+
+// ListenAndServe listens on the server address and serves requests until ctx
+// is cancelled, at which point the server is shut down gracefully.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	l, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ctx, l)
+}
+
+// Serve serves requests on the given listener until ctx is cancelled, at
+// which point the server is shut down gracefully.
+// Webhooks are delivered while serving; see DB.DeliverWebhooks.
+// It returns nil after a graceful shutdown.
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	if s.server.TLSConfig != nil {
+		l = tls.NewListener(l, s.server.TLSConfig)
+	}
+	// Requests see ctx being cancelled, so that long running requests such
+	// as event streams finish when shutting down.
+	s.server.BaseContext = func(net.Listener) context.Context { return ctx }
+
+	done := make(chan error, 1)
+	go func() { done <- s.server.Serve(l) }()
+	go deliverWebhooks(ctx, s.store, s.config)
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("Shutting down\n")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.config.shutdownTimeout)
+	defer cancel()
+	err := s.server.Shutdown(shutdownCtx)
+	if serveErr := <-done; serveErr != http.ErrServerClosed {
+		return serveErr
+	}
+	return err
+}
+
+// Run the server on the given port, using the given store.
+func Run(port string, store Store) {
+	log.Printf("Running on port :%s\n", port)
+	s, err := NewServer(":"+port, store)
+	if err == nil {
+		err = s.ListenAndServe(context.Background())
+	}
+	log.Fatal(err)
+}
+
+// vim: sw=4 ts=4 noexpandtab
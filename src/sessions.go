@@ -0,0 +1,206 @@
+/*
+Session (bearer token) handling.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package backend
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	sessionIdSize    = 10
+	sessionTokenSize = 32
+)
+
+// Session lifetimes.
+// A session expires after sessionLifetime, or after sessionIdleTimeout
+// without being used, whichever comes first.
+var (
+	sessionLifetime    = 30 * 24 * time.Hour
+	sessionIdleTimeout = 7 * 24 * time.Hour
+)
+
+// sessionEnded is returned by event streams and WebSockets opened with a
+// session token once that session is revoked or expires.
+var sessionEnded = fmt.Errorf("Session ended\n")
+
+type session struct {
+	Id       string
+	Token    string `json:",omitempty"` // Only sent when first created.
+	Created  time.Time
+	LastUsed time.Time
+	Expires  time.Time
+}
+
+// hashToken returns the hash of the given token, as stored in the database.
+// Only the hash is stored so that a stolen database cannot be used to
+// impersonate users.
+func hashToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
+
+// bearerToken returns the bearer token in the given request, if any.
+func bearerToken(request *http.Request) (token string, ok bool) {
+	auth := request.Header.Get("Authorization")
+	if len(auth) < len("Bearer ") || !strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(auth[len("Bearer "):]), true
+}
+
+// authenticateToken returns the user owning the given session token.
+// ok is false if the token is unknown, expired, or has been idle too long.
+// Successful lookups update the idle timer.
+func authenticateToken(token string, store Store) (user string, ok bool, err error) {
+	now := time.Now().UTC()
+	id, user, err := store.findSession(hashToken(token), now, now.Add(-sessionIdleTimeout))
+	if err == notFound {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	err = store.touchSession(id, now)
+	if err != nil {
+		return "", false, err
+	}
+	return user, true, nil
+}
+
+// checkSession returns sessionEnded unless the session with the given token
+// hash is still active.
+// Unlike authenticateToken, the idle timer is left alone.
+func checkSession(hash []byte, store Store) error {
+	now := time.Now().UTC()
+	_, _, err := store.findSession(hash, now, now.Add(-sessionIdleTimeout))
+	if err == notFound {
+		return sessionEnded
+	}
+	return err
+}
+
+type sessionList struct {
+	resource
+	user     string
+	password string // Empty if authenticated with a session token.
+	store    Store
+}
+
+// forbidden for sessionList only allows starting a session with the password,
+// so that sessions can't be renewed forever with a token.
+func (l *sessionList) forbidden() int {
+	if l.password == "" {
+		return set | create | delete
+	}
+	return set | delete
+}
+
+// get for sessionList lists the active sessions for the user.
+func (l *sessionList) get(enc encoder) error {
+	now := time.Now().UTC()
+	sessions, err := l.store.sessions(l.user, now, now.Add(-sessionIdleTimeout))
+	if err != nil {
+		return err
+	}
+	for _, s := range sessions {
+		err = enc.Encode(s)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// create for sessionList starts a new session.
+// The token is only ever returned here; the server does not keep a copy.
+func (l *sessionList) create(dec decoder, success func(string, interface{}) error) error {
+	id := make([]byte, sessionIdSize)
+	_, err := rand.Read(id)
+	if err != nil {
+		return err
+	}
+	token := make([]byte, sessionTokenSize)
+	_, err = rand.Read(token)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	s := session{
+		Id:       base32.StdEncoding.EncodeToString(id),
+		Token:    base64.RawURLEncoding.EncodeToString(token),
+		Created:  now,
+		LastUsed: now,
+		Expires:  now.Add(sessionLifetime),
+	}
+
+	// Clear out any stale sessions while we are here.
+	err = l.store.deleteStaleSessions(l.user, now, now.Add(-sessionIdleTimeout))
+	if err != nil {
+		return err
+	}
+	err = l.store.addSession(l.user, s, hashToken(s.Token))
+	if err != nil {
+		return err
+	}
+	return success(fmt.Sprintf("/sessions/%s", s.Id), s)
+}
+
+func newSessionList(user, password string, store Store) (resource, error) {
+	return &sessionList{defaultResource{}, user, password, store}, nil
+}
+
+type sessionResource struct {
+	resource
+	id    string
+	user  string
+	owns  bool
+	store Store
+}
+
+func (s *sessionResource) forbidden() int {
+	if s.owns {
+		return set | create
+	}
+	return get | set | create | delete
+}
+
+func (s *sessionResource) get(enc encoder) error {
+	now := time.Now().UTC()
+	v, _, err := s.store.session(s.id, now, now.Add(-sessionIdleTimeout))
+	if err != nil {
+		return err
+	}
+	return enc.Encode(v)
+}
+
+// delete for sessionResource revokes the session.
+func (s *sessionResource) delete() error {
+	return s.store.deleteSession(s.id)
+}
+
+func newSession(user, id string, store Store) (resource, error) {
+	s := sessionResource{defaultResource{}, id, user, false, store}
+	now := time.Now().UTC()
+	_, name, err := store.session(id, now, now.Add(-sessionIdleTimeout))
+	if err == notFound {
+		return nil, invalidResource
+	} else if err != nil {
+		return nil, err
+	}
+	s.owns = (name == user)
+	return &s, nil
+}
+
+// vim: sw=4 ts=4 noexpandtab
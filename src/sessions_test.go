@@ -0,0 +1,54 @@
+/*
+Tests for session handling.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStaleSessionsHidden(t *testing.T) {
+	store := newTestStore(t)
+	err := NewDB(store).AddUser("user", "password", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	for _, s := range []session{
+		{Id: "active", Created: now, LastUsed: now, Expires: now.Add(time.Hour)},
+		{Id: "expired", Created: now.Add(-2 * time.Hour), LastUsed: now,
+			Expires: now.Add(-time.Hour)},
+		{Id: "idle", Created: now.Add(-sessionIdleTimeout - time.Hour),
+			LastUsed: now.Add(-sessionIdleTimeout - time.Hour),
+			Expires:  now.Add(time.Hour)},
+	} {
+		err = store.addSession("user", s, hashToken(s.Id))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = newSession("user", "active", store)
+	if err != nil {
+		t.Fatalf("Expected the active session, got %q", err)
+	}
+	for _, id := range []string{"expired", "idle"} {
+		_, err = newSession("user", id, store)
+		if err != invalidResource {
+			t.Fatalf("Expected %s to be hidden, got %v", id, err)
+		}
+	}
+	sessions, err := store.sessions("user", now, now.Add(-sessionIdleTimeout))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(sessions) != 1 || sessions[0].Id != "active" {
+		t.Fatalf("Expected only the active session, got %+v", sessions)
+	}
+}
+
+// vim: sw=4 ts=4 noexpandtab
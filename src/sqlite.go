@@ -0,0 +1,40 @@
+/*
+SQLite storage.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package backend
+
+import (
+	"database/sql"
+)
+
+var sqlite = &dialect{
+	name: "sqlite",
+	// SQLite supports numbered ?NNN placeholders.
+	rebind: func(query string) string {
+		return placeholderRe.ReplaceAllString(query, "?$1")
+	},
+	versionTable: `CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		applied TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`,
+	// SQLite locks the whole database on write, and only one connection is
+	// used, so no row locks are needed.
+	forUpdate:   "",
+	lockChanges: "",
+}
+
+// NewSQLiteStore returns a Store using the given SQLite database.
+// The caller is responsible for importing a driver (such as
+// github.com/mattn/go-sqlite3).
+// SQLite only supports a single writer, so the connection pool is limited to
+// a single connection; this also keeps ":memory:" databases consistent.
+func NewSQLiteStore(db *sql.DB) Store {
+	db.SetMaxOpenConns(1)
+	return &sqlStore{db, nil, 0, sqlite, &notifier{}, nil}
+}
+
+// vim: sw=4 ts=4 noexpandtab
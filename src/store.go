@@ -0,0 +1,1142 @@
+/*
+Storage abstraction.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package backend
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// notFound is returned by Store lookups for missing items.
+var notFound error = fmt.Errorf("Not found\n")
+
+// Store abstracts the persistent storage used by the resources.
+// Use NewPostgresStore or NewSQLiteStore to create one.
+type Store interface {
+	// Users.
+	isManager(user string) (bool, error)
+	password(user string) (salt, key []byte, params passwordHash, err error)
+	addUser(user string, salt, key []byte, params passwordHash, isManager bool) error
+	setPassword(user string, salt, key []byte, params passwordHash) error
+	setIsManager(user string, isManager bool) error
+	deleteUser(user string) error
+
+	// Sessions.
+	// Sessions which have expired or have been idle since before idle are
+	// ignored.
+	findSession(token []byte, now, idle time.Time) (id, user string, err error)
+	touchSession(id string, now time.Time) error
+	// session returns the session with the given id, if it has not expired
+	// or been idle since idle.
+	session(id string, now, idle time.Time) (s session, user string, err error)
+	sessions(user string, now, idle time.Time) ([]session, error)
+	addSession(user string, s session, token []byte) error
+	deleteSession(id string) error
+	deleteStaleSessions(user string, now, idle time.Time) error
+	deleteSessions(user string) error
+
+	// Projects.
+	project(pid uint) (project, error)
+	// Inserts return duplicateId if the id is already in use.
+	addProject(p project) error
+	projectVersions(pid uint) (fieldVersions, error)
+	// Updates set the item and field versions if the item is currently at
+	// version old, and return false otherwise.
+	updateProject(p project, old uint, versions fieldVersions) (updated bool, err error)
+	deleteProject(pid uint) error
+	// lockProject blocks other transactions from locking the project until
+	// the current transaction finishes.
+	lockProject(pid uint) error
+	flag(pid uint) (flag, error)
+	// swapFlag sets the flag to new if it is currently old.
+	swapFlag(pid uint, old, new flag) (swapped bool, err error)
+
+	// Memberships.
+	// See permissions for what each role allows.
+	projects(user string) ([]uint, error)
+	// treeVersions returns the tree version of each of the user's projects.
+	treeVersions(user string) ([]treeVersion, error)
+	member(user string, pid uint) (member, error)
+	members(pid uint) ([]member, error)
+	addMember(pid uint, m member) error
+	setRole(user string, pid uint, r role) error
+	removeMember(user string, pid uint) error
+
+	// Deliverables.
+	deliverables(pid uint) ([]uint, error)
+	deliverable(pid, id uint) (deliverable, error)
+	addDeliverable(pid uint, d deliverable) error
+	deliverableVersions(pid, id uint) (fieldVersions, error)
+	updateDeliverable(pid uint, d deliverable, old uint, versions fieldVersions) (updated bool, err error)
+	deleteDeliverable(pid, id uint) error
+	// setDeliverableState moves the deliverable to the new state of the
+	// transition if it is currently in the old state, recording the
+	// transition in the history and bumping the version, and returns false
+	// otherwise.
+	setDeliverableState(pid, id uint, t transition) (updated bool, err error)
+	// deliverableHistory returns the transitions of the deliverable, oldest
+	// first.
+	deliverableHistory(pid, id uint) ([]transition, error)
+	transition(pid, did, id uint) (transition, error)
+
+	// Comments.
+	// Project comments have a zero did, and comments starting a thread have
+	// a zero Parent.
+	// comments returns the comments on the project or deliverable, oldest
+	// first.
+	comments(pid, did uint) ([]comment, error)
+	comment(pid, id uint) (comment, error)
+	addComment(pid uint, c comment) error
+	updateComment(pid uint, c comment) error
+	// deleteComment also removes the replies to the comment.
+	deleteComment(pid, id uint) error
+
+	// Webhooks.
+	// Project webhooks have a pid, while user webhooks have a zero pid and
+	// are used for every project the user is a member of.
+	webhook(id uint) (webhook, error)
+	projectWebhooks(pid uint) ([]webhook, error)
+	userWebhooks(user string) ([]webhook, error)
+	// memberWebhooks returns the user webhooks of the project's members.
+	memberWebhooks(pid uint) ([]webhook, error)
+	addWebhook(w webhook) error
+	// deleteWebhook also removes the webhook's deliveries.
+	deleteWebhook(id uint) error
+	deleteUserWebhooks(user string) error
+
+	// Webhook deliveries.
+	addDelivery(d delivery) error
+	// deliveries returns the latest deliveries for the webhook, newest
+	// first.
+	deliveries(hook uint, limit int) ([]delivery, error)
+	// dueDeliveries returns pending deliveries due by now, oldest first.
+	dueDeliveries(now time.Time, limit int) ([]delivery, error)
+	// nextDelivery returns when the next pending delivery is due.
+	nextDelivery() (time.Time, error)
+	// claimDelivery delays the delivery until the given time if it is still
+	// pending and due by now, and returns false otherwise, so that only one
+	// process sends each delivery.
+	claimDelivery(id uint, now, until time.Time) (claimed bool, err error)
+	updateDelivery(d delivery) error
+
+	// Changes.
+	// Every change to a project is recorded with an increasing sequence
+	// number, which is used as the cursor for the changes feed.
+	cursor() (uint, error)
+	// changes returns the changes with since < seq <= until in projects the
+	// user is a member of, changes to their own memberships, and deletions
+	// of projects they were removed from, ordered by seq.
+	changes(user string, since, until uint) ([]change, error)
+	// changed returns a channel which is closed the next time changes are
+	// committed through this store.
+	changed() <-chan struct{}
+
+	// Schema.
+	version() (int, error)
+	migrate(target int) error
+
+	// begin starts a transaction.
+	// Transactions may be nested; rolling back a nested transaction only
+	// discards the changes made since it began.
+	begin() (transaction, error)
+}
+
+// transaction is a Store whose changes are only saved once committed.
+// Rolling back a committed transaction does nothing, so rollback can safely
+// be deferred.
+type transaction interface {
+	Store
+	commit() error
+	rollback() error
+}
+
+// dialect captures the differences between the supported SQL databases.
+type dialect struct {
+	// name is also the name of the migrations directory.
+	name string
+	// rebind converts a query using $1 style placeholders into the native
+	// style.
+	rebind func(query string) string
+	// versionTable creates the schema_version table if it does not exist.
+	versionTable string
+	// forUpdate is appended to a SELECT to lock the selected rows until the
+	// end of the transaction.
+	forUpdate string
+	// lockChanges stops other transactions recording changes until the
+	// end of the transaction; see sqlTx.commit.
+	lockChanges string
+}
+
+var placeholderRe = regexp.MustCompile(`\$(\d+)`)
+
+// querier is the subset of sql.DB and sql.Tx used by sqlStore.
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// sqlStore implements Store on top of a SQL database.
+// Queries are written for PostgreSQL and rewritten as required for the
+// dialect.
+type sqlStore struct {
+	db       *sql.DB // nil within a transaction.
+	tx       *sql.Tx // nil outside a transaction.
+	depth    int     // Savepoint nesting depth within the transaction.
+	dialect  *dialect
+	notifier *notifier
+	pending  *[]change // Changes to record when the transaction commits.
+}
+
+func (s *sqlStore) querier() querier {
+	if s.tx != nil {
+		return s.tx
+	}
+	return s.db
+}
+
+func (s *sqlStore) exec(query string, args ...interface{}) (sql.Result, error) {
+	return s.querier().Exec(s.dialect.rebind(query), args...)
+}
+
+func (s *sqlStore) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return s.querier().Query(s.dialect.rebind(query), args...)
+}
+
+// queryRow runs a query expected to return a single row, and scans the
+// result into dest.
+func (s *sqlStore) queryRow(query string, args []interface{}, dest ...interface{}) error {
+	err := s.querier().QueryRow(s.dialect.rebind(query), args...).Scan(dest...)
+	if err == sql.ErrNoRows {
+		return notFound
+	}
+	return err
+}
+
+// queryIds runs a query returning a single id column.
+func (s *sqlStore) queryIds(query string, args ...interface{}) ([]uint, error) {
+	rows, err := s.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []uint{}
+	for rows.Next() {
+		var id uint = 0
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// begin starts a transaction, or a savepoint if already in a transaction.
+func (s *sqlStore) begin() (transaction, error) {
+	if s.tx == nil {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return nil, err
+		}
+		return &sqlTx{sqlStore{nil, tx, 0, s.dialect, s.notifier, new([]change)}, "", 0, false}, nil
+	}
+	savepoint := fmt.Sprintf("sp%d", s.depth+1)
+	_, err := s.tx.Exec("SAVEPOINT " + savepoint)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlTx{sqlStore{nil, s.tx, s.depth + 1, s.dialect, s.notifier, s.pending}, savepoint, len(*s.pending), false}, nil
+}
+
+// sqlTx is a transaction (or savepoint) on a sqlStore.
+type sqlTx struct {
+	sqlStore
+	savepoint string // Empty for the outermost transaction.
+	mark      int    // The number of pending changes at the savepoint.
+	done      bool
+}
+
+func (t *sqlTx) commit() error {
+	if t.done {
+		return fmt.Errorf("Transaction already finished\n")
+	}
+	t.done = true
+	if t.savepoint == "" {
+		// The changes are only written now, so that unrelated
+		// transactions only hold the changes lock while committing.
+		if len(*t.pending) > 0 {
+			err := t.writeChanges()
+			if err != nil {
+				t.tx.Rollback()
+				return err
+			}
+		}
+		err := t.tx.Commit()
+		if err == nil && len(*t.pending) > 0 {
+			t.notifier.notify()
+		}
+		return err
+	}
+	_, err := t.tx.Exec("RELEASE SAVEPOINT " + t.savepoint)
+	return err
+}
+
+func (t *sqlTx) rollback() error {
+	if t.done {
+		return nil
+	}
+	t.done = true
+	if t.savepoint == "" {
+		return t.tx.Rollback()
+	}
+	_, err := t.tx.Exec("ROLLBACK TO SAVEPOINT " + t.savepoint)
+	if err != nil {
+		return err
+	}
+	*t.pending = (*t.pending)[:t.mark]
+	_, err = t.tx.Exec("RELEASE SAVEPOINT " + t.savepoint)
+	return err
+}
+
+func (s *sqlStore) isManager(user string) (isManager bool, err error) {
+	err = s.queryRow("SELECT is_manager FROM users WHERE name=$1",
+		[]interface{}{user}, &isManager)
+	return isManager, err
+}
+
+func (s *sqlStore) password(user string) (salt, key []byte, params passwordHash, err error) {
+	err = s.queryRow("SELECT salt, password, hash_algorithm, hash_n, hash_r, hash_p, hash_key_len FROM users WHERE name=$1",
+		[]interface{}{user}, &salt, &key, &params.Algorithm, &params.N,
+		&params.R, &params.P, &params.KeyLen)
+	return salt, key, params, err
+}
+
+func (s *sqlStore) addUser(user string, salt, key []byte, params passwordHash, isManager bool) error {
+	_, err := s.exec("INSERT INTO users (name, salt, password, is_manager, hash_algorithm, hash_n, hash_r, hash_p, hash_key_len) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)",
+		user, salt, key, isManager, params.Algorithm, params.N, params.R,
+		params.P, params.KeyLen)
+	return err
+}
+
+func (s *sqlStore) setPassword(user string, salt, key []byte, params passwordHash) error {
+	result, err := s.exec("UPDATE users SET salt=$1, password=$2, hash_algorithm=$3, hash_n=$4, hash_r=$5, hash_p=$6, hash_key_len=$7 WHERE name=$8",
+		salt, key, params.Algorithm, params.N, params.R, params.P,
+		params.KeyLen, user)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return notFound
+	}
+	return nil
+}
+
+func (s *sqlStore) setIsManager(user string, isManager bool) error {
+	result, err := s.exec("UPDATE users SET is_manager=$1 WHERE name=$2",
+		isManager, user)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return notFound
+	}
+	return nil
+}
+
+func (s *sqlStore) deleteUser(user string) error {
+	result, err := s.exec("DELETE FROM users WHERE name=$1", user)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return notFound
+	}
+	return nil
+}
+
+func (s *sqlStore) findSession(token []byte, now, idle time.Time) (id, user string, err error) {
+	err = s.queryRow("SELECT id, name FROM sessions WHERE token=$1 and expires>$2 and last_used>$3",
+		[]interface{}{token, now, idle}, &id, &user)
+	return id, user, err
+}
+
+func (s *sqlStore) touchSession(id string, now time.Time) error {
+	_, err := s.exec("UPDATE sessions SET last_used=$1 WHERE id=$2", now, id)
+	return err
+}
+
+func (s *sqlStore) session(id string, now, idle time.Time) (v session, user string, err error) {
+	v.Id = id
+	err = s.queryRow("SELECT name, created, last_used, expires FROM sessions WHERE id=$1 and expires>$2 and last_used>$3",
+		[]interface{}{id, now, idle}, &user, &v.Created, &v.LastUsed, &v.Expires)
+	return v, user, err
+}
+
+func (s *sqlStore) sessions(user string, now, idle time.Time) ([]session, error) {
+	rows, err := s.query("SELECT id, created, last_used, expires FROM sessions WHERE name=$1 and expires>$2 and last_used>$3",
+		user, now, idle)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []session{}
+	for rows.Next() {
+		v := session{}
+		err = rows.Scan(&v.Id, &v.Created, &v.LastUsed, &v.Expires)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, v)
+	}
+	return sessions, rows.Err()
+}
+
+func (s *sqlStore) addSession(user string, v session, token []byte) error {
+	_, err := s.exec("INSERT INTO sessions (id, token, name, created, last_used, expires) VALUES ($1, $2, $3, $4, $5, $6)",
+		v.Id, token, user, v.Created, v.LastUsed, v.Expires)
+	return err
+}
+
+func (s *sqlStore) deleteSession(id string) error {
+	_, err := s.exec("DELETE FROM sessions WHERE id=$1", id)
+	return err
+}
+
+func (s *sqlStore) deleteStaleSessions(user string, now, idle time.Time) error {
+	_, err := s.exec("DELETE FROM sessions WHERE name=$1 and (expires<=$2 or last_used<=$3)",
+		user, now, idle)
+	return err
+}
+
+func (s *sqlStore) deleteSessions(user string) error {
+	_, err := s.exec("DELETE FROM sessions WHERE name=$1", user)
+	return err
+}
+
+func (s *sqlStore) project(pid uint) (project, error) {
+	p := project{Id: pid}
+	err := s.queryRow("SELECT name, percentage, description, updated, version, tree_version FROM projects WHERE id=$1",
+		[]interface{}{pid}, &p.Name, &p.Percentage, &p.Description,
+		&p.Updated, &p.Version, &p.TreeVersion)
+	p.Updated = normaliseDate(p.Updated)
+	return p, err
+}
+
+// insert runs an INSERT ... ON CONFLICT DO NOTHING statement, returning
+// duplicateId if nothing was inserted.
+func (s *sqlStore) insert(query string, args ...interface{}) error {
+	result, err := s.exec(query, args...)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err == nil && n == 0 {
+		return duplicateId
+	}
+	return err
+}
+
+func (s *sqlStore) addProject(p project) error {
+	err := s.insert("INSERT INTO projects (id, name, percentage, description, updated, version, flag, flag_version) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) ON CONFLICT DO NOTHING",
+		p.Id, p.Name, p.Percentage, p.Description, p.Updated, p.Version,
+		false, 0)
+	if err != nil {
+		return err
+	}
+	return s.recordChange(p.Id, changeProject, "", false)
+}
+
+func (s *sqlStore) projectVersions(pid uint) (fieldVersions, error) {
+	return s.fieldVersions("projects", projectFields, "id=$1", pid)
+}
+
+func (s *sqlStore) updateProject(p project, old uint, versions fieldVersions) (bool, error) {
+	updated, err := s.update("projects", projectFields, versions,
+		"name=$1, percentage=$2, description=$3, updated=$4, version=$5",
+		"id=$6 and version=$7",
+		p.Name, p.Percentage, p.Description, p.Updated, p.Version, p.Id, old)
+	if err != nil || !updated {
+		return updated, err
+	}
+	return true, s.recordChange(p.Id, changeProject, "", false)
+}
+
+// fieldVersions returns the versions of the given fields for the row of
+// table matching where.
+func (s *sqlStore) fieldVersions(table string, fields []string, where string, args ...interface{}) (fieldVersions, error) {
+	columns := make([]string, len(fields))
+	values := make([]uint, len(fields))
+	dest := make([]interface{}, len(fields))
+	for i, field := range fields {
+		columns[i] = versionColumn(field)
+		dest[i] = &values[i]
+	}
+	err := s.queryRow(fmt.Sprintf("SELECT %s FROM %s WHERE %s",
+		strings.Join(columns, ", "), table, where), args, dest...)
+	if err != nil {
+		return nil, err
+	}
+	versions := fieldVersions{}
+	for i, field := range fields {
+		versions[field] = values[i]
+	}
+	return versions, nil
+}
+
+// update runs "UPDATE table SET assign WHERE where", also setting the given
+// field versions.
+// It returns false if no rows matched, which is used to detect writes
+// based on stale versions.
+func (s *sqlStore) update(table string, fields []string, versions fieldVersions, assign, where string, args ...interface{}) (bool, error) {
+	for _, field := range fields {
+		assign += fmt.Sprintf(", %s=%d", versionColumn(field), versions[field])
+	}
+	result, err := s.exec(fmt.Sprintf("UPDATE %s SET %s WHERE %s",
+		table, assign, where), args...)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// deleteProject removes the project, any deliverables, and any memberships.
+func (s *sqlStore) deleteProject(pid uint) error {
+	err := s.recordChange(pid, changeProject, "", true)
+	if err != nil {
+		return err
+	}
+	// Record the removed memberships, so that former members still see the
+	// project deletion in their changes feed.
+	members, err := s.members(pid)
+	if err != nil {
+		return err
+	}
+	for _, m := range members {
+		err = s.logChange(change{pid: pid, kind: changeMembership,
+			item: m.Name, deleted: true})
+		if err != nil {
+			return err
+		}
+	}
+	for _, cmd := range []string{
+		"DELETE FROM webhooks WHERE pid=$1",
+		"DELETE FROM memberships WHERE pid=$1",
+		"DELETE FROM comments WHERE pid=$1",
+		"DELETE FROM deliverable_history WHERE pid=$1",
+		"DELETE FROM deliverables WHERE pid=$1",
+		"DELETE FROM projects WHERE id=$1",
+	} {
+		_, err := s.exec(cmd, pid)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) lockProject(pid uint) error {
+	var id uint
+	return s.queryRow("SELECT id FROM projects WHERE id=$1"+s.dialect.forUpdate,
+		[]interface{}{pid}, &id)
+}
+
+func (s *sqlStore) flag(pid uint) (flag, error) {
+	f := flag{}
+	err := s.queryRow("SELECT flag, flag_version FROM projects WHERE id=$1",
+		[]interface{}{pid}, &f.Value, &f.Version)
+	return f, err
+}
+
+func (s *sqlStore) swapFlag(pid uint, old, new flag) (bool, error) {
+	result, err := s.exec("UPDATE projects SET flag=$1, flag_version=$2 WHERE id=$3 and flag=$4 and flag_version=$5",
+		new.Value, new.Version, pid, old.Value, old.Version)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil || n != 1 {
+		return false, err
+	}
+	return true, s.recordChange(pid, changeFlag, "", false)
+}
+
+// projects returns the projects the user is a member of.
+func (s *sqlStore) projects(user string) ([]uint, error) {
+	return s.queryIds("SELECT pid FROM memberships WHERE name=$1 ORDER BY pid", user)
+}
+
+func (s *sqlStore) treeVersions(user string) ([]treeVersion, error) {
+	rows, err := s.query("SELECT p.id, p.tree_version FROM projects p JOIN memberships m ON m.pid=p.id WHERE m.name=$1 ORDER BY p.id",
+		user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := []treeVersion{}
+	for rows.Next() {
+		v := treeVersion{}
+		err = rows.Scan(&v.Id, &v.TreeVersion)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
+
+// memberColumns are the columns read into a member by scanMember.
+// Memberships migrated from the old tables do not record who added them.
+const memberColumns = "name, role, COALESCE(added_by, ''), added_at"
+
+func scanMember(m *member) []interface{} {
+	return []interface{}{&m.Name, &m.Role, &m.AddedBy, &m.AddedAt}
+}
+
+func (s *sqlStore) member(user string, pid uint) (member, error) {
+	m := member{}
+	err := s.queryRow("SELECT "+memberColumns+" FROM memberships WHERE name=$1 and pid=$2",
+		[]interface{}{user, pid}, scanMember(&m)...)
+	return m, err
+}
+
+// members returns the members of the project, sorted by name.
+func (s *sqlStore) members(pid uint) ([]member, error) {
+	rows, err := s.query("SELECT "+memberColumns+" FROM memberships WHERE pid=$1 ORDER BY name", pid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []member{}
+	for rows.Next() {
+		m := member{}
+		err = rows.Scan(scanMember(&m)...)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+func (s *sqlStore) addMember(pid uint, m member) error {
+	_, err := s.exec("INSERT INTO memberships (name, pid, role, added_by, added_at) VALUES ($1, $2, $3, $4, $5)",
+		m.Name, pid, m.Role, m.AddedBy, m.AddedAt)
+	if err != nil {
+		return err
+	}
+	return s.recordChange(pid, changeMembership, m.Name, false)
+}
+
+func (s *sqlStore) setRole(user string, pid uint, r role) error {
+	_, err := s.exec("UPDATE memberships SET role=$1 WHERE name=$2 and pid=$3",
+		r, user, pid)
+	if err != nil {
+		return err
+	}
+	return s.recordChange(pid, changeMembership, user, false)
+}
+
+func (s *sqlStore) removeMember(user string, pid uint) error {
+	_, err := s.exec("DELETE FROM memberships WHERE name=$1 and pid=$2", user, pid)
+	if err != nil {
+		return err
+	}
+	return s.recordChange(pid, changeMembership, user, true)
+}
+
+func (s *sqlStore) deliverables(pid uint) ([]uint, error) {
+	return s.queryIds("SELECT id FROM deliverables WHERE pid=$1 ORDER BY id", pid)
+}
+
+func (s *sqlStore) deliverable(pid, id uint) (deliverable, error) {
+	d := deliverable{Id: id}
+	err := s.queryRow("SELECT name, due, percentage, state, description, updated, version FROM deliverables WHERE id=$1 and pid=$2",
+		[]interface{}{id, pid}, &d.Name, &d.Due, &d.Percentage, &d.State,
+		&d.Description, &d.Updated, &d.Version)
+	d.Submitted = d.State.submitted()
+	d.Due = normaliseDate(d.Due)
+	d.Updated = normaliseDate(d.Updated)
+	return d, err
+}
+
+func (s *sqlStore) addDeliverable(pid uint, d deliverable) error {
+	if d.State == "" {
+		d.State = stateDraft
+	}
+	err := s.insert("INSERT INTO deliverables (id, pid, name, due, percentage, submitted, state, description, updated, version) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) ON CONFLICT DO NOTHING",
+		d.Id, pid, d.Name, d.Due, d.Percentage, d.State.submitted(), d.State,
+		d.Description, d.Updated, d.Version)
+	if err != nil {
+		return err
+	}
+	return s.recordChange(pid, changeDeliverable, deliverableItem(d.Id), false)
+}
+
+func (s *sqlStore) deliverableVersions(pid, id uint) (fieldVersions, error) {
+	return s.fieldVersions("deliverables", deliverableFields,
+		"id=$1 and pid=$2", id, pid)
+}
+
+func (s *sqlStore) updateDeliverable(pid uint, d deliverable, old uint, versions fieldVersions) (bool, error) {
+	updated, err := s.update("deliverables", deliverableFields, versions,
+		"name=$1, due=$2, percentage=$3, description=$4, updated=$5, version=$6",
+		"id=$7 and pid=$8 and version=$9",
+		d.Name, d.Due, d.Percentage, d.Description, d.Updated, d.Version, d.Id,
+		pid, old)
+	if err != nil || !updated {
+		return updated, err
+	}
+	return true, s.recordChange(pid, changeDeliverable, deliverableItem(d.Id), false)
+}
+
+func (s *sqlStore) deleteDeliverable(pid, id uint) error {
+	for _, table := range []string{"comments", "deliverable_history"} {
+		_, err := s.exec("DELETE FROM "+table+" WHERE did=$1 and pid=$2", id, pid)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := s.exec("DELETE FROM deliverables WHERE id=$1 and pid=$2", id, pid)
+	if err != nil {
+		return err
+	}
+	return s.recordChange(pid, changeDeliverable, deliverableItem(id), true)
+}
+
+// webhookColumns are the columns read into a webhook by scanWebhook.
+const webhookColumns = "id, COALESCE(pid, 0), name, url, secret, events, created"
+
+// scanWebhooks runs a query returning webhookColumns.
+func (s *sqlStore) scanWebhooks(query string, args ...interface{}) ([]webhook, error) {
+	rows, err := s.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hooks := []webhook{}
+	for rows.Next() {
+		w := webhook{}
+		events := ""
+		err = rows.Scan(&w.Id, &w.Project, &w.User, &w.URL, &w.Secret, &events,
+			&w.Created)
+		if err != nil {
+			return nil, err
+		}
+		w.Events = strings.Split(events, ",")
+		hooks = append(hooks, w)
+	}
+	return hooks, rows.Err()
+}
+
+func (s *sqlStore) webhook(id uint) (webhook, error) {
+	hooks, err := s.scanWebhooks("SELECT "+webhookColumns+" FROM webhooks WHERE id=$1", id)
+	if err != nil {
+		return webhook{}, err
+	} else if len(hooks) == 0 {
+		return webhook{}, notFound
+	}
+	return hooks[0], nil
+}
+
+func (s *sqlStore) projectWebhooks(pid uint) ([]webhook, error) {
+	return s.scanWebhooks("SELECT "+webhookColumns+" FROM webhooks WHERE pid=$1 ORDER BY created, id", pid)
+}
+
+func (s *sqlStore) userWebhooks(user string) ([]webhook, error) {
+	return s.scanWebhooks("SELECT "+webhookColumns+" FROM webhooks WHERE pid IS NULL and name=$1 ORDER BY created, id", user)
+}
+
+func (s *sqlStore) memberWebhooks(pid uint) ([]webhook, error) {
+	return s.scanWebhooks("SELECT "+webhookColumns+" FROM webhooks WHERE pid IS NULL and name IN (SELECT name FROM memberships WHERE pid=$1) ORDER BY created, id", pid)
+}
+
+func (s *sqlStore) addWebhook(w webhook) error {
+	var pid interface{}
+	if w.Project != 0 {
+		pid = w.Project
+	}
+	return s.insert("INSERT INTO webhooks (id, pid, name, url, secret, events, created) VALUES ($1, $2, $3, $4, $5, $6, $7) ON CONFLICT DO NOTHING",
+		w.Id, pid, w.User, w.URL, w.Secret, strings.Join(w.Events, ","),
+		w.Created)
+}
+
+func (s *sqlStore) deleteWebhook(id uint) error {
+	_, err := s.exec("DELETE FROM webhook_deliveries WHERE hook=$1", id)
+	if err != nil {
+		return err
+	}
+	_, err = s.exec("DELETE FROM webhooks WHERE id=$1", id)
+	return err
+}
+
+func (s *sqlStore) deleteUserWebhooks(user string) error {
+	_, err := s.exec("DELETE FROM webhook_deliveries WHERE hook IN (SELECT id FROM webhooks WHERE pid IS NULL and name=$1)", user)
+	if err != nil {
+		return err
+	}
+	_, err = s.exec("DELETE FROM webhooks WHERE pid IS NULL and name=$1", user)
+	return err
+}
+
+// deliveryColumns are the columns read into a delivery by scanDeliveries.
+const deliveryColumns = "id, hook, url, event, payload, signature, status, attempts, response_status, last_error, created, next_attempt"
+
+// scanDeliveries runs a query returning deliveryColumns.
+func (s *sqlStore) scanDeliveries(query string, args ...interface{}) ([]delivery, error) {
+	rows, err := s.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []delivery{}
+	for rows.Next() {
+		d := delivery{}
+		payload := ""
+		err = rows.Scan(&d.Id, &d.Webhook, &d.url, &d.Event, &payload,
+			&d.signature, &d.Status, &d.Attempts, &d.ResponseStatus, &d.Error,
+			&d.Created, &d.NextAttempt)
+		if err != nil {
+			return nil, err
+		}
+		d.Payload = json.RawMessage(payload)
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+func (s *sqlStore) addDelivery(d delivery) error {
+	return s.insert("INSERT INTO webhook_deliveries (id, hook, url, event, payload, signature, status, attempts, response_status, last_error, created, next_attempt) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) ON CONFLICT DO NOTHING",
+		d.Id, d.Webhook, d.url, d.Event, string(d.Payload), d.signature,
+		d.Status, d.Attempts, d.ResponseStatus, d.Error, d.Created,
+		d.NextAttempt)
+}
+
+func (s *sqlStore) deliveries(hook uint, limit int) ([]delivery, error) {
+	return s.scanDeliveries("SELECT "+deliveryColumns+" FROM webhook_deliveries WHERE hook=$1 ORDER BY created DESC, id LIMIT $2",
+		hook, limit)
+}
+
+func (s *sqlStore) dueDeliveries(now time.Time, limit int) ([]delivery, error) {
+	return s.scanDeliveries("SELECT "+deliveryColumns+" FROM webhook_deliveries WHERE status=$1 and next_attempt<=$2 ORDER BY next_attempt, id LIMIT $3",
+		deliveryPending, now, limit)
+}
+
+func (s *sqlStore) nextDelivery() (next time.Time, err error) {
+	err = s.queryRow("SELECT next_attempt FROM webhook_deliveries WHERE status=$1 ORDER BY next_attempt LIMIT 1",
+		[]interface{}{deliveryPending}, &next)
+	return next, err
+}
+
+func (s *sqlStore) claimDelivery(id uint, now, until time.Time) (bool, error) {
+	result, err := s.exec("UPDATE webhook_deliveries SET next_attempt=$1 WHERE id=$2 and status=$3 and next_attempt<=$4",
+		until, id, deliveryPending, now)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+func (s *sqlStore) updateDelivery(d delivery) error {
+	_, err := s.exec("UPDATE webhook_deliveries SET status=$1, attempts=$2, response_status=$3, last_error=$4, next_attempt=$5 WHERE id=$6",
+		d.Status, d.Attempts, d.ResponseStatus, d.Error, d.NextAttempt, d.Id)
+	return err
+}
+
+// setDeliverableState returns duplicateId if the transition id is taken.
+// The transition is recorded before the state is changed, so that the
+// insert can be retried with a new id; if false is returned the transaction
+// should be rolled back.
+func (s *sqlStore) setDeliverableState(pid, id uint, t transition) (bool, error) {
+	// Times may clash, so the history is ordered by seq. Only one concurrent
+	// transition can update the state, so seq is unique too.
+	err := s.insert("INSERT INTO deliverable_history (id, pid, did, seq, from_state, to_state, name, note, changed_at) VALUES ($1, $2, $3, (SELECT COUNT(*) + 1 FROM deliverable_history WHERE pid=$2 and did=$3), $4, $5, $6, $7, $8) ON CONFLICT DO NOTHING",
+		t.Id, pid, id, t.From, t.State, t.User, t.Note, t.Time)
+	if err != nil {
+		return false, err
+	}
+	result, err := s.exec("UPDATE deliverables SET state=$1, submitted=$2, updated=$3, version=version+1 WHERE id=$4 and pid=$5 and state=$6",
+		t.State, t.State.submitted(), t.Time, id, pid, t.From)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil || n != 1 {
+		return false, err
+	}
+	return true, s.recordChange(pid, changeDeliverable, deliverableItem(id), false)
+}
+
+// transitionColumns are the columns read into a transition by
+// scanTransitions.
+const transitionColumns = "id, from_state, to_state, name, note, changed_at"
+
+// scanTransitions runs a query returning transitionColumns.
+func (s *sqlStore) scanTransitions(query string, args ...interface{}) ([]transition, error) {
+	rows, err := s.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transitions := []transition{}
+	for rows.Next() {
+		t := transition{}
+		err = rows.Scan(&t.Id, &t.From, &t.State, &t.User, &t.Note, &t.Time)
+		if err != nil {
+			return nil, err
+		}
+		t.Time = normaliseDate(t.Time)
+		transitions = append(transitions, t)
+	}
+	return transitions, rows.Err()
+}
+
+func (s *sqlStore) deliverableHistory(pid, id uint) ([]transition, error) {
+	return s.scanTransitions("SELECT "+transitionColumns+" FROM deliverable_history WHERE pid=$1 and did=$2 ORDER BY seq",
+		pid, id)
+}
+
+func (s *sqlStore) transition(pid, did, id uint) (transition, error) {
+	transitions, err := s.scanTransitions("SELECT "+transitionColumns+" FROM deliverable_history WHERE pid=$1 and did=$2 and id=$3",
+		pid, did, id)
+	if err != nil {
+		return transition{}, err
+	} else if len(transitions) == 0 {
+		return transition{}, notFound
+	}
+	return transitions[0], nil
+}
+
+// commentColumns are the columns read into a comment by scanComments.
+const commentColumns = "id, did, parent, name, body, created, updated"
+
+// scanComments runs a query returning commentColumns.
+func (s *sqlStore) scanComments(query string, args ...interface{}) ([]comment, error) {
+	rows, err := s.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	comments := []comment{}
+	for rows.Next() {
+		c := comment{}
+		err = rows.Scan(&c.Id, &c.did, &c.Parent, &c.User, &c.Body, &c.Created,
+			&c.Updated)
+		if err != nil {
+			return nil, err
+		}
+		c.Created = normaliseDate(c.Created)
+		c.Updated = normaliseDate(c.Updated)
+		comments = append(comments, c)
+	}
+	return comments, rows.Err()
+}
+
+func (s *sqlStore) comments(pid, did uint) ([]comment, error) {
+	return s.scanComments("SELECT "+commentColumns+" FROM comments WHERE pid=$1 and did=$2 ORDER BY seq, id",
+		pid, did)
+}
+
+func (s *sqlStore) comment(pid, id uint) (comment, error) {
+	comments, err := s.scanComments("SELECT "+commentColumns+" FROM comments WHERE pid=$1 and id=$2",
+		pid, id)
+	if err != nil {
+		return comment{}, err
+	} else if len(comments) == 0 {
+		return comment{}, notFound
+	}
+	return comments[0], nil
+}
+
+func (s *sqlStore) addComment(pid uint, c comment) error {
+	// Times may clash, so comments are ordered by seq instead.
+	err := s.insert("INSERT INTO comments (id, pid, did, parent, seq, name, body, created, updated) VALUES ($1, $2, $3, $4, (SELECT COALESCE(MAX(seq), 0) + 1 FROM comments WHERE pid=$2 and did=$3), $5, $6, $7, $8) ON CONFLICT DO NOTHING",
+		c.Id, pid, c.did, c.Parent, c.User, c.Body, c.Created, c.Updated)
+	if err != nil {
+		return err
+	}
+	return s.recordChange(pid, changeComment, commentItem(c.did, c.Id), false)
+}
+
+func (s *sqlStore) updateComment(pid uint, c comment) error {
+	_, err := s.exec("UPDATE comments SET body=$1, updated=$2 WHERE pid=$3 and id=$4",
+		c.Body, c.Updated, pid, c.Id)
+	if err != nil {
+		return err
+	}
+	return s.recordChange(pid, changeComment, commentItem(c.did, c.Id), false)
+}
+
+func (s *sqlStore) deleteComment(pid, id uint) error {
+	c, err := s.comment(pid, id)
+	if err != nil {
+		return err
+	}
+	ids, err := s.queryIds(`WITH RECURSIVE thread(id) AS (
+			SELECT id FROM comments WHERE pid=$1 and id=$2
+			UNION ALL SELECT c.id FROM comments c JOIN thread t ON c.parent=t.id
+		) SELECT id FROM thread`, pid, id)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		_, err = s.exec("DELETE FROM comments WHERE pid=$1 and id=$2", pid, id)
+		if err != nil {
+			return err
+		}
+		err = s.recordChange(pid, changeComment, commentItem(c.did, id), true)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliverableItem returns the item recorded in changes for a deliverable.
+func deliverableItem(id uint) string {
+	return strconv.FormatUint(uint64(id), 10)
+}
+
+// commentItem returns the item recorded in changes for a comment, which is
+// the path of the comment within the project.
+func commentItem(did, id uint) string {
+	if did == 0 {
+		return fmt.Sprintf("comments/%d", id)
+	}
+	return fmt.Sprintf("deliverables/%d/comments/%d", did, id)
+}
+
+// recordChange records a change to an item in the project, and bumps the
+// project tree version.
+func (s *sqlStore) recordChange(pid uint, kind, item string, deleted bool) error {
+	_, err := s.exec("UPDATE projects SET tree_version=tree_version+1 WHERE id=$1", pid)
+	if err != nil {
+		return err
+	}
+	return s.logChange(change{pid: pid, kind: kind, item: item, deleted: deleted})
+}
+
+// logChange adds the change to the changes feed.
+// Within a transaction, the change is only written when the transaction
+// commits; see sqlTx.commit.
+func (s *sqlStore) logChange(c change) error {
+	if s.tx != nil {
+		*s.pending = append(*s.pending, c)
+		return nil
+	}
+	err := s.insertChange(c, time.Now().UTC())
+	if err == nil {
+		s.notifier.notify()
+	}
+	return err
+}
+
+func (s *sqlStore) insertChange(c change, now time.Time) error {
+	_, err := s.exec("INSERT INTO changes (pid, kind, item, deleted, changed_at) VALUES ($1, $2, $3, $4, $5)",
+		c.pid, c.kind, c.item, c.deleted, now)
+	return err
+}
+
+// writeChanges writes the pending changes, holding the changes lock until
+// the transaction commits.
+// Otherwise, a reader could see a change with a later seq before one still
+// being committed, and skip over the earlier change.
+func (t *sqlTx) writeChanges() error {
+	if t.dialect.lockChanges != "" {
+		_, err := t.exec(t.dialect.lockChanges)
+		if err != nil {
+			return err
+		}
+	}
+	now := time.Now().UTC()
+	for _, c := range *t.pending {
+		err := t.insertChange(c, now)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) cursor() (uint, error) {
+	var seq uint
+	err := s.queryRow("SELECT COALESCE(MAX(seq), 0) FROM changes", nil, &seq)
+	return seq, err
+}
+
+func (s *sqlStore) changes(user string, since, until uint) ([]change, error) {
+	rows, err := s.query(`SELECT seq, pid, kind, item, deleted FROM changes
+		WHERE seq > $1 and seq <= $2 and (
+			pid IN (SELECT pid FROM memberships WHERE name=$3) or
+			(kind=$4 and item=$3) or
+			(kind=$5 and deleted and pid IN (SELECT pid FROM changes WHERE kind=$4 and item=$3 and deleted))
+		) ORDER BY seq`,
+		since, until, user, changeMembership, changeProject)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []change{}
+	for rows.Next() {
+		c := change{}
+		err = rows.Scan(&c.seq, &c.pid, &c.kind, &c.item, &c.deleted)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
+
+func (s *sqlStore) changed() <-chan struct{} {
+	return s.notifier.wait()
+}
+
+// notifier wakes anything waiting for changes to be committed.
+type notifier struct {
+	lock sync.Mutex
+	ch   chan struct{}
+}
+
+// wait returns a channel which is closed on the next call to notify.
+func (n *notifier) wait() <-chan struct{} {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.ch == nil {
+		n.ch = make(chan struct{})
+	}
+	return n.ch
+}
+
+func (n *notifier) notify() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.ch != nil {
+		close(n.ch)
+		n.ch = nil
+	}
+}
+
+// vim: sw=4 ts=4 noexpandtab
@@ -0,0 +1,174 @@
+/*
+Tests for the storage implementation.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package backend
+
+import (
+	"database/sql"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// newTestStore returns a migrated store using an in-memory SQLite database.
+func newTestStore(t *testing.T) Store {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	store := NewSQLiteStore(db)
+	err = NewDB(store).Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestTransactionRollback(t *testing.T) {
+	store := newTestStore(t)
+
+	tx, err := store.begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.addProject(project{Id: 1, Name: "Project"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = store.project(1)
+	if err != notFound {
+		t.Fatalf("Expected the project to be rolled back, got %v", err)
+	}
+}
+
+func TestNestedTransaction(t *testing.T) {
+	store := newTestStore(t)
+
+	tx, err := store.begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.rollback()
+	err = tx.addProject(project{Id: 1, Name: "Kept"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nested, err := tx.begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = nested.addProject(project{Id: 2, Name: "Discarded"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = nested.rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = store.project(1)
+	if err != nil {
+		t.Fatalf("Expected the outer change to be kept, got %v", err)
+	}
+	_, err = store.project(2)
+	if err != notFound {
+		t.Fatalf("Expected the nested change to be discarded, got %v", err)
+	}
+}
+
+func TestSwapFlag(t *testing.T) {
+	store := newTestStore(t)
+	err := store.addProject(project{Id: 1, Name: "Project"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	swapped, err := store.swapFlag(1, flag{0, false}, flag{1, true})
+	if err != nil || !swapped {
+		t.Fatalf("Expected the first swap to succeed, got %v, %v", swapped, err)
+	}
+	// A second writer basing their change on the old state loses.
+	swapped, err = store.swapFlag(1, flag{0, false}, flag{1, false})
+	if err != nil || swapped {
+		t.Fatalf("Expected a stale swap to fail, got %v, %v", swapped, err)
+	}
+	f, err := store.flag(1)
+	if err != nil || f != (flag{1, true}) {
+		t.Fatalf("Expected %v, got %v, %v", flag{1, true}, f, err)
+	}
+}
+
+func TestUpdateProjectVersions(t *testing.T) {
+	store := newTestStore(t)
+	err := store.addProject(project{Id: 1, Name: "Project"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	versions := fieldVersions{"Name": 1}
+	updated, err := store.updateProject(project{Id: 1, Name: "New", Version: 1}, 0, versions)
+	if err != nil || !updated {
+		t.Fatalf("Expected the first update to succeed, got %v, %v", updated, err)
+	}
+	// A second writer which read version 0 loses.
+	updated, err = store.updateProject(project{Id: 1, Name: "Stale", Version: 1}, 0, versions)
+	if err != nil || updated {
+		t.Fatalf("Expected a stale update to fail, got %v, %v", updated, err)
+	}
+	p, err := store.project(1)
+	if err != nil || p.Name != "New" || p.Version != 1 {
+		t.Fatalf("Expected the first update to be kept, got %+v, %v", p, err)
+	}
+	saved, err := store.projectVersions(1)
+	if err != nil || saved["Name"] != 1 || saved["Description"] != 0 {
+		t.Fatalf("Expected %v, got %v, %v", versions, saved, err)
+	}
+}
+
+func TestMembershipMigration(t *testing.T) {
+	store := newTestStore(t)
+	err := store.migrate(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := store.(*sqlStore)
+	for _, cmd := range []string{
+		"INSERT INTO users (name) VALUES ('owner'), ('viewer')",
+		"INSERT INTO projects (id, name) VALUES (1, 'Project')",
+		"INSERT INTO owns (name, pid) VALUES ('owner', 1)",
+		"INSERT INTO views (name, pid) VALUES ('viewer', 1)",
+	} {
+		_, err = s.exec(cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = NewDB(store).Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expected := range map[string]role{"owner": roleOwner, "viewer": roleViewer} {
+		r, err := roleOf(name, 1, store)
+		if err != nil || r != expected {
+			t.Fatalf("Expected %s to be %q, got %q, %v", name, expected, r, err)
+		}
+	}
+}
+
+// vim: sw=4 ts=4 noexpandtab
@@ -0,0 +1,86 @@
+/*
+Server-side merging of synchronised items.
+
+This generalises the flag synchronisation described in api.md to items with
+several fields. Each synchronised field records the item version at which it
+was last changed. A client change to a field is applied if the client has
+seen that change (the field version is not newer than the version the client
+sent); otherwise the server value is kept.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package backend
+
+import (
+	"reflect"
+	"strings"
+)
+
+// maxMergeAttempts is the number of times a merge is retried when another
+// writer updates the item between reading and writing it.
+const maxMergeAttempts = 8
+
+// Synchronised fields for each item type.
+// Updated is set by the server whenever anything else changes, and the state
+// of deliverables only changes through the workflow, so neither are
+// synchronised.
+var (
+	projectFields     = []string{"Name", "Percentage", "Description"}
+	deliverableFields = []string{"Name", "Due", "Percentage", "Description"}
+)
+
+// fieldVersions maps field names to the item version they last changed at.
+type fieldVersions map[string]uint
+
+// versionColumn returns the column holding the version of the given field.
+func versionColumn(field string) string {
+	return strings.ToLower(field) + "_version"
+}
+
+// merge applies the changes from update to cur, both of which must be
+// pointers to structs of the same type, and updates versions to match.
+// base is the version the client based the update on, and next is the
+// version to give any changed fields.
+// merge returns the fields where the client value was dropped in favour of
+// a newer server value, and whether anything changed.
+func merge(cur, update interface{}, fields []string, versions fieldVersions, base, next uint) (kept []string, changed bool) {
+	curValue := reflect.ValueOf(cur).Elem()
+	updateValue := reflect.ValueOf(update).Elem()
+	kept = []string{}
+	for _, field := range fields {
+		c := curValue.FieldByName(field)
+		u := updateValue.FieldByName(field)
+		if reflect.DeepEqual(c.Interface(), u.Interface()) {
+			continue
+		}
+		if versions[field] > base {
+			// Somebody else has changed this since the client last synced.
+			kept = append(kept, field)
+			continue
+		}
+		c.Set(u)
+		versions[field] = next
+		changed = true
+	}
+	return kept, changed
+}
+
+// mergeResult is returned to clients after a PUT to a synchronised item.
+// Kept lists the fields where the server value was kept.
+type mergeResult struct {
+	Kept []string
+}
+
+type mergedProject struct {
+	project
+	mergeResult
+}
+
+type mergedDeliverable struct {
+	deliverable
+	mergeResult
+}
+
+// vim: sw=4 ts=4 noexpandtab
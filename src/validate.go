@@ -0,0 +1,95 @@
+/*
+Validation of uploaded items.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package backend
+
+import (
+	"fmt"
+	"time"
+)
+
+// Dates are sent to clients as RFC 3339 timestamps in UTC, with no
+// fractional seconds.
+const dateFormat = time.RFC3339
+
+// Dates outside of this range are rejected, since they are almost certainly
+// mistakes.
+var (
+	minDate = time.Date(1900, time.January, 1, 0, 0, 0, 0, time.UTC)
+	maxDate = time.Date(9999, time.December, 31, 23, 59, 59, 0, time.UTC)
+)
+
+// formatDate returns the given time in the format sent to clients.
+func formatDate(t time.Time) string {
+	return t.UTC().Truncate(time.Second).Format(dateFormat)
+}
+
+// normaliseDate converts a date read from the database to the format sent
+// to clients.
+// Dates which can't be parsed are returned unchanged.
+func normaliseDate(date string) string {
+	t, err := time.Parse(time.RFC3339Nano, date)
+	if err != nil {
+		return date
+	}
+	return formatDate(t)
+}
+
+// validator checks the fields of an uploaded item, collecting every invalid
+// field so that clients can be told about all of them at once.
+// The same rules are used when creating and updating items.
+type validator struct {
+	fields []fieldError
+}
+
+// invalid marks the field as invalid.
+func (v *validator) invalid(field, format string, args ...interface{}) {
+	v.fields = append(v.fields, fieldError{field, fmt.Sprintf(format, args...)})
+}
+
+// length checks that the value is at least min bytes long, and shorter than
+// max.
+func (v *validator) length(field, value string, min, max int) {
+	if len(value) < min || len(value) >= max {
+		if min == 0 {
+			v.invalid(field, "Must be less than %d bytes", max)
+		} else {
+			v.invalid(field, "Must be between %d and %d bytes", min, max-1)
+		}
+	}
+}
+
+// percentage checks that the value is a percentage.
+func (v *validator) percentage(field string, value uint) {
+	if value > 100 {
+		v.invalid(field, "Must be at most 100")
+	}
+}
+
+// date checks that the value is an RFC 3339 timestamp, including the time
+// zone, and normalises it to the format sent to clients.
+func (v *validator) date(field string, value *string) {
+	t, err := time.Parse(time.RFC3339Nano, *value)
+	if err != nil {
+		v.invalid(field, "Must be an RFC 3339 date and time, like %q",
+			"2017-12-19T00:00:00Z")
+		return
+	}
+	if t.Before(minDate) || t.After(maxDate) {
+		v.invalid(field, "Must be between %s and %s", formatDate(minDate),
+			formatDate(maxDate))
+		return
+	}
+	*value = formatDate(t)
+}
+
+// err returns an error listing the invalid fields, or nil if there are none.
+func (v *validator) err() error {
+	return invalidFields(v.fields)
+}
+
+// vim: sw=4 ts=4 noexpandtab
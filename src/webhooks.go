@@ -0,0 +1,637 @@
+/*
+Webhooks, letting other services (like CI or chat bots) follow projects.
+
+Owners register webhooks for a project, and users can register webhooks for
+every project they are a member of. Events are queued in the same
+transaction as the change causing them, and delivered in the background with
+retries; see DeliverWebhooks.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Events sent to webhooks.
+const (
+	eventDeliverableCreated   = "deliverable.created"
+	eventDeliverableSubmitted = "deliverable.submitted"
+	eventFlagChanged          = "flag.changed"
+	eventClientAdded          = "client.added"
+	eventProjectDeleted       = "project.deleted"
+)
+
+// webhookEvents maps each event to the kind of resource it is about, which
+// members need to be able to see for their webhooks to be sent the event.
+var webhookEvents = map[string]kind{
+	eventDeliverableCreated:   deliverableKind,
+	eventDeliverableSubmitted: deliverableKind,
+	eventFlagChanged:          flagKind,
+	eventClientAdded:          clientKind,
+	eventProjectDeleted:       projectKind,
+}
+
+// Delivery states.
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+)
+
+const (
+	webhookURLLen    = 2048
+	webhookSecretLen = 128
+	webhookErrorLen  = 512
+	// webhookSecretSize is the size of generated secrets, in bytes.
+	webhookSecretSize = 32
+	// webhookLogSize is the number of deliveries listed in the log.
+	webhookLogSize = 100
+)
+
+// Failed deliveries are retried after the retry delay (see
+// WithWebhookRetryDelay), doubling after each attempt up to
+// webhookMaxRetryDelay, and given up on after webhookMaxAttempts.
+// Pending deliveries are also checked for every webhookPollInterval; see
+// checkChanges.
+var (
+	webhookTimeout       = 10 * time.Second
+	webhookMaxAttempts   = uint(8)
+	webhookMaxRetryDelay = 6 * time.Hour
+	webhookPollInterval  = 30 * time.Second
+	webhookBatchSize     = 10
+)
+
+// privateNetworks are the special purpose networks which webhooks are not
+// sent to, besides those recognised by the net.IP methods; see
+// publicAddress.
+var privateNetworks = func() []*net.IPNet {
+	networks := []*net.IPNet{}
+	for _, cidr := range []string{
+		"0.0.0.0/8",     // "This" network.
+		"100.64.0.0/10", // Carrier-grade NAT.
+		"192.0.0.0/24",  // IETF protocol assignments.
+		"198.18.0.0/15", // Benchmarking.
+		"240.0.0.0/4",   // Reserved.
+		"64:ff9b::/96",  // NAT64, which may map to private IPv4 addresses.
+		"2001:db8::/32", // Documentation.
+		"fec0::/10",     // Deprecated site-local.
+	} {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+// Headers sent with each delivery.
+const (
+	webhookEventHeader     = "X-Mel-Event"
+	webhookDeliveryHeader  = "X-Mel-Delivery"
+	webhookSignatureHeader = "X-Mel-Signature"
+)
+
+type webhook struct {
+	Id      uint
+	URL     string
+	Events  []string
+	Secret  string `json:",omitempty"` // Only sent when first created.
+	Project uint   `json:",omitempty"` // Zero for user webhooks.
+	User    string // The user who added the webhook.
+	Created time.Time
+}
+
+// validate checks the uploaded webhook, returning an error listing any
+// invalid fields.
+// Unless allowPrivate is set, URLs for hosts which are obviously not public
+// are rejected; see publicHost.
+func (w *webhook) validate(allowPrivate bool) error {
+	v := validator{}
+	v.length("URL", w.URL, 1, webhookURLLen)
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		v.invalid("URL", "Must be an absolute http or https URL")
+	} else if !allowPrivate && !publicHost(u.Hostname()) {
+		v.invalid("URL", "Must not be a loopback, link-local, or private address")
+	}
+	if len(w.Events) == 0 {
+		v.invalid("Events", "Must list at least one event")
+	}
+	for _, event := range w.Events {
+		if _, ok := webhookEvents[event]; !ok {
+			v.invalid("Events", "Unknown event %q", event)
+		}
+	}
+	v.length("Secret", w.Secret, 0, webhookSecretLen)
+	return v.err()
+}
+
+// publicHost returns false if the host is localhost or a non-public IP
+// address.
+// Other hostnames may still resolve to a non-public address, so addresses
+// are checked again when delivering; see newWebhookClient.
+func publicHost(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip == nil || publicAddress(ip)
+}
+
+// publicAddress returns true if the IP address is a public unicast address.
+func publicAddress(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// path returns the path of the webhook resource.
+func (w webhook) path() string {
+	if w.Project == 0 {
+		return fmt.Sprintf("/webhooks/%d", w.Id)
+	}
+	return fmt.Sprintf("%s/webhooks/%d", projectPath(w.Project), w.Id)
+}
+
+// delivery is a single event sent (or to be sent) to a webhook.
+type delivery struct {
+	Id             uint
+	Webhook        uint
+	Event          string
+	Status         string
+	Attempts       uint
+	ResponseStatus int    `json:",omitempty"` // From the last attempt.
+	Error          string `json:",omitempty"` // Why the last attempt failed.
+	Created        time.Time
+	NextAttempt    time.Time // Only meaningful while pending.
+	Payload        json.RawMessage
+	url            string
+	signature      string
+}
+
+// webhookPayload is the body of a delivery.
+type webhookPayload struct {
+	Id      uint // The delivery id.
+	Event   string
+	Project uint
+	User    string // The user who caused the event.
+	Time    string
+	Data    interface{} // The item the event is about.
+}
+
+// webhookEvent is an event to queue for delivery.
+type webhookEvent struct {
+	name  string
+	pid   uint
+	actor string
+	data  interface{}
+}
+
+// visibleTo returns true if a user with the given role in the project can
+// see the event.
+func (e webhookEvent) visibleTo(user string, r role) bool {
+	if c, ok := e.data.(client); ok && c.Name == user {
+		// Members can always see their own membership.
+		return r != roleNone
+	}
+	return forbiddenFor(r, webhookEvents[e.name])&get == 0
+}
+
+// queueWebhooks queues the event for delivery to the project's webhooks,
+// and to the webhooks of members who can see it.
+func queueWebhooks(store Store, e webhookEvent) error {
+	hooks, err := store.projectWebhooks(e.pid)
+	if err != nil {
+		return err
+	}
+	members, err := store.memberWebhooks(e.pid)
+	if err != nil {
+		return err
+	}
+	for _, w := range members {
+		r, err := roleOf(w.User, e.pid, store)
+		if err != nil {
+			return err
+		} else if e.visibleTo(w.User, r) {
+			hooks = append(hooks, w)
+		}
+	}
+
+	now := time.Now().UTC()
+	for _, w := range hooks {
+		if !contains(w.Events, e.name) {
+			continue
+		}
+		d := delivery{Webhook: w.Id, Event: e.name, Status: deliveryPending,
+			Created: now, NextAttempt: now, url: w.URL}
+		_, err = insertWithId(func(id uint) error {
+			var err error
+			d.Id = id
+			d.Payload, err = json.Marshal(webhookPayload{id, e.name, e.pid,
+				e.actor, formatDate(now), e.data})
+			if err != nil {
+				return err
+			}
+			d.signature = signPayload(w.Secret, d.Payload)
+			return store.addDelivery(d)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// signPayload returns the signature header for the payload, which is the
+// hex encoded HMAC-SHA256 of the payload keyed with the webhook secret.
+func signPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// DeliverWebhooks sends queued webhook deliveries until ctx is cancelled.
+// Servers created with NewServer do this automatically, but programs using
+// NewHandler need to run it themselves.
+// Several processes may deliver webhooks from the same database at once.
+func (d DB) DeliverWebhooks(ctx context.Context, opts ...Option) {
+	deliverWebhooks(ctx, d.store, newConfig(opts))
+}
+
+func deliverWebhooks(ctx context.Context, store Store, c config) {
+	client := newWebhookClient(c.privateWebhooks)
+	for {
+		var wait time.Duration
+		changed, err := checkChanges(store, func() (err error) {
+			wait, err = deliverDue(ctx, store, client, c.webhookRetryDelay)
+			return err
+		})
+		if err != nil {
+			log.Printf("Failed to deliver webhooks: %q\n", err)
+			wait = webhookPollInterval
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-changed:
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
+
+// newWebhookClient returns the client used to deliver webhooks.
+// Unless allowPrivate is set, the client refuses to connect to anything but
+// public addresses; see WithPrivateWebhooks.
+func newWebhookClient(allowPrivate bool) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if !allowPrivate {
+		dialer := &net.Dialer{
+			Timeout: webhookTimeout,
+			// The address has already been resolved, so this also catches
+			// hostnames which resolve to non-public addresses.
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				ip := net.ParseIP(host)
+				if ip == nil || !publicAddress(ip) {
+					return fmt.Errorf("Refusing to connect to non-public address %s", host)
+				}
+				return nil
+			},
+		}
+		transport.DialContext = dialer.DialContext
+		// Otherwise the proxy would be connected to instead, and could
+		// forward the delivery anywhere.
+		transport.Proxy = nil
+	}
+	return &http.Client{
+		Timeout:   webhookTimeout,
+		Transport: transport,
+		// Redirects are treated as failures.
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// deliverDue sends every delivery which is due, and returns how long to wait
+// before the next delivery is due.
+func deliverDue(ctx context.Context, store Store, client *http.Client, retryDelay time.Duration) (time.Duration, error) {
+	for ctx.Err() == nil {
+		due, err := claimDeliveries(store)
+		if err != nil {
+			return 0, err
+		} else if len(due) == 0 {
+			break
+		}
+		for _, d := range due {
+			sendDelivery(ctx, client, &d, retryDelay)
+			if ctx.Err() != nil {
+				// Interrupted; the claim expires, so it will be retried.
+				break
+			}
+			err = store.updateDelivery(d)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	next, err := store.nextDelivery()
+	if err == notFound {
+		return webhookPollInterval, nil
+	} else if err != nil {
+		return 0, err
+	}
+	wait := time.Until(next)
+	if wait < 0 {
+		wait = 0
+	} else if wait > webhookPollInterval {
+		wait = webhookPollInterval
+	}
+	return wait, nil
+}
+
+// claimDeliveries claims the next few deliveries which are due.
+// Claimed deliveries are not due again until the claim expires, so that
+// deliveries interrupted by a crash are still retried.
+func claimDeliveries(store Store) ([]delivery, error) {
+	tx, err := store.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.rollback()
+
+	now := time.Now().UTC()
+	due, err := tx.dueDeliveries(now, webhookBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	claimed := []delivery{}
+	for _, d := range due {
+		ok, err := tx.claimDelivery(d.Id, now, now.Add(2*webhookTimeout))
+		if err != nil {
+			return nil, err
+		} else if ok {
+			claimed = append(claimed, d)
+		}
+	}
+	return claimed, tx.commit()
+}
+
+// sendDelivery makes a single attempt at sending the delivery, and updates
+// it with the result.
+func sendDelivery(ctx context.Context, client *http.Client, d *delivery, retryDelay time.Duration) {
+	d.Attempts++
+	err := postDelivery(ctx, client, d)
+	if err == nil {
+		d.Status = deliveryDelivered
+		d.Error = ""
+		return
+	}
+
+	d.Error = err.Error()
+	if len(d.Error) > webhookErrorLen {
+		d.Error = d.Error[:webhookErrorLen]
+	}
+	if d.Attempts >= webhookMaxAttempts {
+		d.Status = deliveryFailed
+		return
+	}
+	delay := retryDelay
+	for i := uint(1); i < d.Attempts && delay < webhookMaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > webhookMaxRetryDelay {
+		delay = webhookMaxRetryDelay
+	}
+	d.NextAttempt = time.Now().UTC().Add(delay)
+}
+
+// postDelivery posts the delivery to the webhook, returning an error unless
+// the webhook responds with a 2xx status.
+func postDelivery(ctx context.Context, client *http.Client, d *delivery) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url,
+		bytes.NewReader(d.Payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(webhookEventHeader, d.Event)
+	request.Header.Set(webhookDeliveryHeader, fmt.Sprint(d.Id))
+	request.Header.Set(webhookSignatureHeader, d.signature)
+	response, err := client.Do(request)
+	if err != nil {
+		d.ResponseStatus = 0
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 1<<16))
+
+	d.ResponseStatus = response.StatusCode
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("Unexpected status %s", response.Status)
+	}
+	return nil
+}
+
+// webhookList lists the project's webhooks, or the user's own webhooks if
+// project is nil.
+type webhookList struct {
+	resource
+	user         string
+	project      *projectResource
+	allowPrivate bool // See WithPrivateWebhooks.
+	store        Store
+}
+
+func (l *webhookList) forbidden() int {
+	if l.project == nil {
+		return 0
+	}
+	return forbiddenFor(l.project.role, webhookListKind)
+}
+
+func (l *webhookList) get(enc encoder) error {
+	var hooks []webhook
+	var err error
+	if l.project == nil {
+		hooks, err = l.store.userWebhooks(l.user)
+	} else {
+		hooks, err = l.store.projectWebhooks(l.project.pid)
+	}
+	if err != nil {
+		return err
+	}
+	for _, w := range hooks {
+		err = enc.Encode(w.Id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// create for webhookList registers a new webhook.
+// A secret is generated if none is given; either way, the secret is only
+// returned here.
+func (l *webhookList) create(dec decoder, success func(string, interface{}) error) error {
+	upload := webhook{}
+	err := dec.Decode(&upload)
+	if err != nil {
+		return badJSON(err)
+	}
+	err = upload.validate(l.allowPrivate)
+	if err != nil {
+		return err
+	}
+
+	w := webhook{URL: upload.URL, Events: upload.Events, Secret: upload.Secret,
+		User: l.user, Created: time.Now().UTC()}
+	if l.project != nil {
+		w.Project = l.project.pid
+	}
+	if w.Secret == "" {
+		secret := make([]byte, webhookSecretSize)
+		_, err = rand.Read(secret)
+		if err != nil {
+			return err
+		}
+		w.Secret = base64.RawURLEncoding.EncodeToString(secret)
+	}
+	w.Id, err = insertWithId(func(id uint) error {
+		w.Id = id
+		return l.store.addWebhook(w)
+	})
+	if err != nil {
+		return err
+	}
+	return success(w.path(), w)
+}
+
+func newWebhookList(user string, pid uint, c config, store Store) (resource, error) {
+	if pid == 0 {
+		return &webhookList{defaultResource{}, user, nil, c.privateWebhooks, store}, nil
+	}
+	proj, err := newProject(user, pid, store)
+	return &webhookList{defaultResource{}, user, proj, c.privateWebhooks, store}, err
+}
+
+type webhookResource struct {
+	resource
+	hook    webhook
+	user    string
+	project *projectResource // nil for user webhooks.
+	store   Store
+}
+
+func (w *webhookResource) forbidden() int {
+	if w.project != nil {
+		return forbiddenFor(w.project.role, webhookKind)
+	} else if w.hook.User == w.user {
+		return set | create
+	}
+	return all
+}
+
+func (w *webhookResource) get(enc encoder) error {
+	hook := w.hook
+	hook.Secret = ""
+	return enc.Encode(hook)
+}
+
+func (w *webhookResource) delete() error {
+	return w.store.deleteWebhook(w.hook.Id)
+}
+
+// newWebhook returns the webhook with the given id, which must be a user
+// webhook if pid is zero, or belong to the project otherwise.
+func newWebhook(user string, id, pid uint, store Store) (*webhookResource, error) {
+	hook, err := store.webhook(id)
+	if err == notFound || (err == nil && hook.Project != pid) {
+		return nil, invalidResource
+	} else if err != nil {
+		return nil, err
+	}
+	w := &webhookResource{defaultResource{}, hook, user, nil, store}
+	if pid != 0 {
+		w.project, err = newProject(user, pid, store)
+	}
+	return w, err
+}
+
+// deliveryList is the delivery log for a webhook.
+type deliveryList struct {
+	resource
+	hook *webhookResource
+}
+
+// forbidden for deliveryList allows reading the log if the webhook can be
+// read.
+func (l *deliveryList) forbidden() int {
+	if l.hook.forbidden()&get != 0 {
+		return all
+	}
+	return set | create | delete
+}
+
+// get for deliveryList lists the latest deliveries, newest first.
+func (l *deliveryList) get(enc encoder) error {
+	deliveries, err := l.hook.store.deliveries(l.hook.hook.Id, webhookLogSize)
+	if err != nil {
+		return err
+	}
+	for _, d := range deliveries {
+		err = enc.Encode(d)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newDeliveryList(user string, id, pid uint, store Store) (resource, error) {
+	hook, err := newWebhook(user, id, pid, store)
+	if err != nil {
+		return nil, err
+	}
+	return &deliveryList{defaultResource{}, hook}, nil
+}
+
+// vim: sw=4 ts=4 noexpandtab
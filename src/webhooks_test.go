@@ -0,0 +1,64 @@
+/*
+Tests for webhook delivery.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package backend
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPublicHost(t *testing.T) {
+	for host, public := range map[string]bool{
+		"example.com":     true,
+		"93.184.216.34":   true,
+		"2606:4700::6810": true,
+		"localhost":       false,
+		"LocalHost.":      false,
+		"api.localhost":   false,
+		"127.0.0.1":       false,
+		"10.1.2.3":        false,
+		"172.16.0.1":      false,
+		"192.168.1.1":     false,
+		"169.254.169.254": false,
+		"100.64.0.1":      false,
+		"0.0.0.0":         false,
+		"::1":             false,
+		"fe80::1":         false,
+		"fd00::1":         false,
+		"::ffff:10.0.0.1": false,
+	} {
+		if publicHost(host) != public {
+			t.Errorf("Expected publicHost(%q) to be %t", host, public)
+		}
+	}
+}
+
+func TestWebhookClientPrivate(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	// Resolved, so only caught when connecting.
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://localhost:" + port
+
+	_, err = newWebhookClient(false).Get(url)
+	if err == nil {
+		t.Fatalf("Expected connecting to %s to fail", url)
+	}
+	response, err := newWebhookClient(true).Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+}
+
+// vim: sw=4 ts=4 noexpandtab
@@ -0,0 +1,411 @@
+/*
+WebSocket channel for bidirectional sync.
+
+Clients connect to /ws, subscribe to projects, and then send requests over
+the socket instead of making separate HTTP requests. Changes to subscribed
+projects are pushed as they happen, including those made by other users.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const wsPath = "/ws"
+
+// Types of message sent over the socket.
+const (
+	wsSubscribe   = "subscribe"
+	wsUnsubscribe = "unsubscribe"
+	wsRequest     = "request"
+	wsResponse    = "response"
+	wsChange      = "change"
+)
+
+// Pings are sent every wsPingInterval, and the connection is closed if
+// nothing is received for twice that.
+var (
+	wsPingInterval   = 30 * time.Second
+	wsWriteTimeout   = 10 * time.Second
+	wsMaxMessageSize = int64(1 << 20)
+)
+
+var upgrader = websocket.Upgrader{
+	Error: func(writer http.ResponseWriter, request *http.Request, status int, reason error) {
+		log.Printf("WebSocket upgrade failed: %q\n", reason)
+		writeProblem(writer, statusProblem(status))
+	},
+}
+
+// wsMessage is a message from the client.
+// Subscriptions list the Projects; if none are given, every project the user
+// can see is used. Requests are operations as for batches, and are answered
+// with a response with the same Id.
+type wsMessage struct {
+	Id       string `json:",omitempty"`
+	Type     string
+	Projects []uint `json:",omitempty"`
+	operation
+}
+
+// wsReply is the response to a message from the client.
+type wsReply struct {
+	Id   string `json:",omitempty"`
+	Type string
+	operationResult
+}
+
+// wsPush is a change to a subscribed project.
+// Seq is the sequence number of the change, as for event ids.
+type wsPush struct {
+	Type string
+	Seq  uint
+	feedEntry
+}
+
+// wsConn is a single client connection.
+// mu guards the stream, and is held while pushing changes so that the
+// changes for a new subscription are never sent before the snapshot.
+// writeMu guards writes to the socket; it may be taken while holding mu, but
+// not the other way around.
+type wsConn struct {
+	conn     *websocket.Conn
+	user     string
+	password string
+	config   config
+	store    Store
+
+	mu     sync.Mutex
+	stream *eventStream
+
+	writeMu sync.Mutex
+}
+
+// serveWebSocket upgrades the request, and handles messages from the client
+// until the client disconnects or the server shuts down.
+func serveWebSocket(writer http.ResponseWriter, request *http.Request, user, password string, conf config, store Store) {
+	if request.Method != http.MethodGet {
+		writeProblem(writer, newProblem(invalidMethod))
+		return
+	}
+	// Clients start without any subscriptions.
+	stream := &eventStream{user: user, only: map[uint]bool{}, store: store}
+	if token, ok := bearerToken(request); ok {
+		stream.session = hashToken(token)
+	}
+	err := stream.start("", store)
+	if err != nil {
+		writeProblem(writer, statusProblem(http.StatusInternalServerError))
+		log.Printf("%q\n", err)
+		return
+	}
+	conn, err := upgrader.Upgrade(writer, request, nil)
+	if err != nil {
+		// The upgrader has already responded.
+		return
+	}
+	c := &wsConn{conn: conn, user: user, password: password, config: conf,
+		store: store, stream: stream}
+	defer conn.Close()
+
+	// Close the connection when the server shuts down, which also stops the
+	// reader.
+	ctx := request.Context()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.write(websocket.CloseMessage, websocket.FormatCloseMessage(
+				websocket.CloseGoingAway, "Server shutting down"))
+			conn.Close()
+		case <-done:
+		}
+	}()
+	go c.push(done)
+
+	conn.SetReadLimit(wsMaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(2 * wsPingInterval))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * wsPingInterval))
+	})
+	for {
+		kind, data, err := conn.ReadMessage()
+		if err != nil {
+			// The client has gone, or sent something invalid.
+			return
+		} else if kind != websocket.TextMessage {
+			c.reply(wsMessage{}, errorResult(badBody("Expected a text message")))
+			continue
+		}
+		msg := wsMessage{}
+		err = json.Unmarshal(data, &msg)
+		if err != nil {
+			c.reply(msg, errorResult(badJSON(err)))
+			continue
+		}
+		err = c.handle(msg)
+		if err == sessionEnded {
+			c.endSession()
+			return
+		} else if err != nil {
+			log.Printf("WebSocket for %s failed: %q\n", user, err)
+			return
+		}
+	}
+}
+
+// handle a single message from the client.
+// Only errors which should close the connection are returned.
+func (c *wsConn) handle(msg wsMessage) error {
+	if c.stream.session != nil {
+		err := checkSession(c.stream.session, c.store)
+		if err != nil {
+			return err
+		}
+	}
+	switch msg.Type {
+	case wsSubscribe:
+		return c.subscribe(msg)
+	case wsUnsubscribe:
+		return c.unsubscribe(msg)
+	case wsRequest:
+		res, err := c.request(msg.operation)
+		if err != nil {
+			// As for other requests, the client just sees the error.
+			log.Printf("WebSocket request for %s failed: %q\n", c.user, err)
+			res = errorResult(err)
+		}
+		return c.reply(msg, res)
+	default:
+		return c.reply(msg, errorResult(badBody(
+			fmt.Sprintf("Unknown message type %q", msg.Type))))
+	}
+}
+
+// request performs a single operation in its own transaction.
+func (c *wsConn) request(op operation) (operationResult, error) {
+	tx, err := c.store.begin()
+	if err != nil {
+		return operationResult{}, err
+	}
+	defer tx.rollback()
+	res, err := batchOperation(c.user, c.password, op, c.config, tx)
+	if err != nil {
+		return res, err
+	}
+	return res, tx.commit()
+}
+
+// subscribe adds the projects to the subscriptions, and sends each new
+// project in full.
+func (c *wsConn) subscribe(msg wsMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tx, err := c.store.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.rollback()
+
+	pids := msg.Projects
+	if len(pids) == 0 {
+		pids, err = tx.projects(c.user)
+		if err != nil {
+			return err
+		}
+	}
+	for _, pid := range pids {
+		err = checkCanView(c.user, pid, tx)
+		if errorStatus(err) == http.StatusInternalServerError {
+			return err
+		} else if err != nil {
+			return c.reply(msg, errorResult(err))
+		}
+	}
+
+	// Catch up on the current subscriptions first, so that the new projects
+	// can be sent as of the same change; later changes are pushed as usual.
+	pushes := []wsPush{}
+	events, err := c.stream.read(tx)
+	if err != nil {
+		return err
+	}
+	for _, e := range events {
+		pushes = append(pushes, wsPush{wsChange, e.seq, e.feedEntry})
+	}
+	f := &feedResource{defaultResource{}, c.user, "", tx, map[uint]role{}, nil}
+	for _, pid := range pids {
+		if c.stream.only == nil || c.stream.only[pid] {
+			continue
+		}
+		r, err := f.role(pid)
+		if err != nil {
+			return err
+		}
+		entries, err := f.snapshot(pid, r)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			pushes = append(pushes, wsPush{wsChange, c.stream.cursor, entry})
+		}
+	}
+	err = tx.commit()
+	if err != nil {
+		return err
+	}
+
+	if len(msg.Projects) == 0 {
+		c.stream.only = nil
+	} else if c.stream.only != nil {
+		for _, pid := range pids {
+			c.stream.only[pid] = true
+		}
+	}
+	err = c.reply(msg, operationResult{Status: http.StatusOK})
+	if err != nil {
+		return err
+	}
+	for _, p := range pushes {
+		err = c.writeJSON(p)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unsubscribe removes the projects from the subscriptions, or every project
+// if none are given.
+func (c *wsConn) unsubscribe(msg wsMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(msg.Projects) == 0 {
+		c.stream.only = map[uint]bool{}
+		return c.reply(msg, operationResult{Status: http.StatusOK})
+	}
+	if c.stream.only == nil {
+		// Replace "every project" with the projects the user is in now.
+		pids, err := c.store.projects(c.user)
+		if err != nil {
+			return err
+		}
+		c.stream.only = map[uint]bool{}
+		for _, pid := range pids {
+			c.stream.only[pid] = true
+		}
+	}
+	remove := map[uint]bool{}
+	for _, pid := range msg.Projects {
+		remove[pid] = true
+	}
+	only := map[uint]bool{}
+	for pid := range c.stream.only {
+		if !remove[pid] {
+			only[pid] = true
+		}
+	}
+	c.stream.only = only
+	return c.reply(msg, operationResult{Status: http.StatusOK})
+}
+
+// push sends changes to subscribed projects until done is closed.
+func (c *wsConn) push(done <-chan struct{}) {
+	poll := time.NewTicker(eventPollInterval)
+	defer poll.Stop()
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	for {
+		changed, err := checkChanges(c.store, c.pushChanges)
+		if err == sessionEnded {
+			c.endSession()
+			return
+		} else if err != nil {
+			log.Printf("Failed to push changes to %s: %q\n", c.user, err)
+			c.conn.Close()
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-poll.C:
+		case <-ping.C:
+			err = c.write(websocket.PingMessage, nil)
+			if err != nil {
+				c.conn.Close()
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// pushChanges sends any changes since the last call.
+func (c *wsConn) pushChanges() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	events, err := c.stream.next()
+	if err != nil {
+		return err
+	}
+	for _, e := range events {
+		err = c.writeJSON(wsPush{wsChange, e.seq, e.feedEntry})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// endSession closes the connection once the session used to open it has
+// ended.
+func (c *wsConn) endSession() {
+	c.write(websocket.CloseMessage, websocket.FormatCloseMessage(
+		websocket.ClosePolicyViolation, "Session ended"))
+	c.conn.Close()
+}
+
+// errorResult returns the result for a failed message.
+func errorResult(err error) operationResult {
+	p := newProblem(err)
+	return operationResult{Status: p.Status, Error: &p}
+}
+
+// reply sends the response to a message.
+func (c *wsConn) reply(msg wsMessage, res operationResult) error {
+	return c.writeJSON(wsReply{msg.Id, wsResponse, res})
+}
+
+func (c *wsConn) writeJSON(value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return c.write(websocket.TextMessage, data)
+}
+
+// write a single message to the socket.
+func (c *wsConn) write(kind int, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return c.conn.WriteMessage(kind, data)
+}
+
+// vim: sw=4 ts=4 noexpandtab
@@ -0,0 +1,217 @@
+/*
+Deliverable review workflow.
+
+Deliverables start as drafts. Members submit them, and owners review them,
+then either accept them or reject them with a note explaining the changes
+needed. Every state change is recorded in the deliverable's history.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package backend
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// deliverableState is the state of a deliverable in the workflow.
+type deliverableState string
+
+const (
+	stateDraft     deliverableState = "draft"
+	stateSubmitted deliverableState = "submitted"
+	stateInReview  deliverableState = "in_review"
+	stateAccepted  deliverableState = "accepted"
+	stateRejected  deliverableState = "rejected"
+)
+
+// valid returns true for the known states.
+func (s deliverableState) valid() bool {
+	switch s {
+	case stateDraft, stateSubmitted, stateInReview, stateAccepted, stateRejected:
+		return true
+	}
+	return false
+}
+
+// submitted returns true for the states where the deliverable has been
+// submitted and not sent back; this is sent as Submitted for older clients.
+func (s deliverableState) submitted() bool {
+	return s == stateSubmitted || s == stateInReview || s == stateAccepted
+}
+
+// stateTransitions lists the states each state can move to, along with the
+// kind of permission needed to make that transition.
+// Submitted deliverables can be withdrawn (moved back to draft) until the
+// review starts, and rejected deliverables can be submitted again.
+// Accepted deliverables are final.
+var stateTransitions = map[deliverableState]map[deliverableState]kind{
+	stateDraft:     {stateSubmitted: submissionKind},
+	stateSubmitted: {stateDraft: submissionKind, stateInReview: reviewKind},
+	stateInReview:  {stateAccepted: reviewKind, stateRejected: reviewKind},
+	stateRejected:  {stateSubmitted: submissionKind},
+}
+
+// transition is a single change of state, as recorded in the history.
+type transition struct {
+	Id    uint
+	From  deliverableState
+	State deliverableState // The new state.
+	User  string           // The user who made the change.
+	Note  string           `json:",omitempty"`
+	Time  string
+}
+
+var invalidTransition error = &requestError{http.StatusConflict, "invalid_transition", "Invalid state transition", nil}
+
+type historyList struct {
+	resource
+	deliverable *deliverableResource
+}
+
+func (l *historyList) forbidden() int {
+	r := l.deliverable.project.role
+	forbidden := all
+	if forbiddenFor(r, deliverableKind)&get == 0 {
+		forbidden &^= get
+	}
+	// The transition is checked in create, once the state is known.
+	if forbiddenFor(r, submissionKind)&create == 0 ||
+		forbiddenFor(r, reviewKind)&create == 0 {
+		forbidden &^= create
+	}
+	return forbidden
+}
+
+// get for historyList lists the transitions, oldest first.
+func (l *historyList) get(enc encoder) error {
+	transitions, err := l.deliverable.store.deliverableHistory(
+		l.deliverable.pid, l.deliverable.id)
+	if err != nil {
+		return err
+	}
+	for _, t := range transitions {
+		err = enc.Encode(t)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// create for historyList moves the deliverable to the given State.
+// Rejections must include a Note explaining the changes needed.
+func (l *historyList) create(dec decoder, success func(string, interface{}) error) error {
+	upload := transition{}
+	err := dec.Decode(&upload)
+	if err != nil {
+		return badJSON(err)
+	}
+	v := validator{}
+	if !upload.State.valid() {
+		v.invalid("State", "Unknown state %q", upload.State)
+	}
+	v.length("Note", upload.Note, 0, dbDescLen)
+	if upload.State == stateRejected && upload.Note == "" {
+		v.invalid("Note", "Must explain the changes needed")
+	}
+	err = v.err()
+	if err != nil {
+		return err
+	}
+
+	d := l.deliverable
+	cur, err := d.store.deliverable(d.pid, d.id)
+	if err != nil {
+		return err
+	}
+	t, err := changeState(d, cur.State, upload.State, upload.Note)
+	if err != nil {
+		return err
+	}
+	return success(fmt.Sprintf("/projects/%d/deliverables/%d/history/%d",
+		d.pid, d.id, t.Id), t)
+}
+
+// changeState moves the deliverable from the state from to the given state,
+// if the user is allowed to, and returns the transition added to the
+// history.
+func changeState(d *deliverableResource, from, state deliverableState, note string) (transition, error) {
+	k, ok := stateTransitions[from][state]
+	if !ok {
+		return transition{}, &requestError{http.StatusConflict, "invalid_transition",
+			fmt.Sprintf("Cannot move from %s to %q", from, state), nil}
+	} else if forbiddenFor(d.project.role, k)&create != 0 {
+		return transition{}, accessDenied
+	}
+
+	t := transition{From: from, State: state, User: d.project.user,
+		Note: note, Time: formatDate(time.Now())}
+	var err error
+	t.Id, err = insertWithId(func(id uint) error {
+		t.Id = id
+		updated, err := d.store.setDeliverableState(d.pid, d.id, t)
+		if err == nil && !updated {
+			// Somebody else changed the state first.
+			return invalidTransition
+		}
+		return err
+	})
+	if err != nil {
+		return t, err
+	}
+
+	if t.State == stateSubmitted {
+		cur, err := d.store.deliverable(d.pid, d.id)
+		if err != nil {
+			return t, err
+		}
+		err = queueWebhooks(d.store, webhookEvent{eventDeliverableSubmitted,
+			d.pid, d.project.user, cur})
+		if err != nil {
+			return t, err
+		}
+	}
+	return t, nil
+}
+
+func newHistoryList(user string, id, pid uint, store Store) (resource, error) {
+	d, err := newDeliverable(user, id, pid, store)
+	if err != nil {
+		return nil, err
+	}
+	return &historyList{defaultResource{}, d}, nil
+}
+
+type historyResource struct {
+	resource
+	transition  transition
+	deliverable *deliverableResource
+}
+
+func (h *historyResource) forbidden() int {
+	return forbiddenFor(h.deliverable.project.role, deliverableKind) | set | create | delete
+}
+
+func (h *historyResource) get(enc encoder) error {
+	return enc.Encode(h.transition)
+}
+
+func newHistory(user string, id, did, pid uint, store Store) (resource, error) {
+	d, err := newDeliverable(user, did, pid, store)
+	if err != nil {
+		return nil, err
+	}
+	t, err := store.transition(pid, did, id)
+	if err == notFound {
+		return nil, invalidResource
+	} else if err != nil {
+		return nil, err
+	}
+	return &historyResource{defaultResource{}, t, d}, nil
+}
+
+// vim: sw=4 ts=4 noexpandtab
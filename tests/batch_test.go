@@ -0,0 +1,184 @@
+/*
+Tests for the batch endpoint.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+var batchUrl = "/batch"
+
+func TestBatch(t *testing.T) {
+	runSuite(t, batchTests())
+}
+
+type operationResult struct {
+	Status   int
+	Location string
+	Body     []json.RawMessage
+}
+
+// checkBatch returns a CheckBody function checking the status of each
+// operation in a batch.
+// The results are saved in results, if not nil.
+func checkBatch(results *[]operationResult, statuses ...int) func(*json.Decoder) error {
+	return func(dec *json.Decoder) error {
+		got := []operationResult{}
+		err := dec.Decode(&got)
+		if err != nil {
+			return err
+		}
+		if len(got) != len(statuses) {
+			return fmt.Errorf("Expected %d results, got %+v", len(statuses), got)
+		}
+		for i, status := range statuses {
+			if got[i].Status != status {
+				return fmt.Errorf("Expected status %d for operation %d, got %+v",
+					status, i, got)
+			}
+		}
+		if results != nil {
+			*results = got
+		}
+		return nil
+	}
+}
+
+// batchTests returns the tests for the batch endpoint.
+func batchTests() []Test {
+	projectIds := []uint{}
+	results := []operationResult{}
+	projectUrl := func() string {
+		return fmt.Sprintf("%s/%d", projectsUrl, projectIds[0])
+	}
+	create := func(name string) string {
+		return fmt.Sprintf(`{"Method":"POST", "Path":%q, "Body":{"Name":%q, "Updated":"2017-12-19"}}`,
+			projectsUrl, name)
+	}
+
+	return []Test{
+		Test{
+			Name:   "batch:Create",
+			Pre:    addUsers,
+			Method: "POST", URL: batchUrl, Status: http.StatusOK,
+			BodyFunc: func() string {
+				return "[" + create("A") + "," + create("B") + "]"
+			},
+			CheckBody: checkBatch(&results, http.StatusCreated, http.StatusCreated),
+		},
+		Test{
+			Name:   "batch:CheckCreated",
+			Method: "GET", URL: projectsUrl, Status: http.StatusOK,
+			CheckBody: func(dec *json.Decoder) error {
+				err := getProjectIds(dec, &projectIds)
+				if err != nil {
+					return err
+				}
+				if len(projectIds) != 2 {
+					return fmt.Errorf("Expected two projects, got %v", projectIds)
+				}
+				for _, id := range projectIds {
+					if results[0].Location == fmt.Sprintf("%s/%d", projectsUrl, id) {
+						return nil
+					}
+				}
+				return fmt.Errorf("Unexpected location %s", results[0].Location)
+			},
+		},
+		Test{
+			// Lists return one value per entry.
+			Name:   "batch:GetList",
+			Method: "POST", URL: batchUrl, Status: http.StatusOK,
+			BodyFunc: func() string {
+				return fmt.Sprintf(`[{"Method":"GET", "Path":%q}]`, projectsUrl)
+			},
+			CheckBody: func(dec *json.Decoder) error {
+				err := checkBatch(&results, http.StatusOK)(dec)
+				if err != nil {
+					return err
+				}
+				if len(results[0].Body) != 2 {
+					return fmt.Errorf("Expected two projects, got %+v", results[0])
+				}
+				return nil
+			},
+		},
+		Test{
+			// Failed operations do not stop the rest of the batch.
+			Name:   "batch:PartialFailure",
+			Method: "POST", URL: batchUrl, Status: http.StatusOK,
+			BodyFunc: func() string {
+				return fmt.Sprintf(`[%s, {"Method":"GET", "Path":"/nonexistent"}, {"Method":"POST", "Path":%q, "Body":"invalid"}]`,
+					create("C"), projectsUrl)
+			},
+			CheckBody: checkBatch(nil, http.StatusCreated, http.StatusNotFound,
+				http.StatusBadRequest),
+		},
+		Test{
+			Name:   "batch:CheckPartialFailure",
+			Method: "GET", URL: projectsUrl, Status: http.StatusOK,
+			CheckBody: func(dec *json.Decoder) error {
+				ids := []uint{}
+				err := getProjectIds(dec, &ids)
+				if len(ids) != 3 {
+					return fmt.Errorf("Expected three projects, got %v", ids)
+				}
+				return err
+			},
+		},
+		Test{
+			// Any failure in an atomic batch undoes the whole batch.
+			Name:   "batch:AtomicFailure",
+			Method: "POST", URL: batchUrl + "?atomic=true", Status: http.StatusOK,
+			BodyFunc: func() string {
+				return fmt.Sprintf(`[%s, {"Method":"DELETE", "Path":%q}, {"Method":"GET", "Path":"/nonexistent"}, %s]`,
+					create("D"), projectUrl(), create("E"))
+			},
+			CheckBody: checkBatch(nil, http.StatusFailedDependency,
+				http.StatusFailedDependency, http.StatusNotFound,
+				http.StatusFailedDependency),
+		},
+		Test{
+			Name:   "batch:CheckAtomicFailure",
+			Method: "GET", URL: projectsUrl, Status: http.StatusOK,
+			CheckBody: func(dec *json.Decoder) error {
+				ids := []uint{}
+				err := getProjectIds(dec, &ids)
+				if len(ids) != 3 {
+					return fmt.Errorf("Expected three projects, got %v", ids)
+				}
+				return err
+			},
+		},
+		Test{
+			// Each operation is checked against the user's permissions.
+			Name:   "batch:Forbidden",
+			Method: "POST", URL: batchUrl, Status: http.StatusOK,
+			SetAuth: setClientAuth,
+			BodyFunc: func() string {
+				return fmt.Sprintf(`[{"Method":"GET", "Path":%q}, {"Method":"GET", "Path":%q}]`,
+					projectsUrl, projectUrl())
+			},
+			CheckBody: checkBatch(nil, http.StatusOK, http.StatusForbidden),
+		},
+		Test{
+			Name:   "batch:InvalidMethod",
+			Method: "GET", URL: batchUrl, Status: http.StatusMethodNotAllowed,
+		},
+		Test{
+			Name:   "batch:InvalidBody",
+			Method: "POST", URL: batchUrl, Status: http.StatusBadRequest,
+			BodyFunc: func() string { return `{"Method":"GET"}` },
+		},
+	}
+}
+
+// vim: sw=4 ts=4 noexpandtab
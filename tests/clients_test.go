@@ -0,0 +1,203 @@
+/*
+Tests for the projects/pID/clients endpoints.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package tests
+
+import (
+	"encoding/base32"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestClients(t *testing.T) {
+	runSuite(t, clientsTests())
+}
+
+type client struct {
+	Id        string
+	Name      string
+	IsManager bool
+}
+
+// clientId returns the id used in URLs for the given user.
+func clientId(name string) string {
+	return base32.StdEncoding.EncodeToString([]byte(name))
+}
+
+// checkClient returns a CheckBody function checking for the given client.
+func checkClient(name string, manager bool) func(*json.Decoder) error {
+	return func(dec *json.Decoder) error {
+		expected := client{clientId(name), name, manager}
+		c := client{}
+		err := dec.Decode(&c)
+		if err == nil && c != expected {
+			err = fmt.Errorf("Expected %+v, got %+v", expected, c)
+		}
+		return err
+	}
+}
+
+// checkClients returns a CheckBody function checking the list of client ids.
+// Clients are listed in order of name.
+func checkClients(names ...string) func(*json.Decoder) error {
+	return func(dec *json.Decoder) error {
+		ids := []string{}
+		for dec.More() {
+			id := ""
+			err := dec.Decode(&id)
+			if err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+		if len(ids) != len(names) {
+			return fmt.Errorf("Expected %d clients, got %v", len(names), ids)
+		}
+		for i, name := range names {
+			if ids[i] != clientId(name) {
+				return fmt.Errorf("Expected %s, got %s", clientId(name), ids[i])
+			}
+		}
+		return nil
+	}
+}
+
+// clientsTests returns the tests for adding, promoting, demoting and
+// removing clients.
+func clientsTests() []Test {
+	projectIds := []uint{}
+	clientsUrl := func() string {
+		return fmt.Sprintf("%s/%d/clients", projectsUrl, projectIds[0])
+	}
+	clientUrl := func(name string) func() string {
+		return func() string {
+			return fmt.Sprintf("%s/%s", clientsUrl(), clientId(name))
+		}
+	}
+	projectUrl := func() string {
+		return fmt.Sprintf("%s/%d", projectsUrl, projectIds[0])
+	}
+
+	return []Test{
+		Test{
+			Name:   "clients:CreateProject",
+			Pre:    addUsers,
+			Method: "POST", URL: projectsUrl, Status: http.StatusCreated,
+			BodyFunc: func() string {
+				return `{"Name":"Test Project", "Updated":"2017-12-19"}`
+			},
+			CheckBody: func(dec *json.Decoder) error {
+				return getCreatedId(dec, &projectIds)
+			},
+		},
+		Test{
+			Name:   "clients:ListOwner",
+			Method: "GET", URLFunc: clientsUrl, Status: http.StatusOK,
+			CheckBody: checkClients(defaultUser),
+		},
+		Test{
+			Name:   "clients:AddViewer",
+			Method: "POST", URLFunc: clientsUrl, Status: http.StatusCreated,
+			BodyFunc:  func() string { return `{"Name":"` + client1User + `"}` },
+			CheckBody: checkClient(client1User, false),
+		},
+		Test{
+			Name:   "clients:AddUnknownUser",
+			Method: "POST", URLFunc: clientsUrl, Status: http.StatusBadRequest,
+			BodyFunc: func() string { return `{"Name":"nobody"}` },
+		},
+		Test{
+			Name:   "clients:ListBoth",
+			Method: "GET", URLFunc: clientsUrl, Status: http.StatusOK,
+			CheckBody: checkClients(client1User, defaultUser),
+		},
+		Test{
+			Name:   "clients:GetViewer",
+			Method: "GET", URLFunc: clientUrl(client1User), Status: http.StatusOK,
+			CheckBody: checkClient(client1User, false),
+		},
+		Test{
+			Name:   "clients:GetOwner",
+			Method: "GET", URLFunc: clientUrl(defaultUser), Status: http.StatusOK,
+			CheckBody: checkClient(defaultUser, true),
+		},
+		Test{
+			Name:   "clients:GetNonMember",
+			Method: "GET", URLFunc: clientUrl("nobody"), Status: http.StatusNotFound,
+		},
+		Test{
+			Name:   "clients:PromoteAsViewerForbidden",
+			Method: "PUT", URLFunc: clientUrl(client1User),
+			Status:   http.StatusForbidden,
+			SetAuth:  setClientAuth,
+			BodyFunc: func() string { return `{"IsManager":true}` },
+		},
+		Test{
+			Name:   "clients:DemoteLastOwner",
+			Method: "PUT", URLFunc: clientUrl(defaultUser), Status: http.StatusConflict,
+			BodyFunc: func() string { return `{"IsManager":false}` },
+		},
+		Test{
+			Name:   "clients:RemoveLastOwner",
+			Method: "DELETE", URLFunc: clientUrl(defaultUser), Status: http.StatusConflict,
+		},
+		Test{
+			Name:   "clients:AddManager",
+			Method: "POST", URLFunc: clientsUrl, Status: http.StatusCreated,
+			BodyFunc:  func() string { return `{"Name":"` + client1User + `", "IsManager":true}` },
+			CheckBody: checkClient(client1User, true),
+		},
+		Test{
+			Name:   "clients:GetAsNewOwner",
+			Method: "GET", URLFunc: projectUrl, Status: http.StatusOK,
+			SetAuth: setClientAuth,
+			CheckBody: func(dec *json.Decoder) error {
+				return checkProjectEqual(dec, project{
+					Id:   projectIds[0],
+					Name: "Test Project",
+					Owns: true,
+				})
+			},
+		},
+		Test{
+			Name:   "clients:ListOwners",
+			Method: "GET", URLFunc: clientsUrl, Status: http.StatusOK,
+			SetAuth:   setClientAuth,
+			CheckBody: checkClients(client1User, defaultUser),
+		},
+		Test{
+			// Transfer ownership by demoting the original owner.
+			Name:   "clients:DemoteSelf",
+			Method: "PUT", URLFunc: clientUrl(defaultUser), Status: http.StatusOK,
+			BodyFunc:  func() string { return `{"IsManager":false}` },
+			CheckBody: checkClient(defaultUser, false),
+		},
+		Test{
+			Name:   "clients:CheckDemoted",
+			Method: "GET", URLFunc: clientsUrl, Status: http.StatusForbidden,
+		},
+		Test{
+			Name:   "clients:DemoteNewLastOwner",
+			Method: "PUT", URLFunc: clientUrl(client1User), Status: http.StatusConflict,
+			SetAuth:  setClientAuth,
+			BodyFunc: func() string { return `{"IsManager":false}` },
+		},
+		Test{
+			Name:   "clients:RemoveViewer",
+			Method: "DELETE", URLFunc: clientUrl(defaultUser), Status: http.StatusOK,
+			SetAuth: setClientAuth,
+		},
+		Test{
+			Name:   "clients:CheckRemoved",
+			Method: "GET", URLFunc: projectUrl, Status: http.StatusForbidden,
+		},
+	}
+}
+
+// vim: sw=4 ts=4 noexpandtab
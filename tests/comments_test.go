@@ -0,0 +1,314 @@
+/*
+Tests for comment threads.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestComments(t *testing.T) {
+	runSuite(t, commentsTests())
+}
+
+// comment is a single comment in a thread.
+type comment struct {
+	Parent uint
+	User   string
+	Body   string
+}
+
+// checkComments returns a CheckBody function checking the comments match the
+// given comments, in order, ignoring the ids and times.
+func checkComments(expected ...comment) func(*json.Decoder) error {
+	return func(dec *json.Decoder) error {
+		got := []comment{}
+		for dec.More() {
+			c := struct {
+				comment
+				Id      uint
+				Created string
+				Updated string
+			}{}
+			err := dec.Decode(&c)
+			if err != nil {
+				return err
+			} else if c.Id == 0 || c.Created == "" || c.Updated == "" {
+				return fmt.Errorf("Expected an id and times, got %+v", c)
+			}
+			got = append(got, c.comment)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(expected) {
+			return fmt.Errorf("Expected comments %+v, got %+v", expected, got)
+		}
+		return nil
+	}
+}
+
+// commentsTests returns the tests for commenting on projects and
+// deliverables.
+// The default user owns the project, and the first client starts as a viewer
+// before becoming a commenter.
+func commentsTests() []Test {
+	projectIds := []uint{}
+	deliverableIds := []uint{}
+	commentIds := []uint{}
+	projectUrl := func() string {
+		return fmt.Sprintf("%s/%d", projectsUrl, projectIds[0])
+	}
+	deliverableUrl := func() string {
+		return fmt.Sprintf("%s/deliverables/%d", projectUrl(), deliverableIds[0])
+	}
+	commentsUrl := func() string {
+		return projectUrl() + "/comments"
+	}
+	commentUrl := func(i int) func() string {
+		return func() string {
+			return fmt.Sprintf("%s/%d", commentsUrl(), commentIds[i])
+		}
+	}
+	deliverableCommentsUrl := func() string {
+		return deliverableUrl() + "/comments"
+	}
+	body := func(body string, parent int) func() string {
+		return func() string {
+			if parent < 0 {
+				return fmt.Sprintf(`{"Body":%q}`, body)
+			}
+			return fmt.Sprintf(`{"Body":%q, "Parent":%d}`, body, commentIds[parent])
+		}
+	}
+	getId := func(dec *json.Decoder) error {
+		return getCreatedId(dec, &commentIds)
+	}
+
+	return []Test{
+		Test{
+			Name:   "comments:CreateProject",
+			Pre:    addUsers,
+			Method: "POST", URL: projectsUrl, Status: http.StatusCreated,
+			BodyFunc: func() string { return `{"Name":"Test Project"}` },
+			CheckBody: func(dec *json.Decoder) error {
+				return getCreatedId(dec, &projectIds)
+			},
+		},
+		Test{
+			Name:   "comments:AddClient",
+			Method: "POST", URLFunc: func() string { return projectUrl() + "/clients" },
+			Status:   http.StatusCreated,
+			BodyFunc: func() string { return `{"Name":"` + client1User + `"}` },
+		},
+		Test{
+			Name:   "comments:CreateDeliverable",
+			Method: "POST", URLFunc: func() string { return projectUrl() + "/deliverables" },
+			Status: http.StatusCreated,
+			BodyFunc: func() string {
+				return `{"Name":"A", "Description":"A", "Due":"2018-01-01T00:00:00Z"}`
+			},
+			CheckBody: func(dec *json.Decoder) error {
+				return getCreatedId(dec, &deliverableIds)
+			},
+		},
+
+		// Comments on the project.
+		Test{
+			Name:   "comments:Create",
+			Method: "POST", URLFunc: commentsUrl, Status: http.StatusCreated,
+			BodyFunc:  body("First", -1),
+			CheckBody: getId,
+		},
+		Test{
+			Name:   "comments:CreateEmpty",
+			Method: "POST", URLFunc: commentsUrl, Status: http.StatusBadRequest,
+			BodyFunc:  body("", -1),
+			CheckBody: checkProblem(http.StatusBadRequest, "invalid_body", "Body"),
+		},
+		Test{
+			Name:   "comments:CreateAsViewer",
+			Method: "POST", URLFunc: commentsUrl, Status: http.StatusForbidden,
+			BodyFunc: body("Reply", 0),
+			SetAuth:  setClientAuth,
+		},
+		Test{
+			Name:   "comments:ListAsViewer",
+			Method: "GET", URLFunc: commentsUrl, Status: http.StatusOK,
+			CheckBody: checkComments(comment{0, defaultUser, "First"}),
+			SetAuth:   setClientAuth,
+		},
+		Test{
+			Name:   "comments:MakeCommenter",
+			Method: "PUT", Status: http.StatusOK,
+			URLFunc: func() string {
+				return fmt.Sprintf("%s/clients/%s", projectUrl(), clientId(client1User))
+			},
+			BodyFunc: func() string { return `{"Role":"commenter"}` },
+		},
+		Test{
+			Name:   "comments:Reply",
+			Method: "POST", URLFunc: commentsUrl, Status: http.StatusCreated,
+			BodyFunc:  body("Reply", 0),
+			CheckBody: getId,
+			SetAuth:   setClientAuth,
+		},
+		Test{
+			Name:   "comments:ReplyToReply",
+			Method: "POST", URLFunc: commentsUrl, Status: http.StatusCreated,
+			BodyFunc:  body("Reply to reply", 1),
+			CheckBody: getId,
+		},
+		Test{
+			Name:   "comments:CreateSecondThread",
+			Method: "POST", URLFunc: commentsUrl, Status: http.StatusCreated,
+			BodyFunc:  body("Second", -1),
+			CheckBody: getId,
+			SetAuth:   setClientAuth,
+		},
+		Test{
+			Name:   "comments:ReplyToMissing",
+			Method: "POST", URLFunc: commentsUrl, Status: http.StatusBadRequest,
+			BodyFunc: func() string { return `{"Body":"Reply", "Parent":1}` },
+			CheckBody: checkProblem(http.StatusBadRequest, "invalid_body",
+				"Parent"),
+		},
+
+		// Only the author can edit a comment.
+		Test{
+			Name:   "comments:Edit",
+			Method: "PUT", URLFunc: commentUrl(1), Status: http.StatusOK,
+			BodyFunc: body("Edited", -1),
+			CheckBody: func(dec *json.Decoder) error {
+				return checkComments(comment{commentIds[0], client1User, "Edited"})(dec)
+			},
+			SetAuth: setClientAuth,
+		},
+		Test{
+			Name:   "comments:Patch",
+			Method: "PATCH", URLFunc: commentUrl(1), Status: http.StatusOK,
+			BodyFunc: body("Patched", -1),
+			SetAuth:  setClientAuth,
+		},
+		Test{
+			Name:   "comments:PatchParent",
+			Method: "PATCH", URLFunc: commentUrl(1), Status: http.StatusBadRequest,
+			BodyFunc: func() string { return `{"Parent":0}` },
+			SetAuth:  setClientAuth,
+		},
+		Test{
+			Name:   "comments:EditAsOwner",
+			Method: "PUT", URLFunc: commentUrl(1), Status: http.StatusForbidden,
+			BodyFunc: body("Edited", -1),
+		},
+		Test{
+			Name:   "comments:DeleteOthers",
+			Method: "DELETE", URLFunc: commentUrl(0), Status: http.StatusForbidden,
+			SetAuth: setClientAuth,
+		},
+		Test{
+			Name:   "comments:List",
+			Method: "GET", URLFunc: commentsUrl, Status: http.StatusOK,
+			CheckBody: func(dec *json.Decoder) error {
+				return checkComments(
+					comment{0, defaultUser, "First"},
+					comment{commentIds[0], client1User, "Patched"},
+					comment{commentIds[1], defaultUser, "Reply to reply"},
+					comment{0, client1User, "Second"},
+				)(dec)
+			},
+		},
+
+		// Comments on deliverables are separate threads.
+		Test{
+			Name:   "comments:CreateOnDeliverable",
+			Method: "POST", URLFunc: deliverableCommentsUrl, Status: http.StatusCreated,
+			BodyFunc:  body("On the deliverable", -1),
+			CheckBody: getId,
+			SetAuth:   setClientAuth,
+		},
+		Test{
+			Name:   "comments:ReplyAcrossThreads",
+			Method: "POST", URLFunc: deliverableCommentsUrl, Status: http.StatusBadRequest,
+			BodyFunc: body("Reply", 0),
+			CheckBody: checkProblem(http.StatusBadRequest, "invalid_body",
+				"Parent"),
+		},
+		Test{
+			Name:   "comments:ListDeliverable",
+			Method: "GET", URLFunc: deliverableCommentsUrl, Status: http.StatusOK,
+			CheckBody: checkComments(comment{0, client1User, "On the deliverable"}),
+		},
+		Test{
+			Name:   "comments:GetOnWrongThread",
+			Method: "GET", URLFunc: commentUrl(4), Status: http.StatusNotFound,
+		},
+		Test{
+			Name:   "comments:GetOnDeliverable",
+			Method: "GET", Status: http.StatusOK,
+			URLFunc: func() string {
+				return fmt.Sprintf("%s/%d", deliverableCommentsUrl(), commentIds[4])
+			},
+			CheckBody: checkComments(comment{0, client1User, "On the deliverable"}),
+		},
+
+		// Comments are included in the changes feed.
+		Test{
+			Name:   "comments:Feed",
+			Method: "GET", URL: "/sync", Status: http.StatusOK,
+			CheckBody: func(dec *json.Decoder) error {
+				f := struct {
+					Changes []struct{ Kind, Path string }
+				}{}
+				err := dec.Decode(&f)
+				if err != nil {
+					return err
+				}
+				n := 0
+				for _, c := range f.Changes {
+					if c.Kind == "comment" {
+						n++
+					}
+				}
+				if n != 5 {
+					return fmt.Errorf("Expected 5 comments, got %+v", f.Changes)
+				}
+				return nil
+			},
+		},
+
+		// Deleting a comment deletes the replies; owners can delete anything.
+		Test{
+			Name:   "comments:DeleteThread",
+			Method: "DELETE", URLFunc: commentUrl(0), Status: http.StatusOK,
+		},
+		Test{
+			Name:   "comments:GetDeletedReply",
+			Method: "GET", URLFunc: commentUrl(2), Status: http.StatusNotFound,
+		},
+		Test{
+			Name:   "comments:ListAfterDelete",
+			Method: "GET", URLFunc: commentsUrl, Status: http.StatusOK,
+			CheckBody: checkComments(comment{0, client1User, "Second"}),
+		},
+		Test{
+			Name:   "comments:DeleteOwn",
+			Method: "DELETE", URLFunc: commentUrl(3), Status: http.StatusOK,
+			SetAuth: setClientAuth,
+		},
+		Test{
+			Name:   "comments:DeleteDeliverable",
+			Method: "DELETE", URLFunc: deliverableUrl, Status: http.StatusOK,
+		},
+		Test{
+			Name:   "comments:ListDeletedDeliverable",
+			Method: "GET", URLFunc: deliverableCommentsUrl, Status: http.StatusNotFound,
+		},
+	}
+}
+
+// vim: sw=4 ts=4 noexpandtab
@@ -0,0 +1,102 @@
+/*
+Tests for the database administration functions.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package tests
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/mel-app/backend/src"
+)
+
+func TestMigrations(t *testing.T) {
+	t.Parallel()
+	_, db := newServer(t)
+
+	latest, err := backend.LatestVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkVersion := func(expected int) {
+		t.Helper()
+		version, err := db.Version()
+		if err != nil {
+			t.Fatal(err)
+		} else if version != expected {
+			t.Fatalf("Expected version %d, got %d", expected, version)
+		}
+	}
+
+	checkVersion(latest)
+	err = db.MigrateTo(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(0)
+	err = db.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(latest)
+	// Migrating again should be a no-op.
+	err = db.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(latest)
+}
+
+func TestUnknownUser(t *testing.T) {
+	t.Parallel()
+	_, db := newServer(t)
+
+	err := db.SetIsManager("nobody", true)
+	if err == nil {
+		t.Fatal("Expected an error promoting an unknown user")
+	}
+	err = db.DeleteUser("nobody")
+	if err == nil {
+		t.Fatal("Expected an error deleting an unknown user")
+	}
+	err = db.AddUser("somebody", "password", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.DeleteUser("somebody")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.DeleteUser("somebody")
+	if err == nil {
+		t.Fatal("Expected an error deleting a user twice")
+	}
+}
+
+func TestSeedDemo(t *testing.T) {
+	runSuite(t, []Test{
+		Test{
+			Name:   "demo:Seed",
+			Pre:    func(db backend.DB) error { return db.SeedDemo() },
+			Method: "GET", URL: "/projects/0", Status: http.StatusOK,
+			SetAuth: func(r *http.Request) { r.SetBasicAuth("beth", "test") },
+		},
+		Test{
+			Name:   "demo:Client",
+			Method: "GET", URL: "/projects/1", Status: http.StatusOK,
+			SetAuth: func(r *http.Request) { r.SetBasicAuth("ben", "test") },
+		},
+		Test{
+			Name:   "demo:DeleteUser",
+			Pre:    func(db backend.DB) error { return db.DeleteUser("beth") },
+			Method: "GET", URL: "/projects/0", Status: http.StatusForbidden,
+			SetAuth: func(r *http.Request) { r.SetBasicAuth("ben", "test") },
+		},
+	})
+}
+
+// vim: sw=4 ts=4 noexpandtab
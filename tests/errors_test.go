@@ -0,0 +1,189 @@
+/*
+Tests for the error responses.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestErrors(t *testing.T) {
+	runSuite(t, errorsTests())
+}
+
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+type problem struct {
+	Type   string       `json:"type"`
+	Title  string       `json:"title"`
+	Status int          `json:"status"`
+	Detail string       `json:"detail"`
+	Code   string       `json:"code"`
+	Errors []fieldError `json:"errors"`
+}
+
+// checkProblemType checks that the response is a problem.
+func checkProblemType(header http.Header) error {
+	if t := header.Get("Content-Type"); t != "application/problem+json" {
+		return fmt.Errorf("Expected a problem, got %s", t)
+	}
+	return nil
+}
+
+// checkProblem returns a CheckBody function checking the problem code and
+// the names of any invalid fields.
+func checkProblem(status int, code string, fields ...string) func(*json.Decoder) error {
+	return func(dec *json.Decoder) error {
+		p := problem{}
+		err := dec.Decode(&p)
+		if err != nil {
+			return err
+		}
+		if p.Status != status || p.Code != code || p.Title != http.StatusText(status) {
+			return fmt.Errorf("Expected a %d %s problem, got %+v", status, code, p)
+		}
+		got := []string{}
+		for _, f := range p.Errors {
+			got = append(got, f.Field)
+		}
+		if len(fields) == 0 {
+			fields = []string{}
+		}
+		if !reflect.DeepEqual(got, fields) {
+			return fmt.Errorf("Expected invalid fields %v, got %+v", fields, p)
+		}
+		return nil
+	}
+}
+
+// errorsTests returns the tests for error responses.
+func errorsTests() []Test {
+	projectIds := []uint{}
+	projectUrl := func() string {
+		return fmt.Sprintf("%s/%d", projectsUrl, projectIds[0])
+	}
+
+	return []Test{
+		Test{
+			Name:   "errors:Unauthorized",
+			Pre:    addUsers,
+			Method: "GET", URL: projectsUrl, Status: http.StatusUnauthorized,
+			SetAuth:     setNilAuth,
+			CheckHeader: checkProblemType,
+			CheckBody:   checkProblem(http.StatusUnauthorized, "unauthorized"),
+		},
+		Test{
+			Name:   "errors:InvalidPassword",
+			Method: "GET", URL: projectsUrl, Status: http.StatusForbidden,
+			SetAuth:   func(r *http.Request) { r.SetBasicAuth(defaultUser, "wrong") },
+			CheckBody: checkProblem(http.StatusForbidden, "access_denied"),
+		},
+		Test{
+			Name:   "errors:NotFound",
+			Method: "GET", URL: "/nonexistent", Status: http.StatusNotFound,
+			CheckHeader: checkProblemType,
+			CheckBody:   checkProblem(http.StatusNotFound, "not_found"),
+		},
+		Test{
+			Name:   "errors:InvalidMethod",
+			Method: "PUT", URL: projectsUrl, Status: http.StatusMethodNotAllowed,
+			CheckHeader: checkProblemType,
+			CheckBody:   checkProblem(http.StatusMethodNotAllowed, "invalid_method"),
+		},
+		Test{
+			Name:   "errors:InvalidJSON",
+			Method: "POST", URL: projectsUrl, Status: http.StatusBadRequest,
+			BodyFunc:  func() string { return `{"Name":` },
+			CheckBody: checkProblem(http.StatusBadRequest, "invalid_body"),
+		},
+		Test{
+			Name:   "errors:InvalidFields",
+			Method: "POST", URL: projectsUrl, Status: http.StatusBadRequest,
+			BodyFunc: func() string {
+				return `{"Name":"", "Percentage":101, "Updated":"2017-12-19"}`
+			},
+			CheckHeader: checkProblemType,
+			CheckBody: checkProblem(http.StatusBadRequest, "invalid_body",
+				"Name", "Percentage"),
+		},
+		Test{
+			Name:   "errors:Create",
+			Method: "POST", URL: projectsUrl, Status: http.StatusCreated,
+			BodyFunc: func() string {
+				return `{"Name":"A", "Updated":"2017-12-19"}`
+			},
+			CheckBody: func(dec *json.Decoder) error {
+				return getCreatedId(dec, &projectIds)
+			},
+		},
+		Test{
+			Name:   "errors:NewerVersion",
+			Method: "PUT", URLFunc: projectUrl, Status: http.StatusBadRequest,
+			BodyFunc: func() string {
+				return fmt.Sprintf(`{"Id":%d, "Version":5, "Name":"A", "Updated":"2017-12-19"}`,
+					projectIds[0])
+			},
+			CheckBody: checkProblem(http.StatusBadRequest, "invalid_body",
+				"Version"),
+		},
+		Test{
+			Name:   "errors:Forbidden",
+			Method: "GET", URLFunc: projectUrl, Status: http.StatusForbidden,
+			SetAuth:   setClientAuth,
+			CheckBody: checkProblem(http.StatusForbidden, "access_denied"),
+		},
+		Test{
+			Name:   "errors:LastOwner",
+			Method: "DELETE", URLFunc: func() string {
+				return fmt.Sprintf("%s/clients/%s", projectUrl(), clientId(defaultUser))
+			},
+			Status:    http.StatusConflict,
+			CheckBody: checkProblem(http.StatusConflict, "last_owner"),
+		},
+		Test{
+			Name:   "errors:UnknownRole",
+			Method: "POST", URLFunc: func() string {
+				return fmt.Sprintf("%s/clients", projectUrl())
+			},
+			Status: http.StatusBadRequest,
+			BodyFunc: func() string {
+				return `{"Name":"` + client1User + `", "Role":"admin"}`
+			},
+			CheckBody: checkProblem(http.StatusBadRequest, "invalid_body", "Role"),
+		},
+		Test{
+			// Failed operations in a batch include the problem.
+			Name:   "errors:Batch",
+			Method: "POST", URL: batchUrl, Status: http.StatusOK,
+			BodyFunc: func() string {
+				return fmt.Sprintf(`[{"Method":"PATCH", "Path":%q, "Body":{"Id":1}}]`,
+					projectUrl())
+			},
+			CheckBody: func(dec *json.Decoder) error {
+				results := []struct{ Error problem }{}
+				err := dec.Decode(&results)
+				if err != nil {
+					return err
+				}
+				if len(results) != 1 || results[0].Error.Code != "invalid_body" ||
+					len(results[0].Error.Errors) != 1 {
+					return fmt.Errorf("Expected an invalid body, got %+v", results)
+				}
+				return nil
+			},
+		},
+	}
+}
+
+// vim: sw=4 ts=4 noexpandtab
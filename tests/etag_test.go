@@ -0,0 +1,196 @@
+/*
+Tests for conditional requests using ETags.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestETags(t *testing.T) {
+	runSuite(t, etagTests())
+}
+
+// saveETag returns a CheckHeader function saving the ETag in etag.
+func saveETag(etag *string) func(http.Header) error {
+	return func(header http.Header) error {
+		*etag = header.Get("ETag")
+		if *etag == "" {
+			return fmt.Errorf("Expected an ETag")
+		}
+		return nil
+	}
+}
+
+// checkETagChanged returns a CheckHeader function checking that the ETag is
+// different to the given one, and saving the new ETag.
+func checkETagChanged(etag *string) func(http.Header) error {
+	return func(header http.Header) error {
+		old := *etag
+		err := saveETag(etag)(header)
+		if err == nil && *etag == old {
+			err = fmt.Errorf("Expected the ETag %s to change", old)
+		}
+		return err
+	}
+}
+
+// withHeader returns a HeaderFunc setting the given header to the value.
+func withHeader(name string, value *string) func() http.Header {
+	return func() http.Header {
+		header := http.Header{}
+		header.Set(name, *value)
+		return header
+	}
+}
+
+// etagTests returns the tests for conditional requests.
+func etagTests() []Test {
+	projectIds := []uint{}
+	projectEtag := ""
+	listEtag := ""
+	flagEtag := ""
+	staleEtag := ""
+	anyEtag := "*"
+	projectUrl := func() string {
+		return fmt.Sprintf("%s/%d", projectsUrl, projectIds[0])
+	}
+	flagUrl := func() string {
+		return fmt.Sprintf("%s/flag", projectUrl())
+	}
+	projectBody := func() string {
+		return fmt.Sprintf(`{"Id":%d, "Name":"B", "Updated":"2017-12-19T00:00:00Z"}`,
+			projectIds[0])
+	}
+
+	return []Test{
+		Test{
+			Name:   "etag:Create",
+			Pre:    addUsers,
+			Method: "POST", URL: projectsUrl, Status: http.StatusCreated,
+			BodyFunc: func() string {
+				return `{"Name":"A", "Updated":"2017-12-19T00:00:00Z"}`
+			},
+			CheckBody: func(dec *json.Decoder) error {
+				return getCreatedId(dec, &projectIds)
+			},
+		},
+
+		// Lists.
+		Test{
+			Name:   "etag:GetList",
+			Method: "GET", URL: projectsUrl, Status: http.StatusOK,
+			CheckHeader: saveETag(&listEtag),
+		},
+		Test{
+			Name:   "etag:ListNotModified",
+			Method: "GET", URL: projectsUrl, Status: http.StatusNotModified,
+			HeaderFunc: withHeader("If-None-Match", &listEtag),
+		},
+
+		// Items.
+		Test{
+			Name:   "etag:Get",
+			Method: "GET", URLFunc: projectUrl, Status: http.StatusOK,
+			CheckHeader: saveETag(&projectEtag),
+		},
+		Test{
+			Name:   "etag:NotModified",
+			Method: "GET", URLFunc: projectUrl, Status: http.StatusNotModified,
+			HeaderFunc: withHeader("If-None-Match", &projectEtag),
+		},
+		Test{
+			Name:   "etag:PutIfMatch",
+			Method: "PUT", URLFunc: projectUrl, Status: http.StatusOK,
+			HeaderFunc: withHeader("If-Match", &projectEtag),
+			BodyFunc:   projectBody,
+		},
+		Test{
+			Name:   "etag:Modified",
+			Method: "GET", URLFunc: projectUrl, Status: http.StatusOK,
+			HeaderFunc: withHeader("If-None-Match", &projectEtag),
+			CheckHeader: func(header http.Header) error {
+				staleEtag = projectEtag
+				return checkETagChanged(&projectEtag)(header)
+			},
+		},
+		Test{
+			Name:   "etag:PutStale",
+			Method: "PUT", URLFunc: projectUrl,
+			Status:     http.StatusPreconditionFailed,
+			HeaderFunc: withHeader("If-Match", &staleEtag),
+			BodyFunc:   projectBody,
+		},
+		Test{
+			Name:   "etag:PatchStale",
+			Method: "PATCH", URLFunc: projectUrl,
+			Status:     http.StatusPreconditionFailed,
+			HeaderFunc: withHeader("If-Match", &staleEtag),
+			BodyFunc:   func() string { return `{"Name":"C"}` },
+		},
+		Test{
+			Name:   "etag:DeleteStale",
+			Method: "DELETE", URLFunc: projectUrl,
+			Status:     http.StatusPreconditionFailed,
+			HeaderFunc: withHeader("If-Match", &staleEtag),
+		},
+		Test{
+			Name:   "etag:DeleteIfNoneMatch",
+			Method: "DELETE", URLFunc: projectUrl,
+			Status:     http.StatusPreconditionFailed,
+			HeaderFunc: withHeader("If-None-Match", &anyEtag),
+		},
+		Test{
+			Name:   "etag:CheckNotDeleted",
+			Method: "GET", URLFunc: projectUrl, Status: http.StatusNotModified,
+			HeaderFunc: withHeader("If-None-Match", &projectEtag),
+		},
+
+		// The flag.
+		Test{
+			Name:   "etag:GetFlag",
+			Method: "GET", URLFunc: flagUrl, Status: http.StatusOK,
+			CheckHeader: saveETag(&flagEtag),
+		},
+		Test{
+			Name:   "etag:PutFlag",
+			Method: "PUT", URLFunc: flagUrl, Status: http.StatusOK,
+			HeaderFunc: withHeader("If-Match", &flagEtag),
+			BodyFunc:   func() string { return `{"Version":0, "Value":true}` },
+		},
+		Test{
+			Name:   "etag:PutFlagStale",
+			Method: "PUT", URLFunc: flagUrl,
+			Status:     http.StatusPreconditionFailed,
+			HeaderFunc: withHeader("If-Match", &flagEtag),
+			BodyFunc:   func() string { return `{"Version":1, "Value":false}` },
+		},
+		Test{
+			// The list only changes when projects are added or removed.
+			Name:   "etag:ListUnchanged",
+			Method: "GET", URL: projectsUrl, Status: http.StatusNotModified,
+			HeaderFunc: withHeader("If-None-Match", &listEtag),
+		},
+		Test{
+			// Changing the flag changes the project's tree version.
+			Name:   "etag:ModifiedByFlag",
+			Method: "GET", URLFunc: projectUrl, Status: http.StatusOK,
+			HeaderFunc:  withHeader("If-None-Match", &projectEtag),
+			CheckHeader: checkETagChanged(&projectEtag),
+		},
+		Test{
+			Name:   "etag:DeleteIfMatch",
+			Method: "DELETE", URLFunc: projectUrl, Status: http.StatusOK,
+			HeaderFunc: withHeader("If-Match", &projectEtag),
+		},
+	}
+}
+
+// vim: sw=4 ts=4 noexpandtab
@@ -0,0 +1,249 @@
+/*
+Tests for the event streams.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package tests
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sseEvent is a single event from an event stream.
+type sseEvent struct {
+	Id    string
+	Event string
+	Data  feedEntry
+}
+
+// openEvents opens the event stream at the given path, and returns a
+// channel receiving each event.
+// The channel is closed when the stream ends.
+func openEvents(t *testing.T, root, path, lastId string, setAuth func(*http.Request)) <-chan sseEvent {
+	req, err := http.NewRequest("GET", root+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setAuth(req)
+	if lastId != "" {
+		req.Header.Set("Last-Event-ID", lastId)
+	}
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { response.Body.Close() })
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %s", response.Status)
+	}
+	if ct := response.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %s", ct)
+	}
+
+	events := make(chan sseEvent, 100)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(response.Body)
+		e := sseEvent{}
+		for scanner.Scan() {
+			line := scanner.Text()
+			field, value, _ := strings.Cut(line, ": ")
+			switch field {
+			case "id":
+				e.Id = value
+			case "event":
+				e.Event = value
+			case "data":
+				if json.Unmarshal([]byte(value), &e.Data) != nil {
+					return
+				}
+			case "":
+				if e.Event != "" {
+					events <- e
+				}
+				e = sseEvent{}
+			}
+		}
+	}()
+	return events
+}
+
+// nextEvent returns the next event from the stream, failing if there are
+// none within a few seconds.
+func nextEvent(t *testing.T, events <-chan sseEvent) sseEvent {
+	t.Helper()
+	select {
+	case e, ok := <-events:
+		if !ok {
+			t.Fatalf("The stream ended unexpectedly")
+		}
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for an event")
+	}
+	return sseEvent{}
+}
+
+// expectEvent checks that the next event is for the given path.
+func expectEvent(t *testing.T, events <-chan sseEvent, kind, path string) sseEvent {
+	t.Helper()
+	e := nextEvent(t, events)
+	if e.Event != kind || e.Data.Kind != kind || e.Data.Path != path {
+		t.Fatalf("Expected a %s event for %s, got %+v", kind, path, e)
+	}
+	return e
+}
+
+// expectEnd checks that the stream ends.
+func expectEnd(t *testing.T, events <-chan sseEvent) {
+	t.Helper()
+	select {
+	case e, ok := <-events:
+		if ok {
+			t.Fatalf("Expected the stream to end, got %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the stream to end")
+	}
+}
+
+func TestEvents(t *testing.T) {
+	t.Parallel()
+	server, db := newServer(t)
+	run := func(test Test) {
+		t.Helper()
+		err := runTest(test, server.URL, db)
+		if err != nil {
+			t.Fatalf("%s: %s", test.Name, err)
+		}
+	}
+	setAuth := func(r *http.Request) { r.SetBasicAuth(defaultUser, defaultPassword) }
+
+	projectIds := []uint{}
+	deliverableIds := []uint{}
+	run(Test{
+		Name: "CreateProject", Pre: addUsers,
+		Method: "POST", URL: projectsUrl, Status: http.StatusCreated,
+		BodyFunc: func() string { return `{"Name":"A"}` },
+		CheckBody: func(dec *json.Decoder) error {
+			return getCreatedId(dec, &projectIds)
+		},
+	})
+	projectUrl := fmt.Sprintf("%s/%d", projectsUrl, projectIds[0])
+	flagUrl := projectUrl + "/flag"
+	events := openEvents(t, server.URL, "/events", "", setAuth)
+	projectEvents := openEvents(t, server.URL, projectUrl+"/events", "", setAuth)
+
+	// Changes are pushed to both streams.
+	run(Test{
+		Name:   "SetFlag",
+		Method: "PUT", URL: flagUrl, Status: http.StatusOK,
+		BodyFunc: func() string { return `{"Version":0, "Value":true}` },
+	})
+	first := expectEvent(t, events, "flag", flagUrl)
+	if first.Id == "" {
+		t.Fatalf("Expected an event id")
+	}
+	expectEvent(t, projectEvents, "flag", flagUrl)
+	run(Test{
+		Name:   "CreateDeliverable",
+		Method: "POST", URL: projectUrl + "/deliverables", Status: http.StatusCreated,
+		BodyFunc: func() string {
+			return `{"Name":"A", "Description":"A", "Due":"2018-01-01T00:00:00Z"}`
+		},
+		CheckBody: func(dec *json.Decoder) error {
+			return getCreatedId(dec, &deliverableIds)
+		},
+	})
+	deliverableUrl := fmt.Sprintf("%s/deliverables/%d", projectUrl, deliverableIds[0])
+	expectEvent(t, events, "deliverable", deliverableUrl)
+	expectEvent(t, projectEvents, "deliverable", deliverableUrl)
+
+	// Reconnecting with the last event id resumes after that event.
+	resumed := openEvents(t, server.URL, "/events", first.Id, setAuth)
+	expectEvent(t, resumed, "deliverable", deliverableUrl)
+
+	// Other users can't see the project until they are added.
+	run(Test{
+		Name:   "ProjectEventsAsClientForbidden",
+		Method: "GET", URL: projectUrl + "/events", Status: http.StatusForbidden,
+		SetAuth: setClientAuth,
+	})
+	clientEvents := openEvents(t, server.URL, "/events", "", setClientAuth)
+	run(Test{
+		Name:   "SetFlagAgain",
+		Method: "PUT", URL: flagUrl, Status: http.StatusOK,
+		BodyFunc: func() string { return `{"Version":1, "Value":false}` },
+	})
+	expectEvent(t, events, "flag", flagUrl)
+	expectEvent(t, projectEvents, "flag", flagUrl)
+
+	// Joining a project sends the whole project.
+	run(Test{
+		Name:   "AddClient",
+		Method: "POST", URL: projectUrl + "/clients", Status: http.StatusCreated,
+		BodyFunc: func() string { return `{"Name":"` + client1User + `"}` },
+	})
+	clientPath := fmt.Sprintf("%s/clients/%s", projectUrl, clientId(client1User))
+	expectEvent(t, events, "membership", clientPath)
+	expectEvent(t, projectEvents, "membership", clientPath)
+	expectEvent(t, clientEvents, "project", projectUrl)
+	expectEvent(t, clientEvents, "flag", flagUrl)
+	expectEvent(t, clientEvents, "membership", clientPath)
+	last := expectEvent(t, clientEvents, "deliverable", deliverableUrl)
+	if last.Id == "" {
+		t.Fatalf("Expected the last event in the project to have an id")
+	}
+
+	// Project streams end when the project is deleted.
+	run(Test{
+		Name:   "DeleteProject",
+		Method: "DELETE", URL: projectUrl + "?scope=everyone", Status: http.StatusOK,
+	})
+	e := expectEvent(t, projectEvents, "project", projectUrl)
+	if !e.Data.Deleted {
+		t.Fatalf("Expected a tombstone, got %+v", e)
+	}
+	expectEnd(t, projectEvents)
+	e = expectEvent(t, clientEvents, "project", projectUrl)
+	if !e.Data.Deleted {
+		t.Fatalf("Expected a tombstone, got %+v", e)
+	}
+}
+
+func TestEventsErrors(t *testing.T) {
+	runSuite(t, []Test{
+		Test{
+			Name:   "events:Unauthorized",
+			Pre:    addUsers,
+			Method: "GET", URL: "/events", Status: http.StatusUnauthorized,
+			SetAuth: setNilAuth,
+		},
+		Test{
+			Name:   "events:InvalidMethod",
+			Method: "POST", URL: "/events", Status: http.StatusMethodNotAllowed,
+		},
+		Test{
+			Name:   "events:InvalidId",
+			Method: "GET", URL: "/events?lastEventId=x", Status: http.StatusBadRequest,
+		},
+		Test{
+			Name:   "events:FutureId",
+			Method: "GET", URL: "/events?lastEventId=1000", Status: http.StatusBadRequest,
+		},
+		Test{
+			Name:   "events:NoSuchProject",
+			Method: "GET", URL: "/projects/1/events", Status: http.StatusForbidden,
+		},
+	})
+}
+
+// vim: sw=4 ts=4 noexpandtab
@@ -0,0 +1,356 @@
+/*
+Tests for the sync (changes feed) endpoint.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestFeed(t *testing.T) {
+	runSuite(t, feedTests())
+}
+
+type feedEntry struct {
+	Kind    string
+	Path    string
+	Deleted bool
+	Item    json.RawMessage
+}
+
+type feed struct {
+	Cursor  uint
+	Changes []feedEntry
+}
+
+// checkFeed returns a CheckBody function checking that the feed contains
+// exactly the given paths, in order, with deleted paths prefixed by "-".
+// The new cursor is saved in cursor.
+func checkFeed(cursor *uint, paths ...func() string) func(*json.Decoder) error {
+	return func(dec *json.Decoder) error {
+		f := feed{}
+		err := dec.Decode(&f)
+		if err != nil {
+			return err
+		}
+		got := []string{}
+		for _, c := range f.Changes {
+			path := c.Path
+			if c.Deleted {
+				path = "-" + path
+				if len(c.Item) != 0 {
+					return fmt.Errorf("Expected no item for %s", path)
+				}
+			} else if len(c.Item) == 0 {
+				return fmt.Errorf("Expected an item for %s", path)
+			}
+			got = append(got, path)
+		}
+		if len(got) != len(paths) {
+			return fmt.Errorf("Expected %d changes, got %v", len(paths), got)
+		}
+		for i, path := range paths {
+			if got[i] != path() {
+				return fmt.Errorf("Expected %s, got %v", path(), got)
+			}
+		}
+		if f.Cursor < *cursor {
+			return fmt.Errorf("Cursor went backwards from %d to %d", *cursor, f.Cursor)
+		}
+		*cursor = f.Cursor
+		return nil
+	}
+}
+
+// feedTests returns the tests for the changes feed.
+// The manager and the client keep separate cursors, as separate devices
+// would.
+func feedTests() []Test {
+	projectIds := []uint{}
+	deliverableIds := []uint{}
+	managerCursor := uint(0)
+	clientCursor := uint(0)
+	since := func(cursor *uint) func() string {
+		return func() string { return fmt.Sprintf("/sync?since=%d", *cursor) }
+	}
+
+	projectPath := func() string {
+		return fmt.Sprintf("%s/%d", projectsUrl, projectIds[0])
+	}
+	flagPath := func() string { return projectPath() + "/flag" }
+	clientPath := func(name string) func() string {
+		return func() string {
+			return fmt.Sprintf("%s/clients/%s", projectPath(), clientId(name))
+		}
+	}
+	deliverablePath := func(i int) func() string {
+		return func() string {
+			return fmt.Sprintf("%s/deliverables/%d", projectPath(), deliverableIds[i])
+		}
+	}
+	deleted := func(path func() string) func() string {
+		return func() string { return "-" + path() }
+	}
+	deliverableBody := func() string {
+		return `{"Name":"Deliverable", "Description":"Deliverable", "Updated":"2017-12-19", "Due":"2018-01-01T00:00:00Z"}`
+	}
+
+	return []Test{
+		Test{
+			Name:   "feed:Empty",
+			Pre:    addUsers,
+			Method: "GET", URL: "/sync", Status: http.StatusOK,
+			CheckBody: checkFeed(&managerCursor),
+		},
+		Test{
+			Name:   "feed:CreateProject",
+			Method: "POST", URL: projectsUrl, Status: http.StatusCreated,
+			BodyFunc: func() string {
+				return `{"Name":"Test Project", "Updated":"2017-12-19"}`
+			},
+			CheckBody: func(dec *json.Decoder) error {
+				return getCreatedId(dec, &projectIds)
+			},
+		},
+		Test{
+			Name:   "feed:Initial",
+			Method: "GET", URL: "/sync", Status: http.StatusOK,
+			CheckBody: checkFeed(&managerCursor, projectPath, flagPath,
+				clientPath(defaultUser)),
+		},
+		Test{
+			Name:   "feed:Unchanged",
+			Method: "GET", URLFunc: since(&managerCursor), Status: http.StatusOK,
+			CheckBody: checkFeed(&managerCursor),
+		},
+		Test{
+			Name:   "feed:Future",
+			Method: "GET", URL: "/sync?since=1000000", Status: http.StatusBadRequest,
+		},
+		Test{
+			Name:   "feed:Invalid",
+			Method: "GET", URL: "/sync?since=x", Status: http.StatusBadRequest,
+		},
+		Test{
+			Name:   "feed:CreateDeliverable",
+			Method: "POST", URLFunc: func() string {
+				return projectPath() + "/deliverables"
+			},
+			Status:   http.StatusCreated,
+			BodyFunc: deliverableBody,
+			CheckBody: func(dec *json.Decoder) error {
+				return getCreatedId(dec, &deliverableIds)
+			},
+		},
+		Test{
+			Name:   "feed:SetFlag",
+			Method: "PUT", URLFunc: flagPath, Status: http.StatusOK,
+			BodyFunc: func() string { return `{"Version":0, "Value":true}` },
+		},
+		Test{
+			Name:   "feed:Changed",
+			Method: "GET", URLFunc: since(&managerCursor), Status: http.StatusOK,
+			CheckBody: checkFeed(&managerCursor, deliverablePath(0), flagPath),
+		},
+		Test{
+			Name:   "feed:DeleteDeliverable",
+			Method: "DELETE", URLFunc: deliverablePath(0), Status: http.StatusOK,
+		},
+		Test{
+			Name:   "feed:Deleted",
+			Method: "GET", URLFunc: since(&managerCursor), Status: http.StatusOK,
+			CheckBody: checkFeed(&managerCursor, deleted(deliverablePath(0))),
+		},
+
+		// The client sees nothing until they are added, and then gets the
+		// whole project, bar the other members.
+		Test{
+			Name:   "feed:ClientEmpty",
+			Method: "GET", URL: "/sync", Status: http.StatusOK,
+			SetAuth:   setClientAuth,
+			CheckBody: checkFeed(&clientCursor),
+		},
+		Test{
+			Name:   "feed:AddClient",
+			Method: "POST", URLFunc: func() string {
+				return projectPath() + "/clients"
+			},
+			Status:   http.StatusCreated,
+			BodyFunc: func() string { return `{"Name":"` + client1User + `"}` },
+		},
+		Test{
+			Name:   "feed:ClientAdded",
+			Method: "GET", URLFunc: since(&clientCursor), Status: http.StatusOK,
+			SetAuth: setClientAuth,
+			CheckBody: checkFeed(&clientCursor, projectPath, flagPath,
+				clientPath(client1User)),
+		},
+		Test{
+			Name:   "feed:ManagerSeesClient",
+			Method: "GET", URLFunc: since(&managerCursor), Status: http.StatusOK,
+			CheckBody: checkFeed(&managerCursor, clientPath(client1User)),
+		},
+
+		// Deleting the project leaves tombstones for everyone.
+		Test{
+			Name:   "feed:DeleteProject",
+			Method: "DELETE", URLFunc: func() string {
+				return projectPath() + "?scope=everyone"
+			},
+			Status: http.StatusOK,
+		},
+		Test{
+			Name:   "feed:ManagerDeleted",
+			Method: "GET", URLFunc: since(&managerCursor), Status: http.StatusOK,
+			CheckBody: checkFeed(&managerCursor, deleted(projectPath)),
+		},
+		Test{
+			Name:   "feed:ClientDeleted",
+			Method: "GET", URLFunc: since(&clientCursor), Status: http.StatusOK,
+			SetAuth:   setClientAuth,
+			CheckBody: checkFeed(&clientCursor, deleted(projectPath)),
+		},
+		Test{
+			Name:   "feed:ClientDeletedFromScratch",
+			Method: "GET", URL: "/sync", Status: http.StatusOK,
+			SetAuth:   setClientAuth,
+			CheckBody: checkFeed(new(uint), deleted(projectPath)),
+		},
+	}
+}
+
+// TestConcurrentWriters writes to several projects at once while following
+// the feed, which must not skip or repeat any change.
+// This is mostly of interest when run against PostgreSQL; see newStore.
+func TestConcurrentWriters(t *testing.T) {
+	t.Parallel()
+	server, db := newServer(t)
+	err := addUsers(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Use a session, since checking the password for every request is slow.
+	current := session{}
+	err = runTest(Test{
+		Method: "POST", URL: sessionsUrl, Status: http.StatusCreated,
+		CheckBody: func(dec *json.Decoder) error { return dec.Decode(&current) },
+	}, server.URL, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setTokenAuth := func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer "+current.Token)
+	}
+
+	const projects = 4
+	const writes = 5
+	projectIds := []uint{}
+	for i := 0; i < projects; i++ {
+		err = runTest(Test{
+			Method: "POST", URL: projectsUrl, Status: http.StatusCreated,
+			BodyFunc: func() string { return `{"Name":"Project"}` },
+			CheckBody: func(dec *json.Decoder) error {
+				return getCreatedId(dec, &projectIds)
+			},
+			SetAuth: setTokenAuth,
+		}, server.URL, db)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	cursor := uint(0)
+	poll := func() ([]feedEntry, error) {
+		f := feed{}
+		err := runTest(Test{
+			Method: "GET", Status: http.StatusOK,
+			URLFunc:   func() string { return fmt.Sprintf("/sync?since=%d", cursor) },
+			CheckBody: func(dec *json.Decoder) error { return dec.Decode(&f) },
+			SetAuth:   setTokenAuth,
+		}, server.URL, db)
+		cursor = f.Cursor
+		return f.Changes, err
+	}
+	_, err = poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each writer adds deliverables to its own project.
+	var wg sync.WaitGroup
+	errs := make(chan error, projects*writes)
+	created := make(chan string, projects*writes)
+	for _, pid := range projectIds {
+		wg.Add(1)
+		go func(pid uint) {
+			defer wg.Done()
+			projectUrl := fmt.Sprintf("%s/%d", projectsUrl, pid)
+			for i := 0; i < writes; i++ {
+				ids := []uint{}
+				err := runTest(Test{
+					Method: "POST", URL: projectUrl + "/deliverables",
+					Status: http.StatusCreated,
+					BodyFunc: func() string {
+						return `{"Name":"A", "Description":"A", "Due":"2018-01-01T00:00:00Z"}`
+					},
+					CheckBody: func(dec *json.Decoder) error {
+						return getCreatedId(dec, &ids)
+					},
+					SetAuth: setTokenAuth,
+				}, server.URL, db)
+				if err != nil {
+					errs <- err
+					return
+				}
+				created <- fmt.Sprintf("%s/deliverables/%d", projectUrl, ids[0])
+			}
+		}(pid)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	// Follow the feed until the writers finish, and then once more.
+	seen := map[string]int{}
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+		changes, err := poll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range changes {
+			seen[c.Path]++
+		}
+	}
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	close(created)
+	count := 0
+	for path := range created {
+		count++
+		if seen[path] != 1 {
+			t.Errorf("Expected %s once in the feed, got %d", path, seen[path])
+		}
+	}
+	if count != projects*writes {
+		t.Fatalf("Expected %d deliverables, got %d", projects*writes, count)
+	}
+}
+
+// vim: sw=4 ts=4 noexpandtab
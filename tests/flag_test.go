@@ -0,0 +1,95 @@
+/*
+Tests for the projects/pID/flag endpoint.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestFlag(t *testing.T) {
+	runSuite(t, flagTests())
+}
+
+type flag struct {
+	Version uint
+	Value   bool
+}
+
+// checkFlag returns a CheckBody function checking for the given flag.
+func checkFlag(expected flag) func(*json.Decoder) error {
+	return func(dec *json.Decoder) error {
+		f := flag{}
+		err := dec.Decode(&f)
+		if err == nil && f != expected {
+			err = fmt.Errorf("Expected %+v, got %+v", expected, f)
+		}
+		return err
+	}
+}
+
+// flagTests returns the tests for the flag endpoint.
+func flagTests() []Test {
+	projectIds := []uint{}
+	flagUrl := func() string {
+		return fmt.Sprintf("%s/%d/flag", projectsUrl, projectIds[0])
+	}
+
+	return []Test{
+		Test{
+			Name:   "flag:CreateProject",
+			Pre:    addUsers,
+			Method: "POST", URL: projectsUrl, Status: http.StatusCreated,
+			BodyFunc: func() string {
+				return `{"Name":"Test Project", "Updated":"2017-12-19"}`
+			},
+			CheckBody: func(dec *json.Decoder) error {
+				return getCreatedId(dec, &projectIds)
+			},
+		},
+		Test{
+			Name:   "flag:Get",
+			Method: "GET", URLFunc: flagUrl, Status: http.StatusOK,
+			CheckBody: checkFlag(flag{0, false}),
+		},
+		Test{
+			Name:   "flag:Set",
+			Method: "PUT", URLFunc: flagUrl, Status: http.StatusOK,
+			BodyFunc: func() string { return `{"Version":0, "Value":true}` },
+		},
+		Test{
+			Name:   "flag:CheckSet",
+			Method: "GET", URLFunc: flagUrl, Status: http.StatusOK,
+			CheckBody: checkFlag(flag{1, true}),
+		},
+		Test{
+			Name:   "flag:SetStale",
+			Method: "PUT", URLFunc: flagUrl, Status: http.StatusOK,
+			BodyFunc: func() string { return `{"Version":0, "Value":false}` },
+		},
+		Test{
+			Name:   "flag:CheckStaleIgnored",
+			Method: "GET", URLFunc: flagUrl, Status: http.StatusOK,
+			CheckBody: checkFlag(flag{1, true}),
+		},
+		Test{
+			Name:   "flag:SetFuture",
+			Method: "PUT", URLFunc: flagUrl, Status: http.StatusBadRequest,
+			BodyFunc: func() string { return `{"Version":5, "Value":false}` },
+		},
+		Test{
+			Name:   "flag:GetAsOtherForbidden",
+			Method: "GET", URLFunc: flagUrl, Status: http.StatusForbidden,
+			SetAuth: setClientAuth,
+		},
+	}
+}
+
+// vim: sw=4 ts=4 noexpandtab
@@ -5,20 +5,24 @@ Author:		Alastair Hughes
 Contact:	<hobbitalastair at yandex dot com>
 */
 
-package main
+package tests
 
 import (
-	"database/sql"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"testing"
 
 	"github.com/mel-app/backend/src"
 )
 
-var loginUrl = url + "login"
+var loginUrl = "/login"
 var newPassword = "2nd password"
 
+func TestLogin(t *testing.T) {
+	runSuite(t, loginTests)
+}
+
 var loginTests = []Test{
 	// Authentication sanity checks.
 	Test{
@@ -48,7 +52,7 @@ var loginTests = []Test{
 	Test{
 		Name:   "login:InvalidPassword",
 		Method: "GET", URL: loginUrl, Status: http.StatusForbidden,
-		SetAuth:   setNewPassword,
+		SetAuth: setNewPassword,
 	},
 	Test{
 		Name:   "login:CreateAgain",
@@ -71,6 +75,12 @@ var loginTests = []Test{
 				`","Password":"` + newPassword + `","Manager":true}`
 		},
 	},
+	Test{
+		Name:   "login:ChangeToEmptyPassword",
+		Method: "PUT", URL: loginUrl, Status: http.StatusBadRequest,
+		SetAuth:  setNewPassword,
+		BodyFunc: func() string { return `{"Username":"` + defaultUser + `"}` },
+	},
 	Test{
 		Name:   "login:TestNewPassword",
 		Method: "GET", URL: loginUrl, Status: http.StatusOK,
@@ -84,7 +94,7 @@ var loginTests = []Test{
 	Test{
 		Name:   "login:ResetPassword",
 		Method: "PUT", URL: loginUrl, Status: http.StatusOK,
-		SetAuth:   setNewPassword,
+		SetAuth: setNewPassword,
 		BodyFunc: func() string {
 			return `{"Username":"` + defaultUser +
 				`","Password":"` + defaultPassword + `","Manager":true}`
@@ -95,15 +105,15 @@ var loginTests = []Test{
 	Test{
 		Name:   "login:CreateClient",
 		Method: "POST", URL: loginUrl, Status: http.StatusCreated,
-		SetAuth:	setClientAuth,
+		SetAuth: setClientAuth,
 	},
 
 	// Account deletion.
 	// TODO: Check that associations with projects are cleaned up, and that
 	//		 projects with no owners are also deleted.
 	Test{
-		Name:	"login:Deletion",
-		Method:	"DELETE", URL: loginUrl, Status: http.StatusOK,
+		Name:   "login:Deletion",
+		Method: "DELETE", URL: loginUrl, Status: http.StatusOK,
 	},
 	Test{
 		Name:   "login:Forbidden",
@@ -112,7 +122,7 @@ var loginTests = []Test{
 	Test{
 		Name:   "login:ReCreateDeleted",
 		Method: "POST", URL: loginUrl, Status: http.StatusCreated,
-		Post:	makeManager,
+		Post: makeManager,
 	},
 }
 
@@ -138,8 +148,8 @@ func setClientAuth(r *http.Request) {
 }
 
 // makeManager makes the default user a manager.
-func makeManager(db *sql.DB) error {
-	return backend.NewDB(db).SetIsManager(defaultUser, true)
+func makeManager(db backend.DB) error {
+	return db.SetIsManager(defaultUser, true)
 }
 
 // checkManager checks that the manager flag is set.
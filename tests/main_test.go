@@ -0,0 +1,226 @@
+/*
+Test harness for the backend tests.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package tests
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/mel-app/backend/src"
+)
+
+// Test is a single request/response step in a test suite.
+// Steps in a suite run in order, and later steps may depend on earlier ones.
+type Test struct {
+	Name     string
+	Pre      func(backend.DB) error
+	Post     func(backend.DB) error
+	Method   string
+	URL      string // Path, relative to the server root.
+	URLFunc  func() string
+	Status   int
+	BodyFunc func() string
+	// ContentType of the body, if not the default.
+	ContentType string
+	// HeaderFunc returns any extra request headers.
+	HeaderFunc  func() http.Header
+	CheckBody   func(*json.Decoder) error
+	CheckHeader func(http.Header) error
+	SetAuth     func(*http.Request)
+}
+
+var defaultUser = "test user"
+var defaultPassword = "test password"
+var client1User = "client 1"
+var client1Password = "client 1"
+
+func TestMain(m *testing.M) {
+	// Suppress logging.
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// newStore returns a store backed by a new, empty database.
+// This is an in-memory SQLite database unless DATABASE_URL is set, in which
+// case it is a new schema in that PostgreSQL database.
+func newStore(t *testing.T) backend.Store {
+	var store backend.Store
+	if dbURL := os.Getenv("DATABASE_URL"); dbURL != "" {
+		store = newPostgresStore(t, dbURL)
+	} else {
+		db, err := sql.Open("sqlite3", ":memory:")
+		if err != nil {
+			t.Fatalf("Error opening DB: %q", err)
+		}
+		t.Cleanup(func() { db.Close() })
+		store = backend.NewSQLiteStore(db)
+	}
+	err := backend.NewDB(store).Migrate()
+	if err != nil {
+		t.Fatalf("Error initialising DB: %q", err)
+	}
+	return store
+}
+
+// schemas counts the PostgreSQL schemas created, so that each is unique.
+var schemas int32
+
+// newPostgresStore returns a store using a new schema in the PostgreSQL
+// database at dbURL, so that suites can run in parallel.
+// The schema is dropped once the test finishes.
+func newPostgresStore(t *testing.T, dbURL string) backend.Store {
+	admin, err := sql.Open("postgres", dbURL)
+	if err != nil {
+		t.Fatalf("Error opening DB: %q", err)
+	}
+	t.Cleanup(func() { admin.Close() })
+	schema := fmt.Sprintf("test_%d_%d", os.Getpid(), atomic.AddInt32(&schemas, 1))
+	_, err = admin.Exec("CREATE SCHEMA " + schema)
+	if err != nil {
+		t.Fatalf("Error creating schema: %q", err)
+	}
+	t.Cleanup(func() { admin.Exec("DROP SCHEMA " + schema + " CASCADE") })
+
+	u, err := url.Parse(dbURL)
+	if err != nil {
+		t.Fatalf("Invalid DATABASE_URL: %q", err)
+	}
+	query := u.Query()
+	query.Set("search_path", schema)
+	u.RawQuery = query.Encode()
+	db, err := sql.Open("postgres", u.String())
+	if err != nil {
+		t.Fatalf("Error opening DB: %q", err)
+	}
+	// Registered after the schema cleanup, so runs first.
+	t.Cleanup(func() { db.Close() })
+	return backend.NewPostgresStore(db)
+}
+
+// newServer starts a server backed by a new database; see newStore.
+func newServer(t *testing.T, opts ...backend.Option) (*httptest.Server, backend.DB) {
+	store := newStore(t)
+	server := httptest.NewServer(backend.NewHandler(store, opts...))
+	t.Cleanup(server.Close)
+	return server, backend.NewDB(store)
+}
+
+// runSuite runs the given tests in order against a new server.
+// Suites run in parallel with each other; the first failure in a suite stops
+// the rest of that suite, since later steps generally depend on earlier ones.
+func runSuite(t *testing.T, tests []Test) {
+	t.Parallel()
+	server, db := newServer(t)
+	for _, test := range tests {
+		test := test
+		ok := t.Run(test.Name, func(t *testing.T) {
+			err := runTest(test, server.URL, db)
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+		if !ok {
+			return
+		}
+	}
+}
+
+// runTest runs a single given Test.
+func runTest(t Test, root string, db backend.DB) error {
+	if t.Pre != nil {
+		err := t.Pre(db)
+		if err != nil {
+			return err
+		}
+	}
+
+	url := t.URL
+	if t.URLFunc != nil {
+		url = t.URLFunc()
+	}
+
+	body := ""
+	if t.BodyFunc != nil {
+		body = t.BodyFunc()
+	}
+	req, err := http.NewRequest(t.Method, root+url, bytes.NewBufferString(body))
+	if err != nil {
+		return err
+	}
+
+	if t.ContentType != "" {
+		req.Header.Set("Content-Type", t.ContentType)
+	}
+	if t.HeaderFunc != nil {
+		for name, values := range t.HeaderFunc() {
+			req.Header[name] = values
+		}
+	}
+
+	if t.SetAuth != nil {
+		t.SetAuth(req)
+	} else {
+		req.SetBasicAuth(defaultUser, defaultPassword)
+	}
+
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != t.Status {
+		return fmt.Errorf("Expected %d, got %s!", t.Status, response.Status)
+	}
+
+	if t.CheckHeader != nil {
+		err = t.CheckHeader(response.Header)
+		if err != nil {
+			return err
+		}
+	}
+
+	if t.CheckBody != nil {
+		err = t.CheckBody(json.NewDecoder(response.Body))
+		if err != nil {
+			return err
+		}
+	}
+
+	if t.Post != nil {
+		err := t.Post(db)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addUsers creates the default user (as a manager) and the first client.
+// It is intended for use as a Pre function.
+func addUsers(db backend.DB) error {
+	err := db.AddUser(defaultUser, defaultPassword, true)
+	if err != nil {
+		return err
+	}
+	return db.AddUser(client1User, client1Password, false)
+}
+
+// vim: sw=4 ts=4 noexpandtab
@@ -0,0 +1,185 @@
+/*
+Tests for partial updates (PATCH) to items.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+var mergePatchType = "application/merge-patch+json"
+var jsonPatchType = "application/json-patch+json"
+
+func TestPatch(t *testing.T) {
+	runSuite(t, patchTests())
+}
+
+// patchTests returns the tests for patching items.
+func patchTests() []Test {
+	projectIds := []uint{}
+	deliverableIds := []uint{}
+	projectUrl := func() string {
+		return fmt.Sprintf("%s/%d", projectsUrl, projectIds[0])
+	}
+	flagUrl := func() string {
+		return fmt.Sprintf("%s/flag", projectUrl())
+	}
+	deliverablesUrl := func() string {
+		return fmt.Sprintf("%s/deliverables", projectUrl())
+	}
+	deliverableUrl := func() string {
+		return fmt.Sprintf("%s/%d", deliverablesUrl(), deliverableIds[0])
+	}
+
+	return []Test{
+		Test{
+			Name:   "patch:CreateProject",
+			Pre:    addUsers,
+			Method: "POST", URL: projectsUrl, Status: http.StatusCreated,
+			BodyFunc: func() string {
+				return `{"Name":"A", "Description":"A", "Updated":"2017-12-19T00:00:00Z"}`
+			},
+			CheckBody: func(dec *json.Decoder) error {
+				return getCreatedId(dec, &projectIds)
+			},
+		},
+		Test{
+			// Merge patches are the default.
+			Name:   "patch:MergeProject",
+			Method: "PATCH", URLFunc: projectUrl, Status: http.StatusOK,
+			BodyFunc:  func() string { return `{"Name":"B"}` },
+			CheckBody: checkMerged(merged{"B", "A", 1, []string{}}),
+		},
+		Test{
+			Name:   "patch:JSONPatchProject",
+			Method: "PATCH", URLFunc: projectUrl, Status: http.StatusOK,
+			ContentType: jsonPatchType,
+			BodyFunc: func() string {
+				return `[{"op":"test", "path":"/Name", "value":"B"}, {"op":"replace", "path":"/Description", "value":"C"}]`
+			},
+			CheckBody: checkMerged(merged{"B", "C", 2, []string{}}),
+		},
+		Test{
+			Name:   "patch:FailedTest",
+			Method: "PATCH", URLFunc: projectUrl, Status: http.StatusConflict,
+			ContentType: jsonPatchType,
+			BodyFunc: func() string {
+				return `[{"op":"test", "path":"/Name", "value":"A"}, {"op":"replace", "path":"/Description", "value":"D"}]`
+			},
+		},
+		Test{
+			// Patches based on an old version are merged like a PUT.
+			Name:   "patch:MergeOldVersion",
+			Method: "PATCH", URLFunc: projectUrl, Status: http.StatusOK,
+			ContentType: mergePatchType,
+			BodyFunc:    func() string { return `{"Version":1, "Description":"D"}` },
+			CheckBody:   checkMerged(merged{"B", "C", 2, []string{"Description"}}),
+		},
+		Test{
+			Name:   "patch:NotPatchable",
+			Method: "PATCH", URLFunc: projectUrl, Status: http.StatusBadRequest,
+			BodyFunc: func() string { return `{"Id":1}` },
+		},
+		Test{
+			Name:   "patch:Invalid",
+			Method: "PATCH", URLFunc: projectUrl, Status: http.StatusBadRequest,
+			BodyFunc: func() string { return `{"Name":null}` },
+		},
+		Test{
+			Name:   "patch:AsClientForbidden",
+			Method: "PATCH", URLFunc: projectUrl, Status: http.StatusForbidden,
+			SetAuth:  setClientAuth,
+			BodyFunc: func() string { return `{"Name":"C"}` },
+		},
+
+		// Deliverables can be patched without sending every field.
+		Test{
+			Name:   "patch:CreateDeliverable",
+			Method: "POST", URLFunc: deliverablesUrl, Status: http.StatusCreated,
+			BodyFunc: func() string {
+				return `{"Name":"A", "Description":"A", "Updated":"2017-12-19T00:00:00Z", "Due":"2018-01-01T00:00:00Z"}`
+			},
+			CheckBody: func(dec *json.Decoder) error {
+				return getCreatedId(dec, &deliverableIds)
+			},
+		},
+		Test{
+			Name:   "patch:MergeDeliverable",
+			Method: "PATCH", URLFunc: deliverableUrl, Status: http.StatusOK,
+			BodyFunc:  func() string { return `{"Description":"B"}` },
+			CheckBody: checkMerged(merged{"A", "B", 1, []string{}}),
+		},
+
+		// Flags.
+		Test{
+			Name:   "patch:Flag",
+			Method: "PATCH", URLFunc: flagUrl, Status: http.StatusOK,
+			ContentType: jsonPatchType,
+			BodyFunc: func() string {
+				return `[{"op":"replace", "path":"/Value", "value":true}]`
+			},
+		},
+		Test{
+			Name:   "patch:CheckFlag",
+			Method: "GET", URLFunc: flagUrl, Status: http.StatusOK,
+			CheckBody: checkFlag(flag{1, true}),
+		},
+
+		// Logins.
+		Test{
+			Name:   "patch:Login",
+			Method: "PATCH", URL: loginUrl, Status: http.StatusOK,
+			BodyFunc: func() string {
+				return fmt.Sprintf(`{"Password":%q}`, newPassword)
+			},
+		},
+		Test{
+			Name:   "patch:CheckLogin",
+			Method: "GET", URL: loginUrl, Status: http.StatusOK,
+			SetAuth: setNewPassword,
+		},
+		Test{
+			Name:   "patch:LoginNotPatchable",
+			Method: "PATCH", URL: loginUrl, Status: http.StatusBadRequest,
+			SetAuth:  setNewPassword,
+			BodyFunc: func() string { return `{"Username":"other"}` },
+		},
+		Test{
+			// The password is not reported by GET, so an empty patch
+			// would change it to nothing.
+			Name:   "patch:LoginEmpty",
+			Method: "PATCH", URL: loginUrl, Status: http.StatusBadRequest,
+			SetAuth:   setNewPassword,
+			BodyFunc:  func() string { return `{}` },
+			CheckBody: checkProblem(http.StatusBadRequest, "invalid_body", "Password"),
+		},
+		Test{
+			Name:   "patch:LoginManager",
+			Method: "PATCH", URL: loginUrl, Status: http.StatusBadRequest,
+			SetAuth:  setNewPassword,
+			BodyFunc: func() string { return `{"Manager":true}` },
+		},
+		Test{
+			Name:   "patch:CheckLoginUnchanged",
+			Method: "GET", URL: loginUrl, Status: http.StatusOK,
+			SetAuth: setNewPassword,
+		},
+
+		// Other resources can't be patched.
+		Test{
+			Name:   "patch:List",
+			Method: "PATCH", URL: projectsUrl, Status: http.StatusMethodNotAllowed,
+			SetAuth:  setNewPassword,
+			BodyFunc: func() string { return `{}` },
+		},
+	}
+}
+
+// vim: sw=4 ts=4 noexpandtab
@@ -0,0 +1,364 @@
+/*
+Tests for the projects/ endpoint.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+var projectsUrl = "/projects"
+
+func TestProjects(t *testing.T) {
+	runSuite(t, projectsTests())
+}
+
+// projectsTests returns the tests for the projects/ endpoint.
+// The tests share the list of project ids.
+func projectsTests() []Test {
+	projectIds := []uint{}
+	return []Test{
+		// Basic project functionality.
+		Test{
+			Name:   "projects:Empty",
+			Pre:    addUsers,
+			Method: "GET", URL: projectsUrl, Status: http.StatusOK,
+			CheckBody: checkIsEmpty,
+		},
+		Test{
+			Name:   "projects:Create",
+			Method: "POST", URL: projectsUrl, Status: http.StatusCreated,
+			BodyFunc: func() string {
+				return `{"Name":"Test Project", "Updated":"2017-12-19"}`
+			},
+		},
+		Test{
+			Name:   "projects:CreateAsClientForbidden",
+			Method: "POST", URL: projectsUrl,
+			Status:  http.StatusForbidden,
+			SetAuth: setClientAuth,
+			BodyFunc: func() string {
+				return `{"Name":"Test Project", "Updated":"2017-12-19"}`
+			},
+		},
+		Test{
+			Name:   "projects:GetList",
+			Method: "GET", URL: projectsUrl, Status: http.StatusOK,
+			CheckBody: func(dec *json.Decoder) error {
+				err := getProjectIds(dec, &projectIds)
+				if len(projectIds) != 1 {
+					return fmt.Errorf("Expected a single project")
+				}
+				return err
+			},
+		},
+		Test{
+			Name:   "projects:Get",
+			Method: "GET", URLFunc: func() string {
+				return fmt.Sprintf("%s/%d", projectsUrl, projectIds[0])
+			},
+			Status: http.StatusOK,
+			CheckBody: func(dec *json.Decoder) error {
+				return checkProjectEqual(dec, project{
+					Id:   projectIds[0],
+					Name: "Test Project",
+					Owns: true,
+				})
+			},
+		},
+		Test{
+			Name:   "projects:Put",
+			Method: "PUT", URLFunc: func() string {
+				return fmt.Sprintf("%s/%d", projectsUrl, projectIds[0])
+			},
+			Status: http.StatusOK,
+			BodyFunc: func() string {
+				return fmt.Sprintf(`{"Name":"Test Project 2", "Updated":"2017-12-19", "Id":%d}`,
+					projectIds[0])
+			},
+		},
+
+		// Access from clients.
+		Test{
+			Name:   "projects:GetAsClientForbidden",
+			Method: "GET", URLFunc: func() string {
+				return fmt.Sprintf("%s/%d", projectsUrl, projectIds[0])
+			},
+			Status:  http.StatusForbidden,
+			SetAuth: setClientAuth,
+		},
+		// TODO: Implement adding/removing clients as part of "client" tests.
+		Test{
+			Name:   "clients:Add",
+			Method: "POST", URLFunc: func() string {
+				return fmt.Sprintf("%s/%d/clients", projectsUrl, projectIds[0])
+			},
+			Status:   http.StatusCreated,
+			BodyFunc: func() string { return `{"Name":"` + client1User + `"}` },
+		},
+		Test{
+			Name:   "projects:GetAsClient",
+			Method: "GET", URLFunc: func() string {
+				return fmt.Sprintf("%s/%d", projectsUrl, projectIds[0])
+			},
+			Status:  http.StatusOK,
+			SetAuth: setClientAuth,
+			CheckBody: func(dec *json.Decoder) error {
+				return checkProjectEqual(dec, project{
+					Id:      projectIds[0],
+					Name:    "Test Project 2",
+					Version: 1,
+				})
+			},
+		},
+		Test{
+			Name:   "projects:PutAsClientForbidden",
+			Method: "PUT", URLFunc: func() string {
+				return fmt.Sprintf("%s/%d", projectsUrl, projectIds[0])
+			},
+			Status:  http.StatusForbidden,
+			SetAuth: setClientAuth,
+			BodyFunc: func() string {
+				return fmt.Sprintf(`{"Name":"Test Project 2", "Updated":"2017-12-19", "Id":%d}`,
+					projectIds[0])
+			},
+		},
+
+		// Deletion.
+		Test{
+			Name:   "projects:DeleteAsClient",
+			Method: "DELETE", URLFunc: func() string {
+				return fmt.Sprintf("%s/%d", projectsUrl, projectIds[0])
+			},
+			Status:  http.StatusOK,
+			SetAuth: setClientAuth,
+		},
+		Test{
+			Name:   "projects:CheckDeleteAsClient",
+			Method: "GET", URLFunc: func() string {
+				return fmt.Sprintf("%s/%d", projectsUrl, projectIds[0])
+			},
+			Status:  http.StatusForbidden,
+			SetAuth: setClientAuth,
+		},
+		Test{
+			Name:   "projects:CheckClientDeletionIsNotFull",
+			Method: "GET", URLFunc: func() string {
+				return fmt.Sprintf("%s/%d", projectsUrl, projectIds[0])
+			},
+			Status: http.StatusOK,
+			CheckBody: func(dec *json.Decoder) error {
+				return checkProjectEqual(dec, project{
+					Id:      projectIds[0],
+					Name:    "Test Project 2",
+					Version: 1,
+					Owns:    true,
+				})
+			},
+		},
+		Test{
+			Name:   "clients:Add",
+			Method: "POST", URLFunc: func() string {
+				return fmt.Sprintf("%s/%d/clients", projectsUrl, projectIds[0])
+			},
+			Status:   http.StatusCreated,
+			BodyFunc: func() string { return `{"Name":"` + client1User + `"}` },
+		},
+		Test{
+			Name:   "projects:DeleteAsManager",
+			Method: "DELETE", URLFunc: func() string {
+				return fmt.Sprintf("%s/%d", projectsUrl, projectIds[0])
+			},
+			Status: http.StatusOK,
+		},
+		Test{
+			Name:   "projects:CheckDeletion",
+			Method: "GET", URLFunc: func() string {
+				return fmt.Sprintf("%s/%d", projectsUrl, projectIds[0])
+			},
+			Status: http.StatusForbidden,
+		},
+		Test{
+			Name:   "projects:CheckManagerDeletionIsFull",
+			Method: "GET", URLFunc: func() string {
+				return fmt.Sprintf("%s/%d", projectsUrl, projectIds[0])
+			},
+			Status:  http.StatusForbidden,
+			SetAuth: setClientAuth,
+		},
+	}
+}
+
+func TestProjectDeletion(t *testing.T) {
+	runSuite(t, projectDeletionTests())
+}
+
+// projectDeletionTests returns the tests for leaving and deleting projects
+// with several members.
+func projectDeletionTests() []Test {
+	projectIds := []uint{}
+	projectUrl := func() string {
+		return fmt.Sprintf("%s/%d", projectsUrl, projectIds[0])
+	}
+	scopedUrl := func(scope string) func() string {
+		return func() string {
+			return fmt.Sprintf("%s?scope=%s", projectUrl(), scope)
+		}
+	}
+	clientsUrl := func() string {
+		return fmt.Sprintf("%s/clients", projectUrl())
+	}
+
+	return []Test{
+		Test{
+			Name:   "deletion:Create",
+			Pre:    addUsers,
+			Method: "POST", URL: projectsUrl, Status: http.StatusCreated,
+			BodyFunc: func() string {
+				return `{"Name":"Test Project", "Updated":"2017-12-19"}`
+			},
+			CheckBody: func(dec *json.Decoder) error {
+				return getCreatedId(dec, &projectIds)
+			},
+		},
+		Test{
+			Name:   "deletion:AddOwner",
+			Method: "POST", URLFunc: clientsUrl, Status: http.StatusCreated,
+			BodyFunc: func() string {
+				return `{"Name":"` + client1User + `", "IsManager":true}`
+			},
+		},
+		Test{
+			// Leaving is the default, and should not affect other owners.
+			Name:   "deletion:Leave",
+			Method: "DELETE", URLFunc: projectUrl, Status: http.StatusOK,
+		},
+		Test{
+			Name:   "deletion:CheckLeft",
+			Method: "GET", URLFunc: projectUrl, Status: http.StatusForbidden,
+		},
+		Test{
+			Name:   "deletion:CheckOtherOwnerKept",
+			Method: "GET", URLFunc: projectUrl, Status: http.StatusOK,
+			SetAuth: setClientAuth,
+			CheckBody: func(dec *json.Decoder) error {
+				return checkProjectEqual(dec, project{
+					Id:   projectIds[0],
+					Name: "Test Project",
+					Owns: true,
+				})
+			},
+		},
+		Test{
+			Name:   "deletion:AddViewer",
+			Method: "POST", URLFunc: clientsUrl, Status: http.StatusCreated,
+			SetAuth:  setClientAuth,
+			BodyFunc: func() string { return `{"Name":"` + defaultUser + `"}` },
+		},
+		Test{
+			Name:   "deletion:DeleteForEveryoneAsViewer",
+			Method: "DELETE", URLFunc: scopedUrl("everyone"),
+			Status: http.StatusForbidden,
+		},
+		Test{
+			Name:   "deletion:InvalidScope",
+			Method: "DELETE", URLFunc: scopedUrl("nobody"),
+			Status:  http.StatusBadRequest,
+			SetAuth: setClientAuth,
+		},
+		Test{
+			Name:   "deletion:CheckStillViewing",
+			Method: "GET", URLFunc: projectUrl, Status: http.StatusOK,
+		},
+		Test{
+			Name:   "deletion:DeleteForEveryone",
+			Method: "DELETE", URLFunc: scopedUrl("everyone"),
+			Status:  http.StatusOK,
+			SetAuth: setClientAuth,
+		},
+		Test{
+			Name:   "deletion:CheckDeletedForOwner",
+			Method: "GET", URLFunc: projectUrl, Status: http.StatusForbidden,
+			SetAuth: setClientAuth,
+		},
+		Test{
+			Name:   "deletion:CheckDeletedForViewer",
+			Method: "GET", URLFunc: projectUrl, Status: http.StatusForbidden,
+		},
+		Test{
+			Name:   "deletion:CheckList",
+			Method: "GET", URL: projectsUrl, Status: http.StatusOK,
+			CheckBody: checkIsEmpty,
+		},
+	}
+}
+
+type project struct {
+	Id          uint
+	Name        string
+	Percentage  uint
+	Description string
+	Updated     string
+	Version     uint
+	Owns        bool
+}
+
+// checkIsEmpty checks that the body is empty.
+func checkIsEmpty(dec *json.Decoder) error {
+	if dec.More() == true {
+		return fmt.Errorf("Expected an empty project list")
+	}
+	return nil
+}
+
+// checkProjectEqual checks that the project in the decoder is the same as
+// the given project.
+func checkProjectEqual(dec *json.Decoder, p project) error {
+	json := project{}
+	err := dec.Decode(&json)
+
+	// TODO: We currently ignore the Updated date; compare using some other
+	//		 method?
+	json.Updated = ""
+
+	if err != nil {
+		return err
+	}
+	if p != json {
+		return fmt.Errorf("%+v != %+v", p, json)
+	}
+	return nil
+}
+
+// getCreatedId appends the id of the item created by a POST to ids.
+func getCreatedId(dec *json.Decoder, ids *[]uint) error {
+	item := struct{ Id uint }{}
+	err := dec.Decode(&item)
+	if err != nil {
+		return err
+	}
+	*ids = append(*ids, item.Id)
+	return nil
+}
+
+// getProjectIds appends the list of project ids to ids.
+func getProjectIds(dec *json.Decoder, ids *[]uint) error {
+	for dec.More() {
+		var i uint = 0
+		err := dec.Decode(&i)
+		if err != nil {
+			return err
+		}
+		*ids = append(*ids, i)
+	}
+	return nil
+}
+
+// vim: sw=4 ts=4 noexpandtab
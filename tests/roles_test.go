@@ -0,0 +1,206 @@
+/*
+Tests for the project membership roles.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestRoles(t *testing.T) {
+	runSuite(t, rolesTests())
+}
+
+// checkRole returns a CheckBody function checking the role in a client or
+// project.
+func checkRole(expected string) func(*json.Decoder) error {
+	return func(dec *json.Decoder) error {
+		v := struct{ Role string }{}
+		err := dec.Decode(&v)
+		if err == nil && v.Role != expected {
+			err = fmt.Errorf("Expected role %q, got %q", expected, v.Role)
+		}
+		return err
+	}
+}
+
+// rolesTests returns the tests checking what each role allows.
+// The default user owns the project, and the first client is given each of
+// the other roles in turn.
+func rolesTests() []Test {
+	projectIds := []uint{}
+	projectUrl := func() string {
+		return fmt.Sprintf("%s/%d", projectsUrl, projectIds[0])
+	}
+	clientsUrl := func() string {
+		return projectUrl() + "/clients"
+	}
+	clientUrl := func() string {
+		return fmt.Sprintf("%s/%s", clientsUrl(), clientId(client1User))
+	}
+	deliverablesUrl := func() string {
+		return projectUrl() + "/deliverables"
+	}
+	projectBody := func() string {
+		return fmt.Sprintf(`{"Id":%d, "Name":"Edited", "Updated":"2017-12-19"}`,
+			projectIds[0])
+	}
+	deliverableBody := func() string {
+		return `{"Name":"Deliverable", "Description":"Deliverable", "Updated":"2017-12-19", "Due":"2018-01-01T00:00:00Z"}`
+	}
+	setRole := func(role string) func() string {
+		return func() string { return `{"Role":"` + role + `"}` }
+	}
+
+	return []Test{
+		Test{
+			Name:   "roles:CreateProject",
+			Pre:    addUsers,
+			Method: "POST", URL: projectsUrl, Status: http.StatusCreated,
+			BodyFunc: func() string {
+				return `{"Name":"Test Project", "Updated":"2017-12-19"}`
+			},
+			CheckBody: func(dec *json.Decoder) error {
+				return getCreatedId(dec, &projectIds)
+			},
+		},
+		Test{
+			Name:   "roles:GetOwner",
+			Method: "GET", URLFunc: projectUrl, Status: http.StatusOK,
+			CheckBody: checkRole("owner"),
+		},
+		Test{
+			Name:   "roles:AddInvalid",
+			Method: "POST", URLFunc: clientsUrl, Status: http.StatusBadRequest,
+			BodyFunc: func() string {
+				return `{"Name":"` + client1User + `", "Role":"admin"}`
+			},
+		},
+		Test{
+			Name:   "roles:AddEditor",
+			Method: "POST", URLFunc: clientsUrl, Status: http.StatusCreated,
+			BodyFunc: func() string {
+				return `{"Name":"` + client1User + `", "Role":"editor"}`
+			},
+			CheckBody: checkRole("editor"),
+		},
+
+		// Editors.
+		Test{
+			Name:   "roles:EditorGet",
+			Method: "GET", URLFunc: projectUrl, Status: http.StatusOK,
+			SetAuth:   setClientAuth,
+			CheckBody: checkRole("editor"),
+		},
+		Test{
+			Name:   "roles:EditorSet",
+			Method: "PUT", URLFunc: projectUrl, Status: http.StatusOK,
+			SetAuth:  setClientAuth,
+			BodyFunc: projectBody,
+		},
+		Test{
+			Name:   "roles:EditorCreateDeliverable",
+			Method: "POST", URLFunc: deliverablesUrl, Status: http.StatusCreated,
+			SetAuth:  setClientAuth,
+			BodyFunc: deliverableBody,
+		},
+		Test{
+			Name:   "roles:EditorListClients",
+			Method: "GET", URLFunc: clientsUrl, Status: http.StatusOK,
+			SetAuth:   setClientAuth,
+			CheckBody: checkClients(client1User, defaultUser),
+		},
+		Test{
+			Name:   "roles:EditorAddClientForbidden",
+			Method: "POST", URLFunc: clientsUrl, Status: http.StatusForbidden,
+			SetAuth:  setClientAuth,
+			BodyFunc: func() string { return `{"Name":"` + defaultUser + `"}` },
+		},
+		Test{
+			Name:   "roles:EditorDeleteForEveryoneForbidden",
+			Method: "DELETE", URLFunc: func() string {
+				return projectUrl() + "?scope=everyone"
+			},
+			Status:  http.StatusForbidden,
+			SetAuth: setClientAuth,
+		},
+
+		// Commenters.
+		Test{
+			Name:   "roles:SetCommenter",
+			Method: "PUT", URLFunc: clientUrl, Status: http.StatusOK,
+			BodyFunc:  setRole("commenter"),
+			CheckBody: checkRole("commenter"),
+		},
+		Test{
+			Name:   "roles:CommenterGet",
+			Method: "GET", URLFunc: projectUrl, Status: http.StatusOK,
+			SetAuth:   setClientAuth,
+			CheckBody: checkRole("commenter"),
+		},
+		Test{
+			Name:   "roles:CommenterSetForbidden",
+			Method: "PUT", URLFunc: projectUrl, Status: http.StatusForbidden,
+			SetAuth:  setClientAuth,
+			BodyFunc: projectBody,
+		},
+		Test{
+			Name:   "roles:CommenterCreateDeliverableForbidden",
+			Method: "POST", URLFunc: deliverablesUrl, Status: http.StatusForbidden,
+			SetAuth:  setClientAuth,
+			BodyFunc: deliverableBody,
+		},
+		Test{
+			Name:   "roles:CommenterListDeliverables",
+			Method: "GET", URLFunc: deliverablesUrl, Status: http.StatusOK,
+			SetAuth: setClientAuth,
+		},
+		Test{
+			Name:   "roles:CommenterSetFlag",
+			Method: "PUT", URLFunc: func() string {
+				return projectUrl() + "/flag"
+			},
+			Status:   http.StatusOK,
+			SetAuth:  setClientAuth,
+			BodyFunc: func() string { return `{"Version":0, "Value":true}` },
+		},
+
+		// Viewers.
+		Test{
+			Name:   "roles:SetViewer",
+			Method: "PUT", URLFunc: clientUrl, Status: http.StatusOK,
+			BodyFunc:  setRole("viewer"),
+			CheckBody: checkRole("viewer"),
+		},
+		Test{
+			Name:   "roles:ViewerListClientsForbidden",
+			Method: "GET", URLFunc: clientsUrl, Status: http.StatusForbidden,
+			SetAuth: setClientAuth,
+		},
+		Test{
+			Name:   "roles:ViewerSetRoleForbidden",
+			Method: "PUT", URLFunc: clientUrl, Status: http.StatusForbidden,
+			SetAuth:  setClientAuth,
+			BodyFunc: setRole("owner"),
+		},
+		Test{
+			Name:   "roles:ViewerLeave",
+			Method: "DELETE", URLFunc: projectUrl, Status: http.StatusOK,
+			SetAuth: setClientAuth,
+		},
+		Test{
+			Name:   "roles:CheckLeft",
+			Method: "GET", URLFunc: projectUrl, Status: http.StatusForbidden,
+			SetAuth: setClientAuth,
+		},
+	}
+}
+
+// vim: sw=4 ts=4 noexpandtab
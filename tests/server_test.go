@@ -0,0 +1,92 @@
+/*
+Tests for the HTTP server setup.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package tests
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mel-app/backend/src"
+)
+
+func TestServerShutdown(t *testing.T) {
+	t.Parallel()
+	server, err := backend.NewServer("", newStore(t),
+		backend.WithTimeouts(time.Second, time.Second, time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- server.Serve(ctx, l) }()
+
+	response, err := http.Get("http://" + l.Addr().String() + "/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected %d, got %s", http.StatusUnauthorized, response.Status)
+	}
+
+	cancel()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatalf("Expected a clean shutdown, got %q", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Server did not shut down")
+	}
+}
+
+func TestServerMissingCertificate(t *testing.T) {
+	t.Parallel()
+	_, err := backend.NewServer("", newStore(t),
+		backend.WithTLSCertificate("missing.pem", "missing.key"))
+	if err == nil {
+		t.Fatal("Expected an error loading a missing certificate")
+	}
+}
+
+func TestHandlerPrefix(t *testing.T) {
+	t.Parallel()
+	store := newStore(t)
+	err := backend.NewDB(store).AddUser(defaultUser, defaultPassword, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.StripPrefix("/api",
+		backend.NewHandler(store)))
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", server.URL+"/api/login", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth(defaultUser, defaultPassword)
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("Expected %d, got %s", http.StatusOK, response.Status)
+	}
+}
+
+// vim: sw=4 ts=4 noexpandtab
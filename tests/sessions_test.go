@@ -0,0 +1,207 @@
+/*
+Tests for the sessions/ endpoint.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+var sessionsUrl = "/sessions"
+
+func TestSessions(t *testing.T) {
+	runSuite(t, sessionsTests())
+}
+
+type session struct {
+	Id    string
+	Token string
+}
+
+// sessionsTests returns the tests for the sessions/ endpoint.
+func sessionsTests() []Test {
+	current := session{}
+	setTokenAuth := func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer "+current.Token)
+	}
+	sessionUrl := func() string { return sessionsUrl + "/" + current.Id }
+
+	return []Test{
+		Test{
+			Name:   "sessions:Create",
+			Pre:    addUsers,
+			Method: "POST", URL: sessionsUrl, Status: http.StatusCreated,
+			CheckBody: func(dec *json.Decoder) error {
+				err := dec.Decode(&current)
+				if err == nil && (current.Id == "" || current.Token == "") {
+					err = fmt.Errorf("Expected a session id and token")
+				}
+				return err
+			},
+		},
+		Test{
+			Name:   "sessions:Login",
+			Method: "GET", URL: loginUrl, Status: http.StatusOK,
+			SetAuth:   setTokenAuth,
+			CheckBody: checkManager,
+		},
+		Test{
+			Name:   "sessions:InvalidToken",
+			Method: "GET", URL: loginUrl, Status: http.StatusUnauthorized,
+			SetAuth: func(r *http.Request) {
+				r.Header.Set("Authorization", "Bearer not-a-token")
+			},
+		},
+		Test{
+			Name:   "sessions:List",
+			Method: "GET", URL: sessionsUrl, Status: http.StatusOK,
+			SetAuth: setTokenAuth,
+			CheckBody: func(dec *json.Decoder) error {
+				listed := session{}
+				err := dec.Decode(&listed)
+				if err != nil {
+					return err
+				}
+				if listed.Id != current.Id || listed.Token != "" || dec.More() {
+					return fmt.Errorf("Expected only %q without a token, got %+v",
+						current.Id, listed)
+				}
+				return nil
+			},
+		},
+		Test{
+			Name:   "sessions:RevokeAsOtherForbidden",
+			Method: "DELETE", URLFunc: sessionUrl, Status: http.StatusForbidden,
+			SetAuth: setClientAuth,
+		},
+		Test{
+			Name:   "sessions:Revoke",
+			Method: "DELETE", URLFunc: sessionUrl, Status: http.StatusOK,
+			SetAuth: setTokenAuth,
+		},
+		Test{
+			Name:   "sessions:RevokedToken",
+			Method: "GET", URL: loginUrl, Status: http.StatusUnauthorized,
+			SetAuth: setTokenAuth,
+		},
+		Test{
+			Name:   "sessions:PasswordStillWorks",
+			Method: "GET", URL: loginUrl, Status: http.StatusOK,
+		},
+
+		// Tokens can't be used to start new sessions or to take over the
+		// account.
+		Test{
+			Name:   "sessions:CreateAgain",
+			Method: "POST", URL: sessionsUrl, Status: http.StatusCreated,
+			CheckBody: func(dec *json.Decoder) error {
+				return dec.Decode(&current)
+			},
+		},
+		Test{
+			Name:   "sessions:CreateWithToken",
+			Method: "POST", URL: sessionsUrl, Status: http.StatusForbidden,
+			SetAuth: setTokenAuth,
+		},
+		Test{
+			Name:   "sessions:SetPasswordWithToken",
+			Method: "PUT", URL: loginUrl, Status: http.StatusForbidden,
+			SetAuth:  setTokenAuth,
+			BodyFunc: func() string { return `{"Password":"` + newPassword + `"}` },
+		},
+		Test{
+			Name:   "sessions:PatchPasswordWithToken",
+			Method: "PATCH", URL: loginUrl, Status: http.StatusForbidden,
+			SetAuth:  setTokenAuth,
+			BodyFunc: func() string { return `{"Password":"` + newPassword + `"}` },
+		},
+		Test{
+			Name:   "sessions:DeleteLoginWithToken",
+			Method: "DELETE", URL: loginUrl, Status: http.StatusForbidden,
+			SetAuth: setTokenAuth,
+		},
+		Test{
+			Name:   "sessions:StillLoggedIn",
+			Method: "GET", URL: loginUrl, Status: http.StatusOK,
+		},
+
+		// Changing the password revokes every session.
+		Test{
+			Name:   "sessions:SetPassword",
+			Method: "PUT", URL: loginUrl, Status: http.StatusOK,
+			BodyFunc: func() string { return `{"Password":"` + newPassword + `"}` },
+		},
+		Test{
+			Name:   "sessions:TokenAfterPasswordChange",
+			Method: "GET", URL: loginUrl, Status: http.StatusUnauthorized,
+			SetAuth: setTokenAuth,
+		},
+		Test{
+			Name:   "sessions:ListAfterPasswordChange",
+			Method: "GET", URL: sessionsUrl, Status: http.StatusOK,
+			SetAuth: setNewPassword,
+			CheckBody: func(dec *json.Decoder) error {
+				if dec.More() {
+					return fmt.Errorf("Expected no sessions")
+				}
+				return nil
+			},
+		},
+	}
+}
+
+// TestRevokedSessionStreams checks that revoking a session ends the event
+// streams and WebSockets opened with it.
+func TestRevokedSessionStreams(t *testing.T) {
+	t.Parallel()
+	server, db := newServer(t)
+	run := func(test Test) {
+		t.Helper()
+		err := runTest(test, server.URL, db)
+		if err != nil {
+			t.Fatalf("%s: %s", test.Name, err)
+		}
+	}
+
+	current := session{}
+	run(Test{
+		Name: "CreateSession", Pre: addUsers,
+		Method: "POST", URL: sessionsUrl, Status: http.StatusCreated,
+		CheckBody: func(dec *json.Decoder) error { return dec.Decode(&current) },
+	})
+	setTokenAuth := func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer "+current.Token)
+	}
+	events := openEvents(t, server.URL, "/events", "", setTokenAuth)
+	_, messages := openWebSocket(t, server.URL, setTokenAuth)
+
+	run(Test{
+		Name:   "RevokeSession",
+		Method: "DELETE", URL: sessionsUrl + "/" + current.Id, Status: http.StatusOK,
+	})
+	// Changes wake the streams up.
+	run(Test{
+		Name:   "CreateProject",
+		Method: "POST", URL: projectsUrl, Status: http.StatusCreated,
+		BodyFunc: func() string { return `{"Name":"A"}` },
+	})
+	expectEnd(t, events)
+	select {
+	case msg, ok := <-messages:
+		if ok {
+			t.Fatalf("Expected the WebSocket to close, got %+v", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the WebSocket to close")
+	}
+}
+
+// vim: sw=4 ts=4 noexpandtab
@@ -0,0 +1,159 @@
+/*
+Tests for merging synchronised projects and deliverables.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestSync(t *testing.T) {
+	runSuite(t, syncTests())
+}
+
+// merged is the response to a PUT on a synchronised item.
+type merged struct {
+	Name        string
+	Description string
+	Version     uint
+	Kept        []string
+}
+
+// checkMerged returns a CheckBody function checking the merge result.
+func checkMerged(expected merged) func(*json.Decoder) error {
+	return func(dec *json.Decoder) error {
+		m := merged{}
+		err := dec.Decode(&m)
+		if err == nil && !reflect.DeepEqual(m, expected) {
+			err = fmt.Errorf("Expected %+v, got %+v", expected, m)
+		}
+		return err
+	}
+}
+
+// syncTests returns the tests for merging changes from several devices.
+// Each PUT below is from a device which last synced at the given version.
+func syncTests() []Test {
+	projectIds := []uint{}
+	deliverableIds := []uint{}
+	projectUrl := func() string {
+		return fmt.Sprintf("%s/%d", projectsUrl, projectIds[0])
+	}
+	projectBody := func(version uint, name, desc string) func() string {
+		return func() string {
+			return fmt.Sprintf(`{"Id":%d, "Version":%d, "Name":%q, "Description":%q, "Updated":"2017-12-19T00:00:00Z"}`,
+				projectIds[0], version, name, desc)
+		}
+	}
+	deliverableUrl := func() string {
+		return fmt.Sprintf("%s/%d/deliverables/%d", projectsUrl,
+			projectIds[0], deliverableIds[0])
+	}
+	deliverableBody := func(version uint, name, desc string) func() string {
+		return func() string {
+			return fmt.Sprintf(`{"Version":%d, "Name":%q, "Description":%q, "Updated":"2017-12-19T00:00:00Z", "Due":"2018-01-01T00:00:00Z"}`,
+				version, name, desc)
+		}
+	}
+
+	return []Test{
+		Test{
+			Name:   "sync:CreateProject",
+			Pre:    addUsers,
+			Method: "POST", URL: projectsUrl, Status: http.StatusCreated,
+			BodyFunc: func() string {
+				return `{"Name":"A", "Description":"A", "Updated":"2017-12-19"}`
+			},
+			CheckBody: func(dec *json.Decoder) error {
+				return getCreatedId(dec, &projectIds)
+			},
+		},
+		Test{
+			Name:   "sync:PutProject",
+			Method: "PUT", URLFunc: projectUrl, Status: http.StatusOK,
+			BodyFunc:  projectBody(0, "B", "A"),
+			CheckBody: checkMerged(merged{"B", "A", 1, []string{}}),
+		},
+		Test{
+			Name:   "sync:PutProjectUnchanged",
+			Method: "PUT", URLFunc: projectUrl, Status: http.StatusOK,
+			BodyFunc:  projectBody(1, "B", "A"),
+			CheckBody: checkMerged(merged{"B", "A", 1, []string{}}),
+		},
+		Test{
+			// The name changed after version 0, but the description did not.
+			Name:   "sync:PutProjectStale",
+			Method: "PUT", URLFunc: projectUrl, Status: http.StatusOK,
+			BodyFunc:  projectBody(0, "C", "C"),
+			CheckBody: checkMerged(merged{"B", "C", 2, []string{"Name"}}),
+		},
+		Test{
+			Name:   "sync:PutProjectCurrent",
+			Method: "PUT", URLFunc: projectUrl, Status: http.StatusOK,
+			BodyFunc:  projectBody(2, "D", "C"),
+			CheckBody: checkMerged(merged{"D", "C", 3, []string{}}),
+		},
+		Test{
+			Name:   "sync:PutProjectFuture",
+			Method: "PUT", URLFunc: projectUrl, Status: http.StatusBadRequest,
+			BodyFunc: projectBody(4, "E", "E"),
+		},
+		Test{
+			Name:   "sync:CheckProject",
+			Method: "GET", URLFunc: projectUrl, Status: http.StatusOK,
+			CheckBody: func(dec *json.Decoder) error {
+				return checkProjectEqual(dec, project{
+					Id:          projectIds[0],
+					Name:        "D",
+					Description: "C",
+					Version:     3,
+					Owns:        true,
+				})
+			},
+		},
+
+		Test{
+			Name:   "sync:CreateDeliverable",
+			Method: "POST", URLFunc: func() string {
+				return fmt.Sprintf("%s/%d/deliverables", projectsUrl, projectIds[0])
+			},
+			Status:   http.StatusCreated,
+			BodyFunc: deliverableBody(0, "A", "A"),
+			CheckBody: func(dec *json.Decoder) error {
+				return getCreatedId(dec, &deliverableIds)
+			},
+		},
+		Test{
+			Name:   "sync:PutDeliverable",
+			Method: "PUT", URLFunc: deliverableUrl, Status: http.StatusOK,
+			BodyFunc:  deliverableBody(0, "A", "B"),
+			CheckBody: checkMerged(merged{"A", "B", 1, []string{}}),
+		},
+		Test{
+			Name:   "sync:PutDeliverableStale",
+			Method: "PUT", URLFunc: deliverableUrl, Status: http.StatusOK,
+			BodyFunc:  deliverableBody(0, "C", "C"),
+			CheckBody: checkMerged(merged{"C", "B", 2, []string{"Description"}}),
+		},
+		Test{
+			Name:   "sync:PutDeliverableFuture",
+			Method: "PUT", URLFunc: deliverableUrl, Status: http.StatusBadRequest,
+			BodyFunc: deliverableBody(3, "D", "D"),
+		},
+		Test{
+			Name:   "sync:CheckDeliverable",
+			Method: "GET", URLFunc: deliverableUrl, Status: http.StatusOK,
+			CheckBody: checkMerged(merged{"C", "B", 2, nil}),
+		},
+	}
+}
+
+// vim: sw=4 ts=4 noexpandtab
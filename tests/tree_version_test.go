@@ -0,0 +1,140 @@
+/*
+Tests for the project tree versions.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestTreeVersion(t *testing.T) {
+	runSuite(t, treeVersionTests())
+}
+
+// treeVersionTests returns the tests checking that the tree version changes
+// with everything in the project, and only then.
+func treeVersionTests() []Test {
+	projectIds := []uint{}
+	last := uint(0)
+	projectUrl := func() string {
+		return fmt.Sprintf("%s/%d", projectsUrl, projectIds[0])
+	}
+
+	// checkList checks the version in the project list against the last
+	// version seen, and saves it.
+	checkList := func(changed bool) func(*json.Decoder) error {
+		return func(dec *json.Decoder) error {
+			v := struct{ Id, TreeVersion uint }{}
+			err := dec.Decode(&v)
+			if err != nil {
+				return err
+			} else if dec.More() {
+				return fmt.Errorf("Expected a single project")
+			} else if v.Id != projectIds[0] {
+				return fmt.Errorf("Expected project %d, got %d", projectIds[0], v.Id)
+			} else if changed && v.TreeVersion <= last {
+				return fmt.Errorf("Expected the version to increase from %d, got %d", last, v.TreeVersion)
+			} else if !changed && v.TreeVersion != last {
+				return fmt.Errorf("Expected version %d, got %d", last, v.TreeVersion)
+			}
+			last = v.TreeVersion
+			return nil
+		}
+	}
+	listTest := func(name string, changed bool) Test {
+		return Test{
+			Name:   name,
+			Method: "GET", URL: projectsUrl + "?versions=1", Status: http.StatusOK,
+			CheckBody: checkList(changed),
+		}
+	}
+
+	return []Test{
+		Test{
+			Name:   "tree:CreateProject",
+			Pre:    addUsers,
+			Method: "POST", URL: projectsUrl, Status: http.StatusCreated,
+			BodyFunc: func() string {
+				return `{"Name":"Test Project", "Updated":"2017-12-19"}`
+			},
+			CheckBody: func(dec *json.Decoder) error {
+				return getCreatedId(dec, &projectIds)
+			},
+		},
+		listTest("tree:Initial", true),
+		Test{
+			Name:   "tree:GetProject",
+			Method: "GET", URLFunc: projectUrl, Status: http.StatusOK,
+			CheckBody: func(dec *json.Decoder) error {
+				v := struct{ TreeVersion uint }{}
+				err := dec.Decode(&v)
+				if err == nil && v.TreeVersion != last {
+					err = fmt.Errorf("Expected version %d, got %d", last, v.TreeVersion)
+				}
+				return err
+			},
+		},
+		listTest("tree:Unchanged", false),
+		Test{
+			Name:   "tree:SetFlag",
+			Method: "PUT", URLFunc: func() string { return projectUrl() + "/flag" },
+			Status:   http.StatusOK,
+			BodyFunc: func() string { return `{"Version":0, "Value":true}` },
+		},
+		listTest("tree:FlagChanged", true),
+		Test{
+			Name:   "tree:CreateDeliverable",
+			Method: "POST", URLFunc: func() string { return projectUrl() + "/deliverables" },
+			Status: http.StatusCreated,
+			BodyFunc: func() string {
+				return `{"Name":"Deliverable", "Description":"Deliverable", "Updated":"2017-12-19", "Due":"2018-01-01T00:00:00Z"}`
+			},
+		},
+		listTest("tree:DeliverableChanged", true),
+		Test{
+			Name:   "tree:AddClient",
+			Method: "POST", URLFunc: func() string { return projectUrl() + "/clients" },
+			Status:   http.StatusCreated,
+			BodyFunc: func() string { return `{"Name":"` + client1User + `"}` },
+		},
+		listTest("tree:ClientsChanged", true),
+		Test{
+			Name:   "tree:SetProject",
+			Method: "PUT", URLFunc: projectUrl, Status: http.StatusOK,
+			BodyFunc: func() string {
+				return fmt.Sprintf(`{"Id":%d, "Name":"Renamed", "Updated":"2017-12-19"}`,
+					projectIds[0])
+			},
+			CheckBody: func(dec *json.Decoder) error {
+				v := struct{ TreeVersion uint }{}
+				err := dec.Decode(&v)
+				if err == nil && v.TreeVersion <= last {
+					err = fmt.Errorf("Expected the version to increase from %d, got %d", last, v.TreeVersion)
+				}
+				return err
+			},
+		},
+		listTest("tree:ProjectChanged", true),
+		Test{
+			Name:   "tree:PlainList",
+			Method: "GET", URL: projectsUrl, Status: http.StatusOK,
+			CheckBody: func(dec *json.Decoder) error {
+				ids := []uint{}
+				err := getProjectIds(dec, &ids)
+				if err == nil && (len(ids) != 1 || ids[0] != projectIds[0]) {
+					err = fmt.Errorf("Expected [%d], got %v", projectIds[0], ids)
+				}
+				return err
+			},
+		},
+	}
+}
+
+// vim: sw=4 ts=4 noexpandtab
@@ -0,0 +1,139 @@
+/*
+Tests for validating uploaded projects and deliverables.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestValidation(t *testing.T) {
+	runSuite(t, validationTests())
+}
+
+// dates is the subset of a deliverable including the dates.
+type dates struct {
+	Id      uint
+	Due     string
+	Updated string
+}
+
+// checkDates returns a CheckBody function checking the due date, and that
+// Updated was set by the server.
+// The id is appended to ids, if given.
+func checkDates(due string, ids *[]uint) func(*json.Decoder) error {
+	return func(dec *json.Decoder) error {
+		d := dates{}
+		err := dec.Decode(&d)
+		if err != nil {
+			return err
+		}
+		if d.Due != due {
+			return fmt.Errorf("Expected due date %s, got %s", due, d.Due)
+		}
+		updated, err := time.Parse(time.RFC3339, d.Updated)
+		if err != nil {
+			return err
+		}
+		if time.Since(updated) > time.Hour {
+			return fmt.Errorf("Expected Updated to be recent, got %s", d.Updated)
+		}
+		if ids != nil {
+			*ids = append(*ids, d.Id)
+		}
+		return nil
+	}
+}
+
+// validationTests returns the tests for validating uploads.
+func validationTests() []Test {
+	projectIds := []uint{}
+	deliverableIds := []uint{}
+	deliverablesUrl := func() string {
+		return fmt.Sprintf("%s/%d/deliverables", projectsUrl, projectIds[0])
+	}
+	deliverableUrl := func() string {
+		return fmt.Sprintf("%s/%d", deliverablesUrl(), deliverableIds[0])
+	}
+	deliverableBody := func(due string) func() string {
+		return func() string {
+			return fmt.Sprintf(`{"Name":"A", "Description":"A", "Updated":"2000-01-01T00:00:00Z", "Due":%q}`,
+				due)
+		}
+	}
+	invalidDue := func(name, due string) Test {
+		return Test{
+			Name:   "validation:" + name,
+			Method: "POST", URLFunc: deliverablesUrl,
+			Status:    http.StatusBadRequest,
+			BodyFunc:  deliverableBody(due),
+			CheckBody: checkProblem(http.StatusBadRequest, "invalid_body", "Due"),
+		}
+	}
+
+	return []Test{
+		Test{
+			// Clients don't need to send Updated.
+			Name:   "validation:CreateProject",
+			Pre:    addUsers,
+			Method: "POST", URL: projectsUrl, Status: http.StatusCreated,
+			BodyFunc: func() string { return `{"Name":"A"}` },
+			CheckBody: func(dec *json.Decoder) error {
+				return getCreatedId(dec, &projectIds)
+			},
+		},
+		Test{
+			// Dates are normalised to UTC, and Updated is set by the server.
+			Name:   "validation:CreateDeliverable",
+			Method: "POST", URLFunc: deliverablesUrl, Status: http.StatusCreated,
+			BodyFunc:  deliverableBody("2018-01-01T10:30:00.5+10:00"),
+			CheckBody: checkDates("2018-01-01T00:30:00Z", &deliverableIds),
+		},
+		Test{
+			Name:   "validation:Get",
+			Method: "GET", URLFunc: deliverableUrl, Status: http.StatusOK,
+			CheckBody: checkDates("2018-01-01T00:30:00Z", nil),
+		},
+		invalidDue("MissingDue", ""),
+		invalidDue("DateOnly", "2018-01-01"),
+		invalidDue("NoTimeZone", "2018-01-01T00:00:00"),
+		invalidDue("ImpossibleDate", "2018-02-30T00:00:00Z"),
+		invalidDue("ImpossibleTime", "2018-01-01T25:00:00Z"),
+		invalidDue("TooEarly", "1000-01-01T00:00:00Z"),
+		Test{
+			Name:   "validation:Set",
+			Method: "PUT", URLFunc: deliverableUrl, Status: http.StatusOK,
+			BodyFunc:  deliverableBody("2018-06-01T00:00:00-02:00"),
+			CheckBody: checkDates("2018-06-01T02:00:00Z", nil),
+		},
+		Test{
+			Name:   "validation:SetInvalid",
+			Method: "PUT", URLFunc: deliverableUrl, Status: http.StatusBadRequest,
+			BodyFunc:  deliverableBody("2018-06-01"),
+			CheckBody: checkProblem(http.StatusBadRequest, "invalid_body", "Due"),
+		},
+		Test{
+			// Patches are validated the same way.
+			Name:   "validation:PatchInvalid",
+			Method: "PATCH", URLFunc: deliverableUrl, Status: http.StatusBadRequest,
+			BodyFunc:  func() string { return `{"Due":"tomorrow", "Percentage":200}` },
+			CheckBody: checkProblem(http.StatusBadRequest, "invalid_body", "Due", "Percentage"),
+		},
+		Test{
+			Name:   "validation:PatchUpdated",
+			Method: "PATCH", URLFunc: deliverableUrl, Status: http.StatusBadRequest,
+			BodyFunc:  func() string { return `{"Updated":"2000-01-01T00:00:00Z"}` },
+			CheckBody: checkProblem(http.StatusBadRequest, "invalid_body", "Updated"),
+		},
+	}
+}
+
+// vim: sw=4 ts=4 noexpandtab
@@ -0,0 +1,347 @@
+/*
+Tests for webhooks.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package tests
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mel-app/backend/src"
+)
+
+// webhookRequest is a delivery received by a receiver.
+type webhookRequest struct {
+	Path    string
+	Header  http.Header
+	Body    []byte
+	Payload struct {
+		Id      uint
+		Event   string
+		Project uint
+		User    string
+		Data    json.RawMessage
+	}
+}
+
+// newReceiver starts a server receiving webhook deliveries.
+// The first failures requests are rejected with 500 Internal Server Error.
+func newReceiver(t *testing.T, failures int32) (*httptest.Server, <-chan webhookRequest) {
+	requests := make(chan webhookRequest, 100)
+	receiver := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&failures, -1) >= 0 {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			req := webhookRequest{Path: r.URL.Path, Header: r.Header}
+			req.Body, _ = io.ReadAll(r.Body)
+			json.Unmarshal(req.Body, &req.Payload)
+			requests <- req
+		}))
+	t.Cleanup(receiver.Close)
+	return receiver, requests
+}
+
+// nextDeliveries returns the next n deliveries, keyed by the path and event.
+func nextDeliveries(t *testing.T, requests <-chan webhookRequest, n int) map[string]webhookRequest {
+	t.Helper()
+	result := map[string]webhookRequest{}
+	for i := 0; i < n; i++ {
+		select {
+		case req := <-requests:
+			result[req.Path+" "+req.Payload.Event] = req
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for a delivery")
+		}
+	}
+	return result
+}
+
+// expectDelivery fails unless the event was delivered to the path.
+func expectDelivery(t *testing.T, deliveries map[string]webhookRequest, path, event string) webhookRequest {
+	t.Helper()
+	req, ok := deliveries[path+" "+event]
+	if !ok {
+		t.Fatalf("No %s delivery to %s", event, path)
+	}
+	return req
+}
+
+func TestWebhooks(t *testing.T) {
+	t.Parallel()
+	// The receiver is on the loopback address.
+	server, db := newServer(t, backend.WithPrivateWebhooks())
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go db.DeliverWebhooks(ctx, backend.WithPrivateWebhooks(),
+		backend.WithWebhookRetryDelay(10*time.Millisecond))
+	receiver, requests := newReceiver(t, 1)
+	run := func(test Test) {
+		t.Helper()
+		err := runTest(test, server.URL, db)
+		if err != nil {
+			t.Fatalf("%s: %s", test.Name, err)
+		}
+	}
+
+	projectIds := []uint{}
+	run(Test{
+		Name: "CreateProject", Pre: addUsers,
+		Method: "POST", URL: projectsUrl, Status: http.StatusCreated,
+		BodyFunc: func() string { return `{"Name":"A"}` },
+		CheckBody: func(dec *json.Decoder) error {
+			return getCreatedId(dec, &projectIds)
+		},
+	})
+	projectUrl := fmt.Sprintf("%s/%d", projectsUrl, projectIds[0])
+
+	// Owners can add webhooks to the project.
+	hookIds := []uint{}
+	run(Test{
+		Name:   "AddProjectWebhook",
+		Method: "POST", URL: projectUrl + "/webhooks", Status: http.StatusCreated,
+		BodyFunc: func() string {
+			return `{"URL":"` + receiver.URL + `/project", "Secret":"secret",
+			"Events":["deliverable.created", "deliverable.submitted",
+			"flag.changed", "client.added", "project.deleted"]}`
+		},
+		CheckBody: func(dec *json.Decoder) error {
+			hook := struct {
+				Id     uint
+				Secret string
+			}{}
+			err := dec.Decode(&hook)
+			if err != nil {
+				return err
+			} else if hook.Secret != "secret" {
+				return fmt.Errorf("Expected the secret, got %+v", hook)
+			}
+			hookIds = append(hookIds, hook.Id)
+			return nil
+		},
+	})
+	hookUrl := fmt.Sprintf("%s/webhooks/%d", projectUrl, hookIds[0])
+	run(Test{
+		Name:   "GetProjectWebhook",
+		Method: "GET", URL: hookUrl, Status: http.StatusOK,
+		CheckBody: func(dec *json.Decoder) error {
+			hook := map[string]interface{}{}
+			err := dec.Decode(&hook)
+			if err != nil {
+				return err
+			} else if _, ok := hook["Secret"]; ok {
+				return fmt.Errorf("Expected no secret, got %v", hook)
+			}
+			return nil
+		},
+	})
+	run(Test{
+		Name:   "AddProjectWebhookAsClient",
+		Method: "POST", URL: projectUrl + "/webhooks", Status: http.StatusForbidden,
+		BodyFunc: func() string {
+			return `{"URL":"` + receiver.URL + `", "Events":["flag.changed"]}`
+		},
+		SetAuth: setClientAuth,
+	})
+
+	// Users can add webhooks for all of their projects.
+	run(Test{
+		Name:   "AddUserWebhook",
+		Method: "POST", URL: "/webhooks", Status: http.StatusCreated,
+		BodyFunc: func() string {
+			return `{"URL":"` + receiver.URL + `/user",
+			"Events":["client.added", "deliverable.created"]}`
+		},
+		CheckBody: func(dec *json.Decoder) error {
+			return getCreatedId(dec, &hookIds)
+		},
+		SetAuth: setClientAuth,
+	})
+	userHookUrl := fmt.Sprintf("/webhooks/%d", hookIds[1])
+	run(Test{
+		Name:   "GetOtherUserWebhook",
+		Method: "GET", URL: userHookUrl, Status: http.StatusForbidden,
+	})
+
+	// Failed deliveries are retried, and deliveries are signed.
+	run(Test{
+		Name:   "SetFlag",
+		Method: "PUT", URL: projectUrl + "/flag", Status: http.StatusOK,
+		BodyFunc: func() string { return `{"Version":0, "Value":true}` },
+	})
+	req := expectDelivery(t, nextDeliveries(t, requests, 1), "/project", "flag.changed")
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(req.Body)
+	if sig := req.Header.Get("X-Mel-Signature"); sig != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+		t.Fatalf("Invalid signature %q", sig)
+	}
+	if req.Header.Get("X-Mel-Event") != "flag.changed" ||
+		req.Header.Get("X-Mel-Delivery") != fmt.Sprint(req.Payload.Id) ||
+		req.Payload.Project != projectIds[0] || req.Payload.User != defaultUser {
+		t.Fatalf("Unexpected delivery %+v", req)
+	}
+
+	// The delivery log shows each delivery; the status is updated just after
+	// delivering, so may take a moment.
+	checkLog := func(dec *json.Decoder) error {
+		d := struct {
+			Id       uint
+			Event    string
+			Status   string
+			Attempts uint
+		}{}
+		err := dec.Decode(&d)
+		if err != nil {
+			return err
+		} else if d.Id != req.Payload.Id || d.Event != "flag.changed" ||
+			d.Status != "delivered" || d.Attempts != 2 {
+			return fmt.Errorf("Unexpected delivery %+v", d)
+		}
+		return nil
+	}
+	for attempt := 0; ; attempt++ {
+		err := runTest(Test{
+			Name:   "DeliveryLog",
+			Method: "GET", URL: hookUrl + "/deliveries", Status: http.StatusOK,
+			CheckBody: checkLog,
+		}, server.URL, db)
+		if err == nil {
+			break
+		} else if attempt == 50 {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	run(Test{
+		Name:   "DeliveryLogAsClient",
+		Method: "GET", URL: hookUrl + "/deliveries", Status: http.StatusForbidden,
+		SetAuth: setClientAuth,
+	})
+
+	// Members' webhooks are sent events once they join.
+	run(Test{
+		Name:   "AddClient",
+		Method: "POST", URL: projectUrl + "/clients", Status: http.StatusCreated,
+		BodyFunc: func() string { return `{"Name":"` + client1User + `"}` },
+	})
+	deliveries := nextDeliveries(t, requests, 2)
+	expectDelivery(t, deliveries, "/project", "client.added")
+	expectDelivery(t, deliveries, "/user", "client.added")
+	deliverableIds := []uint{}
+	run(Test{
+		Name:   "CreateDeliverable",
+		Method: "POST", URL: projectUrl + "/deliverables", Status: http.StatusCreated,
+		BodyFunc: func() string {
+			return `{"Name":"A", "Description":"A", "Due":"2018-01-01T00:00:00Z"}`
+		},
+		CheckBody: func(dec *json.Decoder) error {
+			return getCreatedId(dec, &deliverableIds)
+		},
+	})
+	deliveries = nextDeliveries(t, requests, 2)
+	expectDelivery(t, deliveries, "/project", "deliverable.created")
+	expectDelivery(t, deliveries, "/user", "deliverable.created")
+	run(Test{
+		Name:   "SubmitDeliverable",
+		Method: "POST", Status: http.StatusCreated,
+		URL:      fmt.Sprintf("%s/deliverables/%d/history", projectUrl, deliverableIds[0]),
+		BodyFunc: func() string { return `{"State":"submitted"}` },
+	})
+	expectDelivery(t, nextDeliveries(t, requests, 1), "/project", "deliverable.submitted")
+
+	// Deleting the project is still delivered.
+	run(Test{
+		Name:   "DeleteProject",
+		Method: "DELETE", URL: projectUrl + "?scope=everyone", Status: http.StatusOK,
+	})
+	expectDelivery(t, nextDeliveries(t, requests, 1), "/project", "project.deleted")
+	run(Test{
+		Name:   "DeleteUserWebhook",
+		Method: "DELETE", URL: userHookUrl, Status: http.StatusOK,
+		SetAuth: setClientAuth,
+	})
+	run(Test{
+		Name:   "GetDeletedWebhook",
+		Method: "GET", URL: userHookUrl, Status: http.StatusNotFound,
+		SetAuth: setClientAuth,
+	})
+}
+
+func TestWebhookErrors(t *testing.T) {
+	runSuite(t, []Test{
+		Test{
+			Name:   "webhooks:InvalidURL",
+			Pre:    addUsers,
+			Method: "POST", URL: "/webhooks", Status: http.StatusBadRequest,
+			BodyFunc: func() string {
+				return `{"URL":"ftp://example.com", "Events":["flag.changed"]}`
+			},
+			CheckBody: checkProblem(http.StatusBadRequest, "invalid_body", "URL"),
+		},
+		Test{
+			Name:   "webhooks:LoopbackURL",
+			Method: "POST", URL: "/webhooks", Status: http.StatusBadRequest,
+			BodyFunc: func() string {
+				return `{"URL":"http://127.0.0.1:8080/hook", "Events":["flag.changed"]}`
+			},
+			CheckBody: checkProblem(http.StatusBadRequest, "invalid_body", "URL"),
+		},
+		Test{
+			Name:   "webhooks:LocalhostURL",
+			Method: "POST", URL: "/webhooks", Status: http.StatusBadRequest,
+			BodyFunc: func() string {
+				return `{"URL":"http://localhost/hook", "Events":["flag.changed"]}`
+			},
+			CheckBody: checkProblem(http.StatusBadRequest, "invalid_body", "URL"),
+		},
+		Test{
+			Name:   "webhooks:LinkLocalURL",
+			Method: "POST", URL: "/webhooks", Status: http.StatusBadRequest,
+			BodyFunc: func() string {
+				return `{"URL":"http://169.254.169.254/latest", "Events":["flag.changed"]}`
+			},
+			CheckBody: checkProblem(http.StatusBadRequest, "invalid_body", "URL"),
+		},
+		Test{
+			Name:   "webhooks:PrivateURL",
+			Method: "POST", URL: "/webhooks", Status: http.StatusBadRequest,
+			BodyFunc: func() string {
+				return `{"URL":"https://[fd00::1]/hook", "Events":["flag.changed"]}`
+			},
+			CheckBody: checkProblem(http.StatusBadRequest, "invalid_body", "URL"),
+		},
+		Test{
+			Name:   "webhooks:UnknownEvent",
+			Method: "POST", URL: "/webhooks", Status: http.StatusBadRequest,
+			BodyFunc: func() string {
+				return `{"URL":"https://example.com", "Events":["flag.waved"]}`
+			},
+			CheckBody: checkProblem(http.StatusBadRequest, "invalid_body", "Events"),
+		},
+		Test{
+			Name:   "webhooks:NoSuchWebhook",
+			Method: "GET", URL: "/webhooks/1", Status: http.StatusNotFound,
+		},
+		Test{
+			Name:   "webhooks:NoSuchProject",
+			Method: "GET", URL: "/projects/1/webhooks", Status: http.StatusForbidden,
+		},
+	})
+}
+
+// vim: sw=4 ts=4 noexpandtab
@@ -0,0 +1,275 @@
+/*
+Tests for the WebSocket channel.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsMessage is any message from the server.
+type wsMessage struct {
+	Id      string
+	Type    string
+	Status  int
+	Body    []json.RawMessage
+	Error   *problem
+	Seq     uint
+	Kind    string
+	Path    string
+	Deleted bool
+	Item    json.RawMessage
+}
+
+// openWebSocket connects to the WebSocket, and returns the connection and a
+// channel receiving each message.
+func openWebSocket(t *testing.T, root string, setAuth func(*http.Request)) (*websocket.Conn, <-chan wsMessage) {
+	req, err := http.NewRequest("GET", root+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setAuth(req)
+	url := "ws" + strings.TrimPrefix(root, "http") + "/ws"
+	conn, _, err := websocket.DefaultDialer.Dial(url, req.Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	messages := make(chan wsMessage, 100)
+	go func() {
+		defer close(messages)
+		for {
+			msg := wsMessage{}
+			err := conn.ReadJSON(&msg)
+			if err != nil {
+				return
+			}
+			messages <- msg
+		}
+	}()
+	return conn, messages
+}
+
+// send a message to the server.
+func send(t *testing.T, conn *websocket.Conn, msg string) {
+	t.Helper()
+	err := conn.WriteMessage(websocket.TextMessage, []byte(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// nextMessages returns the next n messages, failing if they don't arrive
+// within a few seconds.
+func nextMessages(t *testing.T, messages <-chan wsMessage, n int) []wsMessage {
+	t.Helper()
+	result := []wsMessage{}
+	for len(result) < n {
+		select {
+		case msg, ok := <-messages:
+			if !ok {
+				t.Fatalf("The connection closed unexpectedly")
+			}
+			result = append(result, msg)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for a message")
+		}
+	}
+	return result
+}
+
+// findResponse returns the response with the given id, failing if there is
+// none or it has the wrong status.
+func findResponse(t *testing.T, msgs []wsMessage, id string, status int) wsMessage {
+	t.Helper()
+	for _, msg := range msgs {
+		if msg.Type == "response" && msg.Id == id {
+			if msg.Status != status {
+				t.Fatalf("Expected %d for %s, got %+v", status, id, msg)
+			}
+			return msg
+		}
+	}
+	t.Fatalf("No response for %s in %+v", id, msgs)
+	return wsMessage{}
+}
+
+// findChange fails unless there is a change for the given path.
+func findChange(t *testing.T, msgs []wsMessage, kind, path string) wsMessage {
+	t.Helper()
+	for _, msg := range msgs {
+		if msg.Type == "change" && msg.Kind == kind && msg.Path == path {
+			return msg
+		}
+	}
+	t.Fatalf("No %s change for %s in %+v", kind, path, msgs)
+	return wsMessage{}
+}
+
+func TestWebSocket(t *testing.T) {
+	t.Parallel()
+	server, db := newServer(t)
+	run := func(test Test) {
+		t.Helper()
+		err := runTest(test, server.URL, db)
+		if err != nil {
+			t.Fatalf("%s: %s", test.Name, err)
+		}
+	}
+	setAuth := func(r *http.Request) { r.SetBasicAuth(defaultUser, defaultPassword) }
+
+	projectIds := []uint{}
+	run(Test{
+		Name: "CreateProject", Pre: addUsers,
+		Method: "POST", URL: projectsUrl, Status: http.StatusCreated,
+		BodyFunc: func() string { return `{"Name":"A"}` },
+		CheckBody: func(dec *json.Decoder) error {
+			return getCreatedId(dec, &projectIds)
+		},
+	})
+	projectUrl := fmt.Sprintf("%s/%d", projectsUrl, projectIds[0])
+	flagUrl := projectUrl + "/flag"
+	ownerPath := fmt.Sprintf("%s/clients/%s", projectUrl, clientId(defaultUser))
+	conn, messages := openWebSocket(t, server.URL, setAuth)
+
+	// Subscribing sends the whole project.
+	send(t, conn, fmt.Sprintf(`{"Id":"1", "Type":"subscribe", "Projects":[%d]}`,
+		projectIds[0]))
+	msgs := nextMessages(t, messages, 4)
+	if msgs[0].Type != "response" {
+		t.Fatalf("Expected the response first, got %+v", msgs[0])
+	}
+	findResponse(t, msgs, "1", http.StatusOK)
+	findChange(t, msgs, "project", projectUrl)
+	findChange(t, msgs, "flag", flagUrl)
+	findChange(t, msgs, "membership", ownerPath)
+
+	// Requests are answered, and the merged state is pushed.
+	send(t, conn, `{"Id":"2", "Type":"request", "Method":"PUT", "Path":"`+
+		flagUrl+`", "Body":{"Version":0, "Value":true}}`)
+	msgs = nextMessages(t, messages, 2)
+	findResponse(t, msgs, "2", http.StatusOK)
+	change := findChange(t, msgs, "flag", flagUrl)
+	flag := struct {
+		Version uint
+		Value   bool
+	}{}
+	if json.Unmarshal(change.Item, &flag) != nil || flag.Version != 1 || !flag.Value {
+		t.Fatalf("Expected the merged flag, got %s", change.Item)
+	}
+
+	// Failed requests return a problem.
+	send(t, conn, `{"Id":"3", "Type":"request", "Method":"PUT", "Path":"`+
+		flagUrl+`", "Body":{"Version":10, "Value":true}}`)
+	res := findResponse(t, nextMessages(t, messages, 1), "3", http.StatusBadRequest)
+	if res.Error == nil || res.Error.Code != "invalid_body" {
+		t.Fatalf("Expected a problem, got %+v", res)
+	}
+
+	// Changes made by other users are pushed too.
+	run(Test{
+		Name:   "SetFlag",
+		Method: "PUT", URL: flagUrl, Status: http.StatusOK,
+		BodyFunc: func() string { return `{"Version":1, "Value":false}` },
+	})
+	findChange(t, nextMessages(t, messages, 1), "flag", flagUrl)
+
+	// Users can only subscribe to projects they can see.
+	clientConn, clientMessages := openWebSocket(t, server.URL, setClientAuth)
+	send(t, clientConn, fmt.Sprintf(`{"Id":"1", "Type":"subscribe", "Projects":[%d]}`,
+		projectIds[0]))
+	res = findResponse(t, nextMessages(t, clientMessages, 1), "1", http.StatusForbidden)
+	if res.Error == nil || res.Error.Code != "access_denied" {
+		t.Fatalf("Expected a problem, got %+v", res)
+	}
+	send(t, clientConn, `{"Id":"2", "Type":"publish"}`)
+	findResponse(t, nextMessages(t, clientMessages, 1), "2", http.StatusBadRequest)
+
+	// Nothing is pushed after unsubscribing.
+	send(t, conn, `{"Id":"4", "Type":"unsubscribe"}`)
+	findResponse(t, nextMessages(t, messages, 1), "4", http.StatusOK)
+	run(Test{
+		Name:   "SetFlagUnsubscribed",
+		Method: "PUT", URL: flagUrl, Status: http.StatusOK,
+		BodyFunc: func() string { return `{"Version":2, "Value":true}` },
+	})
+	send(t, conn, `{"Id":"5", "Type":"request", "Method":"GET", "Path":"`+
+		flagUrl+`"}`)
+	msgs = nextMessages(t, messages, 1)
+	findResponse(t, msgs, "5", http.StatusOK)
+
+	// Resubscribing sends the project as of the latest change, even if that
+	// change hasn't been pushed yet.
+	send(t, conn, `{"Id":"6", "Type":"request", "Method":"PUT", "Path":"`+
+		flagUrl+`", "Body":{"Version":3, "Value":false}}`)
+	send(t, conn, fmt.Sprintf(`{"Id":"7", "Type":"subscribe", "Projects":[%d]}`,
+		projectIds[0]))
+	msgs = nextMessages(t, messages, 5)
+	findResponse(t, msgs, "6", http.StatusOK)
+	findResponse(t, msgs, "7", http.StatusOK)
+	change = findChange(t, msgs, "flag", flagUrl)
+	latest := feed{}
+	run(Test{
+		Name:   "GetCursor",
+		Method: "GET", URL: "/sync", Status: http.StatusOK,
+		CheckBody: func(dec *json.Decoder) error { return dec.Decode(&latest) },
+	})
+	if change.Seq != latest.Cursor {
+		t.Fatalf("Expected the flag as of %d, got %+v", latest.Cursor, change)
+	}
+
+	// Subscribing to every project includes projects joined later.
+	send(t, clientConn, `{"Id":"3", "Type":"subscribe"}`)
+	findResponse(t, nextMessages(t, clientMessages, 1), "3", http.StatusOK)
+	run(Test{
+		Name:   "AddClient",
+		Method: "POST", URL: projectUrl + "/clients", Status: http.StatusCreated,
+		BodyFunc: func() string { return `{"Name":"` + client1User + `"}` },
+	})
+	msgs = nextMessages(t, clientMessages, 3)
+	findChange(t, msgs, "project", projectUrl)
+	findChange(t, msgs, "flag", flagUrl)
+
+	// Deleting the project sends a tombstone.
+	run(Test{
+		Name:   "DeleteProject",
+		Method: "DELETE", URL: projectUrl + "?scope=everyone", Status: http.StatusOK,
+	})
+	change = findChange(t, nextMessages(t, clientMessages, 1), "project", projectUrl)
+	if !change.Deleted {
+		t.Fatalf("Expected a tombstone, got %+v", change)
+	}
+}
+
+func TestWebSocketErrors(t *testing.T) {
+	runSuite(t, []Test{
+		Test{
+			Name:   "ws:Unauthorized",
+			Pre:    addUsers,
+			Method: "GET", URL: "/ws", Status: http.StatusUnauthorized,
+			SetAuth: setNilAuth,
+		},
+		Test{
+			Name:   "ws:InvalidMethod",
+			Method: "POST", URL: "/ws", Status: http.StatusMethodNotAllowed,
+		},
+		Test{
+			Name:   "ws:NotUpgraded",
+			Method: "GET", URL: "/ws", Status: http.StatusBadRequest,
+		},
+	})
+}
+
+// vim: sw=4 ts=4 noexpandtab
@@ -0,0 +1,342 @@
+/*
+Tests for the deliverable review workflow.
+
+Author:		Alastair Hughes
+Contact:	<hobbitalastair at yandex dot com>
+*/
+
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestWorkflow(t *testing.T) {
+	runSuite(t, workflowTests())
+}
+
+// transition is a single entry in a deliverable's history.
+type transition struct {
+	Id    uint
+	From  string
+	State string
+	User  string
+	Note  string
+	Time  string
+}
+
+// checkState returns a CheckBody function checking the deliverable's state.
+func checkState(state string, submitted bool) func(*json.Decoder) error {
+	return func(dec *json.Decoder) error {
+		v := struct {
+			State     string
+			Submitted bool
+		}{}
+		err := dec.Decode(&v)
+		if err == nil && (v.State != state || v.Submitted != submitted) {
+			err = fmt.Errorf("Expected %s (submitted %t), got %+v", state,
+				submitted, v)
+		}
+		return err
+	}
+}
+
+// checkHistory returns a CheckBody function checking the history matches the
+// given transitions, ignoring the ids and times.
+func checkHistory(expected []transition) func(*json.Decoder) error {
+	return func(dec *json.Decoder) error {
+		got := []transition{}
+		for dec.More() {
+			t := transition{}
+			err := dec.Decode(&t)
+			if err != nil {
+				return err
+			} else if t.Id == 0 || t.Time == "" {
+				return fmt.Errorf("Expected an id and time, got %+v", t)
+			}
+			t.Id, t.Time = 0, ""
+			got = append(got, t)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(expected) {
+			return fmt.Errorf("Expected history %+v, got %+v", expected, got)
+		}
+		return nil
+	}
+}
+
+// workflowTests returns the tests for moving a deliverable through review.
+// The default user owns the project, and the first client is a viewer.
+func workflowTests() []Test {
+	projectIds := []uint{}
+	deliverableIds := []uint{}
+	transitionIds := []uint{}
+	projectUrl := func() string {
+		return fmt.Sprintf("%s/%d", projectsUrl, projectIds[0])
+	}
+	deliverableUrl := func() string {
+		return fmt.Sprintf("%s/deliverables/%d", projectUrl(), deliverableIds[0])
+	}
+	historyUrl := func() string {
+		return deliverableUrl() + "/history"
+	}
+	secondUrl := func() string {
+		return fmt.Sprintf("%s/deliverables/%d", projectUrl(), deliverableIds[1])
+	}
+	thirdUrl := func() string {
+		return fmt.Sprintf("%s/deliverables/%d", projectUrl(), deliverableIds[2])
+	}
+	draft := `{"Name":"B", "Description":"B", "Due":"2018-01-01T00:00:00Z"}`
+	submitted := `{"Name":"B", "Description":"B", "Due":"2018-01-01T00:00:00Z",
+		"Submitted":true}`
+	moveTo := func(state, note string) func() string {
+		return func() string {
+			return fmt.Sprintf(`{"State":%q, "Note":%q}`, state, note)
+		}
+	}
+
+	return []Test{
+		Test{
+			Name:   "workflow:CreateProject",
+			Pre:    addUsers,
+			Method: "POST", URL: projectsUrl, Status: http.StatusCreated,
+			BodyFunc: func() string { return `{"Name":"Test Project"}` },
+			CheckBody: func(dec *json.Decoder) error {
+				return getCreatedId(dec, &projectIds)
+			},
+		},
+		Test{
+			Name:   "workflow:AddClient",
+			Method: "POST", URLFunc: func() string { return projectUrl() + "/clients" },
+			Status:   http.StatusCreated,
+			BodyFunc: func() string { return `{"Name":"` + client1User + `"}` },
+		},
+		Test{
+			// New deliverables are drafts, whatever was uploaded.
+			Name:   "workflow:CreateDeliverable",
+			Method: "POST", URLFunc: func() string { return projectUrl() + "/deliverables" },
+			Status: http.StatusCreated,
+			BodyFunc: func() string {
+				return `{"Name":"A", "Description":"A", "Due":"2018-01-01T00:00:00Z",
+				"State":"accepted", "Submitted":true}`
+			},
+			CheckBody: func(dec *json.Decoder) error {
+				return getCreatedId(dec, &deliverableIds)
+			},
+		},
+		Test{
+			Name:   "workflow:GetDraft",
+			Method: "GET", URLFunc: deliverableUrl, Status: http.StatusOK,
+			CheckBody: checkState("draft", false),
+		},
+		Test{
+			// The state can only be changed through the history.
+			Name:   "workflow:PatchSubmitted",
+			Method: "PATCH", URLFunc: deliverableUrl, Status: http.StatusBadRequest,
+			BodyFunc: func() string { return `{"Submitted":true}` },
+		},
+		Test{
+			Name:   "workflow:ReviewDraft",
+			Method: "POST", URLFunc: historyUrl, Status: http.StatusConflict,
+			BodyFunc:  moveTo("in_review", ""),
+			CheckBody: checkProblem(http.StatusConflict, "invalid_transition"),
+		},
+		Test{
+			Name:   "workflow:UnknownState",
+			Method: "POST", URLFunc: historyUrl, Status: http.StatusBadRequest,
+			BodyFunc:  moveTo("finished", ""),
+			CheckBody: checkProblem(http.StatusBadRequest, "invalid_body", "State"),
+		},
+
+		// Clients submit, and owners review.
+		Test{
+			Name:   "workflow:SubmitAsClient",
+			Method: "POST", URLFunc: historyUrl, Status: http.StatusCreated,
+			BodyFunc: moveTo("submitted", ""),
+			CheckBody: func(dec *json.Decoder) error {
+				return getCreatedId(dec, &transitionIds)
+			},
+			SetAuth: setClientAuth,
+		},
+		Test{
+			Name:   "workflow:GetSubmitted",
+			Method: "GET", URLFunc: deliverableUrl, Status: http.StatusOK,
+			CheckBody: checkState("submitted", true),
+		},
+		Test{
+			Name:   "workflow:GetTransition",
+			Method: "GET", Status: http.StatusOK,
+			URLFunc: func() string {
+				return fmt.Sprintf("%s/%d", historyUrl(), transitionIds[0])
+			},
+			CheckBody: checkHistory([]transition{{From: "draft", State: "submitted",
+				User: client1User}}),
+			SetAuth: setClientAuth,
+		},
+		Test{
+			Name:   "workflow:ReviewAsClient",
+			Method: "POST", URLFunc: historyUrl, Status: http.StatusForbidden,
+			BodyFunc: moveTo("in_review", ""),
+			SetAuth:  setClientAuth,
+		},
+		Test{
+			Name:   "workflow:Review",
+			Method: "POST", URLFunc: historyUrl, Status: http.StatusCreated,
+			BodyFunc: moveTo("in_review", ""),
+		},
+		Test{
+			Name:   "workflow:RejectWithoutNote",
+			Method: "POST", URLFunc: historyUrl, Status: http.StatusBadRequest,
+			BodyFunc:  moveTo("rejected", ""),
+			CheckBody: checkProblem(http.StatusBadRequest, "invalid_body", "Note"),
+		},
+		Test{
+			Name:   "workflow:Reject",
+			Method: "POST", URLFunc: historyUrl, Status: http.StatusCreated,
+			BodyFunc: moveTo("rejected", "Needs more detail"),
+		},
+		Test{
+			Name:   "workflow:GetRejected",
+			Method: "GET", URLFunc: deliverableUrl, Status: http.StatusOK,
+			CheckBody: checkState("rejected", false),
+			SetAuth:   setClientAuth,
+		},
+		Test{
+			Name:   "workflow:Resubmit",
+			Method: "POST", URLFunc: historyUrl, Status: http.StatusCreated,
+			BodyFunc: moveTo("submitted", ""),
+			SetAuth:  setClientAuth,
+		},
+		Test{
+			Name:   "workflow:ReviewAgain",
+			Method: "POST", URLFunc: historyUrl, Status: http.StatusCreated,
+			BodyFunc: moveTo("in_review", ""),
+		},
+		Test{
+			Name:   "workflow:Accept",
+			Method: "POST", URLFunc: historyUrl, Status: http.StatusCreated,
+			BodyFunc: moveTo("accepted", "Looks good"),
+		},
+		Test{
+			// Accepted deliverables are final.
+			Name:   "workflow:WithdrawAccepted",
+			Method: "POST", URLFunc: historyUrl, Status: http.StatusConflict,
+			BodyFunc:  moveTo("draft", ""),
+			CheckBody: checkProblem(http.StatusConflict, "invalid_transition"),
+			SetAuth:   setClientAuth,
+		},
+		Test{
+			Name:   "workflow:GetAccepted",
+			Method: "GET", URLFunc: deliverableUrl, Status: http.StatusOK,
+			CheckBody: checkState("accepted", true),
+		},
+		Test{
+			Name:   "workflow:GetHistory",
+			Method: "GET", URLFunc: historyUrl, Status: http.StatusOK,
+			CheckBody: checkHistory([]transition{
+				{From: "draft", State: "submitted", User: client1User},
+				{From: "submitted", State: "in_review", User: defaultUser},
+				{From: "in_review", State: "rejected", User: defaultUser,
+					Note: "Needs more detail"},
+				{From: "rejected", State: "submitted", User: client1User},
+				{From: "submitted", State: "in_review", User: defaultUser},
+				{From: "in_review", State: "accepted", User: defaultUser,
+					Note: "Looks good"},
+			}),
+			SetAuth: setClientAuth,
+		},
+		Test{
+			Name:   "workflow:SetTransition",
+			Method: "PUT", Status: http.StatusForbidden,
+			URLFunc: func() string {
+				return fmt.Sprintf("%s/%d", historyUrl(), transitionIds[0])
+			},
+			BodyFunc: moveTo("draft", ""),
+		},
+		Test{
+			Name:   "workflow:NoSuchTransition",
+			Method: "GET", URLFunc: func() string { return historyUrl() + "/1" },
+			Status: http.StatusNotFound,
+		},
+		Test{
+			Name:   "workflow:DeleteDeliverable",
+			Method: "DELETE", URLFunc: deliverableUrl, Status: http.StatusOK,
+		},
+		Test{
+			Name:   "workflow:GetDeletedHistory",
+			Method: "GET", URLFunc: historyUrl, Status: http.StatusNotFound,
+		},
+
+		// Older clients submit by setting Submitted.
+		Test{
+			Name:   "workflow:CreateSecond",
+			Method: "POST", URLFunc: func() string { return projectUrl() + "/deliverables" },
+			Status:   http.StatusCreated,
+			BodyFunc: func() string { return draft },
+			CheckBody: func(dec *json.Decoder) error {
+				return getCreatedId(dec, &deliverableIds)
+			},
+		},
+		Test{
+			Name:   "workflow:PutSubmitted",
+			Method: "PUT", URLFunc: secondUrl, Status: http.StatusOK,
+			BodyFunc:  func() string { return submitted },
+			CheckBody: checkState("submitted", true),
+		},
+		Test{
+			Name:   "workflow:GetPutSubmittedHistory",
+			Method: "GET", URLFunc: func() string { return secondUrl() + "/history" },
+			Status: http.StatusOK,
+			CheckBody: checkHistory([]transition{
+				{From: "draft", State: "submitted", User: defaultUser},
+			}),
+		},
+		Test{
+			// Only drafts are submitted, so stale uploads change nothing.
+			Name:   "workflow:PutSubmittedAgain",
+			Method: "PUT", URLFunc: secondUrl, Status: http.StatusOK,
+			BodyFunc:  func() string { return submitted },
+			CheckBody: checkState("submitted", true),
+		},
+		Test{
+			Name:   "workflow:PutUnsubmitted",
+			Method: "PUT", URLFunc: secondUrl, Status: http.StatusOK,
+			BodyFunc:  func() string { return draft },
+			CheckBody: checkState("submitted", true),
+		},
+		Test{
+			Name:   "workflow:CreateThird",
+			Method: "POST", URLFunc: func() string { return projectUrl() + "/deliverables" },
+			Status:   http.StatusCreated,
+			BodyFunc: func() string { return draft },
+			CheckBody: func(dec *json.Decoder) error {
+				return getCreatedId(dec, &deliverableIds)
+			},
+		},
+		Test{
+			// Failed uploads don't submit the draft either.
+			Name:   "workflow:PutSubmittedNewerVersion",
+			Method: "PUT", URLFunc: thirdUrl, Status: http.StatusBadRequest,
+			BodyFunc: func() string {
+				return `{"Name":"B", "Description":"B", "Due":"2018-01-01T00:00:00Z",
+					"Submitted":true, "Version":10}`
+			},
+			CheckBody: checkProblem(http.StatusBadRequest, "invalid_body", "Version"),
+		},
+		Test{
+			Name:   "workflow:GetPutSubmittedNewerVersion",
+			Method: "GET", URLFunc: thirdUrl, Status: http.StatusOK,
+			CheckBody: checkState("draft", false),
+		},
+		Test{
+			Name:   "workflow:GetPutSubmittedNewerVersionHistory",
+			Method: "GET", URLFunc: func() string { return thirdUrl() + "/history" },
+			Status:    http.StatusOK,
+			CheckBody: checkHistory([]transition{}),
+		},
+	}
+}
+
+// vim: sw=4 ts=4 noexpandtab